@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+/*
+	ADDRESSES
+	A node listens on the multiaddresses given with -listen, or in the Listen entry of NETWORK_CONFIG,
+	or built from the IP, the port and the transports it is given. Without any of them,
+	it listens on the default addresses of libp2p, with ports picked by the system.
+
+	Among the addresses of a node, the one that the node shows and puts in the topology is chosen
+	by selectAddress, for the node itself and for its peers:
+		1. the scope of the address must be the wanted one: loopback for ADDR_LOOPBACK, any other for ADDR_LAN
+		   (if there is none, the other scope is taken)
+		2. TCP before QUIC, other transports are never chosen
+		3. IPv4 before IPv6
+		4. the first one, in the order given by libp2p
+*/
+type ListenConfig struct {
+	addrs		[]string	// Multiaddresses to listen on. If given, the other fields are ignored
+	ip			string		// IP to listen on, "" for every interface
+	port		int			// Port of TCP and QUIC, 0 if the system picks it
+	quic		bool		// Listen on QUIC too
+	loopback	bool		// Only listen on loopback
+}
+
+// Read the listen multiaddresses of the Listen entry of a config file.
+// A missing file or entry gives no addresses
+func readListenAddrs(config_filename string) ([]string, error) {
+	if _, err := os.Stat(config_filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	value, err := readConfigValue(config_filename, "Listen")
+	if err != nil {
+		return nil, err
+	}
+	return parseListenAddrs(value)
+}
+
+// Parse comma separated multiaddresses
+func parseListenAddrs(spec string) ([]string, error) {
+	var addrs []string
+	for _, a := range strings.Split(spec, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		_, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %s: %v", a, err)
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// Multiaddresses to listen on. Empty if the node listens on the default addresses of libp2p
+func (lc ListenConfig) addresses() []string {
+	if len(lc.addrs) > 0 {
+		return lc.addrs
+	}
+	if lc.ip == "" && lc.port == 0 && !lc.quic && !lc.loopback {
+		return nil
+	}
+
+	ip := lc.ip
+	if ip == "" {
+		ip = LISTEN_ALL_IP4
+		if lc.loopback {
+			ip = LISTEN_LOOPBACK_IP4
+		}
+	}
+	family := "ip4"
+	if strings.Contains(ip, ":") {
+		family = "ip6"
+	}
+	addrs := []string{fmt.Sprintf("/%s/%s/tcp/%d", family, ip, lc.port)}
+	if lc.quic {
+		addrs = append(addrs, fmt.Sprintf("/%s/%s/udp/%d/quic-v1", family, ip, lc.port))
+	}
+	return addrs
+}
+
+// Options of createNode listening on the addresses of the configuration
+func listenOptions(lc ListenConfig) []libp2p.Option {
+	addrs := lc.addresses()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return []libp2p.Option{libp2p.ListenAddrStrings(addrs...)}
+}
+
+// Choose the address of a node among its multiaddresses, see ADDRESSES. Nil if no address can be used
+func selectAddress(addrs []multiaddr.Multiaddr, ADDRESS_TYPE string) multiaddr.Multiaddr {
+	var best multiaddr.Multiaddr
+	best_rank := -1
+	for _, a := range addrs {
+		rank := addressRank(a, ADDRESS_TYPE)
+		if rank > best_rank {
+			best, best_rank = a, rank
+		}
+	}
+	return best
+}
+
+// Rank of an address for selectAddress, the higher the better. -1 if it can't be used
+func addressRank(a multiaddr.Multiaddr, ADDRESS_TYPE string) int {
+	if manet.IsIPUnspecified(a) || manet.IsIP6LinkLocal(a) {
+		return -1
+	}
+	protocols := a.Protocols()
+	if len(protocols) < 2 {
+		return -1
+	}
+
+	rank := 0
+	switch {
+	case len(protocols) == 2 && protocols[1].Code == multiaddr.P_TCP:
+		rank += 2
+	case len(protocols) == 3 && protocols[1].Code == multiaddr.P_UDP && protocols[2].Code == multiaddr.P_QUIC_V1:
+	default:
+		return -1
+	}
+	switch protocols[0].Code {
+	case multiaddr.P_IP4:
+		rank += 1
+	case multiaddr.P_IP6:
+	default:
+		return -1
+	}
+	if manet.IsIPLoopback(a) == (ADDRESS_TYPE == ADDR_LOOPBACK) {
+		rank += 4
+	}
+	return rank
+}
+
+// Scope of an address in the format "<ADDRESS>/p2p/<PEER_ID>": ADDR_LOOPBACK or ADDR_LAN
+func addressType(address string) string {
+	a, err := multiaddr.NewMultiaddr(address)
+	if err == nil && manet.IsIPLoopback(a) {
+		return ADDR_LOOPBACK
+	}
+	return ADDR_LAN
+}
+
+// Gets a string with the complete address of a node, chosen by selectAddress among its addresses.
+// The address is returned in the format "<ADDRESS>/p2p/<PEER_ID>", "" if the node has no usable address
+func getNodeAddress(h host.Host, ADDRESS_TYPE string) string {
+	a := selectAddress(h.Addrs(), ADDRESS_TYPE)
+	if a == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/p2p/%s", a, h.ID())
+}
+
+// Gets the complete address of a peer, from the addresses of the peerstore,
+// in the same scope as the address of this node. "" if the peer has no usable address
+func (n *Node) peerAddress(p peer.ID) string {
+	a := selectAddress(n.Peerstore().Addrs(p), addressType(n.address))
+	if a == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/p2p/%s", a, p)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"bufio"
 	"fmt"
 	"math/rand"
@@ -9,11 +10,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/libp2p/go-libp2p/core/host"
 )
 
-var bz Byzantine
-
 // Byzantine type represents various Byzantine faults in a network
 /*
 Type 1 = dealys actions
@@ -69,6 +67,47 @@ func readMaxByzantines(config_filename string, MAX_BYZANTINES *int) error {
 	return nil
 }
 
+// Read the seed of the random source of the nodes.
+// If the config file has no seed (or Seed=0) a new seed is generated from the wall clock:
+// it is written in the logs, so it can be put in the config file to replay the run
+func readSeed(config_filename string, seed *int64) error {
+	*seed = time.Now().UnixNano()
+	value, err := readConfigValue(config_filename, "Seed")
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Seed value: %v", err)
+		}
+		if val != 0 {
+			*seed = val
+		}
+	}
+	fmt.Println("RANDOM SEED: ", *seed)
+	return nil
+}
+
+// Read the value of a key from a config file. Returns "" if the key is not in the file
+func readConfigValue(config_filename string, key string) (string, error) {
+	file, err := os.Open(config_filename)
+	if err != nil {
+		return "", fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
 // LoadByzantineConfig reads the byzantine.config file and loads data into a Byzantine struct
 func LoadByzantineConfig(config_filename string) (Byzantine, error) {
 	bz := Byzantine{} // Default values
@@ -116,6 +155,8 @@ func LoadByzantineConfig(config_filename string) (Byzantine, error) {
 			bz.DropRate, err = strconv.ParseFloat(value, 64)
 		case "Alterations":
 			bz.Alterations = value
+		case "MAX_BYZANTINES", "Seed":
+			// Read by readMaxByzantines and readSeed
 		default:
 			fmt.Printf("Warning: Unknown config key '%s'\n", key)
 		}
@@ -133,17 +174,39 @@ func LoadByzantineConfig(config_filename string) (Byzantine, error) {
 	return bz, nil
 }
 
+// Turn this node into a byzantine, or back into a correct node if it already is one
+func toggleByzantine(thisNode *Node) {
+	if !thisNode.byzantine_status {
+		var err error
+		thisNode.bz, err = LoadByzantineConfig(BYZANTINE_CONFIG)
+		if err != nil {
+			printError(err)
+		}
+		if thisNode.address == console_address {
+			color_info = RED
+		}
+		event := fmt.Sprintf("byzantine - Node %s is now a byzantine", addressToPrint(thisNode.ID().String(), NODE_PRINTLAST))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	} else {
+		event := fmt.Sprintf("byzantine - Node %s is no more a byzantine", addressToPrint(thisNode.ID().String(), NODE_PRINTLAST))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		if thisNode.address == console_address {
+			color_info = GREEN
+		}
+	}
+	thisNode.byzantine_status = !thisNode.byzantine_status
+}
+
 // SwapTwoRandom swaps the position of two random strings in a slice.
 // If the slice has fewer than 2 elements, it does nothing.
-func SwapTwoRandom(list []string) []string {
+func SwapTwoRandom(rng *rand.Rand, list []string) []string {
     if len(list) < 2 {
         return list
     }
-    rand.Seed(time.Now().UnixNano())
-    i := rand.Intn(len(list))
-    j := rand.Intn(len(list))
+    i := rng.Intn(len(list))
+    j := rng.Intn(len(list))
     for j == i {
-        j = rand.Intn(len(list))
+        j = rng.Intn(len(list))
     }
     list[i], list[j] = list[j], list[i]
     return list
@@ -151,17 +214,19 @@ func SwapTwoRandom(list []string) []string {
 
 // Applies the bizantine changes on the message
 // Returns true if bz.Type2 == true, so that the message can be dropped in the main function
-func applyByzantine(thisNode host.Host, m *Message) bool {
-	if byzantine_status {
+func applyByzantine(ctx context.Context, thisNode *Node, m *Message) bool {
+	bz := thisNode.bz
+	rng := thisNode.rng
+	if thisNode.byzantine_status {
 		// If byzantine is of Type 1, then sleep for bz.Delay milliseconds
 		if bz.Type1 {
 			event := fmt.Sprintf("byzantine %s - delay of %s ms", m.Content, bz.Delay)
 			logEvent(thisNode.ID().String(), PRINTOPTION, event)
-			time.Sleep(bz.Delay)
+			clock.Sleep(ctx, bz.Delay)
 		}
 		// If byzantine is of Type 2, then drop the message with bz.Droprate probability
 		if bz.Type2 {
-			if (rand.Float64() < bz.DropRate) {
+			if (rng.Float64() < bz.DropRate) {
 				event := fmt.Sprintf("byzantine %s - Message from %s dropped", m.Content, addressToPrint(m.Sender, NODE_PRINTLAST))
 				logEvent(thisNode.ID().String(), PRINTOPTION, event)
 				return bz.Type2
@@ -172,8 +237,7 @@ func applyByzantine(thisNode host.Host, m *Message) bool {
 			if bz.Alterations == BYZ_NEIGHBOURHOOD {
 				if len(m.Neighbourhood) > 0 {
 					// Remove a random element from the neighbourhood
-					rand.Seed(time.Now().UnixNano())
-					index := rand.Intn(len(m.Neighbourhood))
+					index := rng.Intn(len(m.Neighbourhood))
 					removed := m.Neighbourhood[index]
 					m.Neighbourhood = append(m.Neighbourhood[:index], m.Neighbourhood[index+1:]...)
 					event := fmt.Sprintf("byzantine %s - Message from %s altered. Removed %s from neighbourhood.", m.Content, addressToPrint(m.Sender, NODE_PRINTLAST), addressToPrint(removed, NODE_PRINTLAST))
@@ -182,8 +246,7 @@ func applyByzantine(thisNode host.Host, m *Message) bool {
 			} else if bz.Alterations == BYZ_PATH {
 				if len(m.Path) > 0 {
 					// Remove a random element from the path
-					rand.Seed(time.Now().UnixNano())
-					index := rand.Intn(len(m.Path))
+					index := rng.Intn(len(m.Path))
 					removed := m.Path[index]
 					m.Path = append(m.Path[:index], m.Path[index+1:]...)
 					event := fmt.Sprintf("byzantine %s - Message from %s altered. Removed %s from path.", m.Content, addressToPrint(m.Sender, NODE_PRINTLAST), addressToPrint(removed, NODE_PRINTLAST))
@@ -191,11 +254,10 @@ func applyByzantine(thisNode host.Host, m *Message) bool {
 				}
 			} else if bz.Alterations == BYZ_SWAP_PATH {
 				if len(m.Path) > 1 {
-					rand.Seed(time.Now().UnixNano())
-					i := rand.Intn(len(m.Path))
-					j := rand.Intn(len(m.Path))
+					i := rng.Intn(len(m.Path))
+					j := rng.Intn(len(m.Path))
 					for j == i {
-						j = rand.Intn(len(m.Path))
+						j = rng.Intn(len(m.Path))
 					}
 					m.Path[i], m.Path[j] = m.Path[j], m.Path[i]
 					event := fmt.Sprintf("byzantine %s - Message from %s altered. Swapped %s and %s in path.", m.Content, addressToPrint(m.Sender, NODE_PRINTLAST), addressToPrint(m.Path[j], NODE_PRINTLAST), addressToPrint(m.Path[i], NODE_PRINTLAST))
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+	CLOCK
+	Every timing operation of the nodes goes through the clock, so that
+	protocols can run either on the wall clock or on a virtual clock.
+	The clock is shared by all the nodes of the process.
+	The context given to the clock tells whether the caller is an event of the virtual clock:
+	the functions run by the clock get the context of their event, and must pass it on to the clock.
+*/
+type Clock interface {
+	Now() time.Time
+	Sleep(ctx context.Context, d time.Duration)
+	Wait(ctx context.Context, done <-chan struct{}, d time.Duration) bool	// Wait until done is closed, for at most d. False if d has passed
+	AfterFunc(ctx context.Context, d time.Duration, fn func(ctx context.Context))	// Run fn after d
+	Run(ctx context.Context, fn func(ctx context.Context))							// Run fn and everything that it triggers
+}
+
+// Clock used by every node of this process
+var clock Clock = realClock{}
+
+/*
+	REAL CLOCK
+	Wall clock: things happen when they happen
+*/
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) Wait(ctx context.Context, done <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (realClock) AfterFunc(ctx context.Context, d time.Duration, fn func(ctx context.Context)) {
+	time.AfterFunc(d, func() {
+		fn(ctx)
+	})
+}
+
+// On the wall clock, what fn triggers keeps running on its own
+func (realClock) Run(ctx context.Context, fn func(ctx context.Context)) {
+	fn(ctx)
+}
+
+/*
+	VIRTUAL CLOCK
+	Discrete-event scheduler. Events are kept in a queue ordered by virtual time,
+	and time jumps from one event to the next one.
+	Events are run one at a time, each one in its own goroutine:
+	when an event sleeps or waits it is parked and given back to the queue,
+	so that only one goroutine is running at any moment and
+	every run with the same inputs produces the same ordering of events.
+	Each event gets a context holding its handle: with it, the clock knows that the caller is the running event.
+	Goroutines that are not events (console, libp2p callbacks, goroutines
+	started by an event) can sleep too: they wait for the virtual time to pass,
+	and run the events themselves if nobody else is running them.
+*/
+type VirtualClock struct {
+	mu		sync.Mutex
+	now		time.Time
+	seq		uint64				// Number of scheduled events, to order events with the same time
+	events	eventQueue
+	waiting	[]*event			// Timeouts of the goroutines waiting for a channel, see Wait
+	running	*eventHandle		// Event holding the clock, nil between two events
+	yield	chan struct{}		// The running event signals here when it ends or sleeps
+	looping	bool				// True while a goroutine is running the events
+	idle	*sync.Cond			// Signalled when the events stop running or a goroutine outside the events wakes up
+}
+
+// An event is either a new function to run or a parked goroutine to wake up
+type event struct {
+	at		time.Time
+	seq		uint64
+	fn		func(ctx context.Context)
+	ctx		context.Context		// Context of the caller that scheduled fn
+	handle	*eventHandle		// Event whose goroutine runs fn or is parked
+	wake	chan struct{}
+	outside	bool				// The sleeping goroutine is not an event: wake it up without waiting for it
+	done	<-chan struct{}		// Wake up before the time if closed, see Wait
+	woken	bool				// Already woken up by done: nothing to do at the time
+}
+
+// Handle of an event, held by the context of its goroutine
+type eventHandle struct {
+	vc	*VirtualClock
+}
+
+type eventKey struct{}
+
+// Return a new VirtualClock starting at time start
+func NewVirtualClock(start time.Time) *VirtualClock {
+	vc := &VirtualClock{
+		now:	start,
+		events:	make(eventQueue, 0),
+		yield:	make(chan struct{}),
+	}
+	vc.idle = sync.NewCond(&vc.mu)
+	return vc
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return vc.now
+}
+
+// Park the running event for d, letting the other events run.
+// Outside of the events, wait until the virtual time has passed
+func (vc *VirtualClock) Sleep(ctx context.Context, d time.Duration) {
+	vc.park(ctx, d, nil)
+}
+
+// Park the running event until done is closed by another event, for at most d
+func (vc *VirtualClock) Wait(ctx context.Context, done <-chan struct{}, d time.Duration) bool {
+	if isClosed(done) {
+		return true
+	}
+	vc.park(ctx, d, done)
+	return isClosed(done)
+}
+
+// Park the caller until d has passed or done is closed
+func (vc *VirtualClock) park(ctx context.Context, d time.Duration, done <-chan struct{}) {
+	wake := make(chan struct{})
+	if handle := vc.eventOf(ctx); handle != nil {
+		vc.schedule(&event{at: vc.Now().Add(d), handle: handle, wake: wake, done: done})
+		vc.yield <- struct{}{}
+		<-wake
+		return
+	}
+
+	vc.schedule(&event{at: vc.Now().Add(d), wake: wake, outside: true, done: done})
+	vc.mu.Lock()
+	for vc.looping && !isClosed(wake) {
+		vc.idle.Wait()
+	}
+	if isClosed(wake) {
+		vc.mu.Unlock()
+		return
+	}
+	// Nobody is running the events: run them until it's time to wake up
+	vc.looping = true
+	vc.mu.Unlock()
+	vc.runEvents(wake)
+}
+
+func (vc *VirtualClock) AfterFunc(ctx context.Context, d time.Duration, fn func(ctx context.Context)) {
+	vc.schedule(&event{at: vc.Now().Add(d), fn: fn, ctx: ctx})
+}
+
+// Run fn as an event and then all the events until the queue is empty
+func (vc *VirtualClock) Run(ctx context.Context, fn func(ctx context.Context)) {
+	vc.schedule(&event{at: vc.Now(), fn: fn, ctx: ctx})
+	vc.mu.Lock()
+	for vc.looping {
+		vc.idle.Wait()
+	}
+	vc.looping = true
+	vc.mu.Unlock()
+	vc.runEvents(nil)
+}
+
+// Run the events one at a time until the queue is empty or until is closed
+func (vc *VirtualClock) runEvents(until chan struct{}) {
+	for {
+		vc.mu.Lock()
+		vc.running = nil
+		vc.wakeWaiting()
+		if vc.events.Len() == 0 || isClosed(until) {
+			vc.looping = false
+			vc.idle.Broadcast()
+			vc.mu.Unlock()
+			return
+		}
+		e := heap.Pop(&vc.events).(*event)
+		if e.done != nil {
+			vc.forget(e)
+		}
+		if e.woken {
+			vc.mu.Unlock()
+			continue
+		}
+		vc.now = e.at
+		if e.outside {
+			close(e.wake)
+			vc.idle.Broadcast()
+			vc.mu.Unlock()
+			continue
+		}
+		if e.handle == nil {
+			e.handle = &eventHandle{vc: vc}
+		}
+		vc.running = e.handle
+		vc.mu.Unlock()
+
+		if e.wake != nil {
+			e.wake <- struct{}{}
+		} else {
+			go vc.runEvent(e)
+		}
+		// Wait until the event ends or sleeps
+		<-vc.yield
+	}
+}
+
+// Goroutine of an event, whose context holds the handle of the event
+func (vc *VirtualClock) runEvent(e *event) {
+	ctx := e.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	e.fn(context.WithValue(ctx, eventKey{}, e.handle))
+	vc.yield <- struct{}{}
+}
+
+// Add an event to the queue. Must be called with vc.mu unlocked
+func (vc *VirtualClock) schedule(e *event) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	vc.push(e)
+}
+
+// Add an event to the queue. Must be called with vc.mu locked
+func (vc *VirtualClock) push(e *event) {
+	vc.seq++
+	e.seq = vc.seq
+	heap.Push(&vc.events, e)
+	if e.done != nil {
+		vc.waiting = append(vc.waiting, e)
+	}
+}
+
+// Wake up now the goroutines whose channel has been closed by the last event.
+// Must be called with vc.mu locked
+func (vc *VirtualClock) wakeWaiting() {
+	for _, e := range append([]*event{}, vc.waiting...) {
+		if !isClosed(e.done) {
+			continue
+		}
+		vc.forget(e)
+		e.woken = true
+		vc.push(&event{at: vc.now, handle: e.handle, wake: e.wake, outside: e.outside})
+	}
+}
+
+// Stop watching the channel of an event. Must be called with vc.mu locked
+func (vc *VirtualClock) forget(e *event) {
+	for i, w := range vc.waiting {
+		if w == e {
+			vc.waiting = append(vc.waiting[:i], vc.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Handle of the event running with the context ctx, nil if the caller is not the running event
+func (vc *VirtualClock) eventOf(ctx context.Context) *eventHandle {
+	if ctx == nil {
+		return nil
+	}
+	handle, ok := ctx.Value(eventKey{}).(*eventHandle)
+	if !ok || handle.vc != vc {
+		return nil
+	}
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	// The context of a parked event may have been given to another goroutine
+	if vc.running != handle {
+		return nil
+	}
+	return handle
+}
+
+// Give to the context ctx the handle of the event running with the context of the event,
+// so that the clock knows the caller. A context that is not of an event leaves ctx as it is
+func withEvent(ctx context.Context, event_ctx context.Context) context.Context {
+	if event_ctx == nil {
+		return ctx
+	}
+	handle, ok := event_ctx.Value(eventKey{}).(*eventHandle)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, eventKey{}, handle)
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Priority queue of events, ordered by time and then by scheduling order
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x any) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	*q = old[:n-1]
+	return e
+}
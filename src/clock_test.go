@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var clock_start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Events sleeping inside Run are woken up in virtual time order
+func TestVirtualClockSleepInRun(t *testing.T) {
+	vc := NewVirtualClock(clock_start)
+	var order []int
+	vc.Run(context.Background(), func(ctx context.Context) {
+		vc.AfterFunc(ctx, 0, func(ctx context.Context) {
+			vc.Sleep(ctx, 2 * time.Second)
+			order = append(order, 2)
+		})
+		vc.Sleep(ctx, time.Second)
+		order = append(order, 1)
+		vc.Sleep(ctx, 2 * time.Second)
+		order = append(order, 3)
+	})
+
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("events woken up in order %v, expected [1 2 3]", order)
+	}
+	if got := vc.Now().Sub(clock_start); got != 3*time.Second {
+		t.Fatalf("virtual time %v after Run, expected 3s", got)
+	}
+}
+
+// A goroutine that is not an event runs the events itself until it wakes up
+func TestVirtualClockSleepOutsideRun(t *testing.T) {
+	vc := NewVirtualClock(clock_start)
+	ran := false
+	vc.AfterFunc(context.Background(), time.Second, func(ctx context.Context) {
+		ran = true
+	})
+	vc.AfterFunc(context.Background(), time.Minute, func(ctx context.Context) {
+		t.Error("event after the end of the sleep was run")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		vc.Sleep(context.Background(), 5 * time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep outside Run never returned")
+	}
+
+	if !ran {
+		t.Fatal("event before the end of the sleep was not run")
+	}
+	if got := vc.Now().Sub(clock_start); got != 5*time.Second {
+		t.Fatalf("virtual time %v after the sleep, expected 5s", got)
+	}
+}
+
+// A goroutine started by an event sleeps while Run is running the events,
+// even with the context of the event once the event is parked
+func TestVirtualClockSleepOutsideEvent(t *testing.T) {
+	vc := NewVirtualClock(clock_start)
+	woken := make(chan time.Time, 1)
+	vc.Run(context.Background(), func(ctx context.Context) {
+		parked := make(chan struct{})
+		go func() {
+			<-parked
+			vc.Sleep(ctx, time.Second)
+			woken <- vc.Now()
+		}()
+		vc.AfterFunc(ctx, 0, func(context.Context) {
+			close(parked)
+		})
+		vc.Sleep(ctx, 10 * time.Second)
+	})
+
+	select {
+	case at := <-woken:
+		if at.Before(clock_start.Add(time.Second)) {
+			t.Fatalf("goroutine woken up at %v, before its sleep ended", at.Sub(clock_start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep of a goroutine started by an event never returned")
+	}
+}
+
+// An event waiting for a channel wakes up when another event closes it, or at the timeout
+func TestVirtualClockWait(t *testing.T) {
+	vc := NewVirtualClock(clock_start)
+	var closed_at, timeout_at time.Duration
+	closed, timeout := false, true
+	vc.Run(context.Background(), func(ctx context.Context) {
+		done := make(chan struct{})
+		vc.AfterFunc(ctx, 2 * time.Second, func(context.Context) {
+			close(done)
+		})
+		closed = vc.Wait(ctx, done, 10 * time.Second)
+		closed_at = vc.Now().Sub(clock_start)
+
+		timeout = vc.Wait(ctx, make(chan struct{}), 3 * time.Second)
+		timeout_at = vc.Now().Sub(clock_start)
+	})
+
+	if !closed || closed_at != 2*time.Second {
+		t.Fatalf("wait on a channel closed at 2s returned %v at %v", closed, closed_at)
+	}
+	if timeout || timeout_at != 5*time.Second {
+		t.Fatalf("wait on a channel never closed returned %v at %v, expected false at 5s", timeout, timeout_at)
+	}
+	// The timeout of the first wait is not an event anymore
+	if got := vc.Now().Sub(clock_start); got != 5*time.Second {
+		t.Fatalf("virtual time %v after Run, expected 5s", got)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	CLUSTER
+	Every node of a topology file runs in its own headless process on loopback,
+	started by this process, that is the master of the cluster.
+	The console of this process is the console of the master node.
+
+	Process i runs the node with the i-th label of the file, in alphabetical order.
+	Nodes register their label to the master, that replaces it in its own copy of the topology
+	and then sends the complete topology to every node: no file is written by more than one process.
+	The output of each node goes to its own file in the cluster directory.
+	With a key directory and a base port, the master and the nodes get the same addresses on every run.
+*/
+type ClusterNode struct {
+	label			string
+	port			int				// Listen port of the node, 0 if the system picks it
+	topology_file	string			// Copy of the topology of this node
+	output_file		string			// Standard output and error of the node
+	cmd				*exec.Cmd
+	output			*os.File
+}
+
+type Cluster struct {
+	dir			string
+	master		*SimNode				// The master runs in this process
+	nodes		[]*ClusterNode			// Sorted by label
+	stop_once	sync.Once
+}
+
+// Options of a cluster
+type ClusterConfig struct {
+	topology_file	string
+	dir				string				// Directory of the topology copies and of the output of the nodes
+	bin				string				// Executable of the nodes
+	encoding		string				// Encoding of the messages of every node, ENC_JSON or ENC_BINARY
+	heartbeat		time.Duration		// Time between two heartbeats of the failure detectors, 0 if they don't run
+	persist			string				// State saved by every node when it shuts down, see persistState
+	pool			PoolConfig			// Queue and workers of the protocols of every node
+	limit			string				// Rate limits of every node, see parseRateLimits
+	limit_suspect	bool				// Nodes report the peers over a rate limit as suspects
+	keys			string				// Directory of the key files of the master and of the nodes, see identity.go
+	port			int					// Listen port of the master, node i listens on port+1+i. 0 if the system picks them
+	psk				string				// Key file of the private network of the cluster, PSK_NEW for a fresh one. "" if there is none
+	gate			bool				// Every node only connects to its neighbours and to the master, see gater.go
+	links			string				// Links file emulating the links of the nodes, see links.go. "" if links are not emulated
+	nabopt			string				// Modifications of the DolevU broadcast of every node, see parseOptimisations
+	bdopt			string				// Optimisations of the Bracha-Dolev reliable broadcast of every node, see parseOptimisations
+}
+
+// Start the master, then one process for each node of the topology
+func NewCluster(ctx context.Context, config ClusterConfig) (*Cluster, error) {
+	if config.encoding == "" {
+		config.encoding = ENC_JSON
+	}
+	err := validEncoding(config.encoding)
+	if err != nil {
+		return nil, err
+	}
+	err = validPoolConfig(config.pool)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := parseRateLimits(config.limit)
+	if err != nil {
+		return nil, err
+	}
+	if config.nabopt == "" {
+		config.nabopt = OPT_NONE
+	}
+	_, err = parseOptimisations(config.nabopt, NAB_OPTIMISATIONS)
+	if err != nil {
+		return nil, err
+	}
+	if config.bdopt == "" {
+		config.bdopt = OPT_NONE
+	}
+	_, err = parseOptimisations(config.bdopt, BDOPT_OPTIMISATIONS)
+	if err != nil {
+		return nil, err
+	}
+	// The nodes load the links file themselves: it is only checked here
+	if config.links != "" {
+		_, err = loadLinks(config.links)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	topology_graph := LoadGraphFromCSV(config.topology_file)
+	var labels []string
+	for label := range topology_graph.nodes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	err = os.MkdirAll(config.dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster directory: %v", err)
+	}
+
+	// Start the master on its own copy of the topology
+	master_topology := filepath.Join(config.dir, "topology.csv")
+	err = copyFile(config.topology_file, master_topology)
+	if err != nil {
+		return nil, err
+	}
+	// A fresh key makes a cluster that no other experiment can join
+	if config.psk == PSK_NEW {
+		psk, err := newPSK()
+		if err != nil {
+			return nil, err
+		}
+		config.psk = filepath.Join(config.dir, "swarm.key")
+		err = savePSK(config.psk, psk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	psk_options, psk_id, err := pskOptions(config.psk)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := identityOptions(config.keys, CLS_MASTER_LABEL)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, listenOptions(ListenConfig{port: config.port, loopback: true})...)
+	options = append(options, psk_options...)
+	h := createNode(options...)
+	if h == nil {
+		return nil, fmt.Errorf("failed to create the master")
+	}
+	cluster := &Cluster{
+		dir:	config.dir,
+		master:	newSimNode(h, CLS_MASTER_LABEL),
+	}
+	master := cluster.master.node
+	master.topology_path = master_topology
+	master.psk_path, master.psk_id = config.psk, psk_id
+	master.transport.SetEncoding(config.encoding)
+	master.pool_config = config.pool
+	master.limiter.setLimits(limits, config.limit_suspect)
+	readMaxByzantines(BYZANTINE_CONFIG, &master.max_byzantines)
+	var seed int64
+	readSeed(BYZANTINE_CONFIG, &seed)
+	master.setSeed(seed)
+	cluster.master.run(ctx)
+	master.startFailureDetector(ctx, config.heartbeat)
+
+	// Start the nodes
+	for i, label := range labels {
+		cn := &ClusterNode{
+			label:			label,
+			topology_file:	filepath.Join(config.dir, label+".csv"),
+			output_file:	filepath.Join(config.dir, label+".log"),
+		}
+		if config.port != 0 {
+			cn.port = config.port + 1 + i
+		}
+		cluster.nodes = append(cluster.nodes, cn)
+
+		err := cn.start(config, master.address)
+		if err != nil {
+			cluster.Stop()
+			return nil, fmt.Errorf("failed to start node %s: %v", label, err)
+		}
+	}
+
+	return cluster, nil
+}
+
+// Wait for every node to register its label to the master
+func (cluster *Cluster) waitNodes(ctx context.Context, timeout time.Duration) error {
+	master := cluster.master.node
+	deadline := clock.Now().Add(timeout)
+	for master.countLabels() < len(cluster.nodes) {
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("only %d of %d nodes registered to the master", master.countLabels(), len(cluster.nodes))
+		}
+		clock.Sleep(ctx, 100 * time.Millisecond)
+	}
+	return nil
+}
+
+// Start the process of the node, connected to the master
+func (cn *ClusterNode) start(config ClusterConfig, master_address string) error {
+	err := copyFile(config.topology_file, cn.topology_file)
+	if err != nil {
+		return err
+	}
+	cn.output, err = os.Create(cn.output_file)
+	if err != nil {
+		return err
+	}
+
+	cn.cmd = exec.Command(config.bin, "-loopback", "-encoding", config.encoding, "-hb", config.heartbeat.String(),
+		"-persist", config.persist, "-queue", fmt.Sprint(config.pool.size), "-workers", fmt.Sprint(config.pool.workers),
+		"-overload", config.pool.policy, "-limit", config.limit, fmt.Sprintf("-limit-suspect=%t", config.limit_suspect),
+		"-keys", config.keys, "-port", fmt.Sprint(cn.port), "-psk", config.psk, fmt.Sprintf("-gate=%t", config.gate), "-links", config.links, "-nabopt", config.nabopt, "-bdopt", config.bdopt, "-t", cn.topology_file, "-n", cn.label, "-d", master_address)
+	cn.cmd.Stdout = cn.output
+	cn.cmd.Stderr = cn.output
+	return cn.cmd.Start()
+}
+
+// Stop the process of the node: it is interrupted first, so that it leaves the network,
+// and killed if it doesn't exit in time
+func (cn *ClusterNode) stop() {
+	if cn.cmd == nil || cn.cmd.Process == nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cn.cmd.Wait() }()
+
+	cn.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-done:
+	case <-time.After(CLS_STOP_TIMEOUT):
+		cn.cmd.Process.Kill()
+		<-done
+	}
+	cn.output.Close()
+}
+
+// Send the complete topology to the nodes, then make them load it and connect with their neighbours
+func (cluster *Cluster) setUp(ctx context.Context) {
+	master := cluster.master
+	for _, command := range []string{mst_top, mst_top_load, mst_connectall} {
+		executeCommand(ctx, master.node, cmd_master+" "+command, master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+		clock.Sleep(ctx, CLS_STEP_INTERVAL)
+	}
+}
+
+// Stop all the nodes of the cluster and the master. Safe to call more than once
+func (cluster *Cluster) Stop() {
+	cluster.stop_once.Do(func() {
+		var wg sync.WaitGroup
+		for _, cn := range cluster.nodes {
+			wg.Add(1)
+			go func(cn *ClusterNode) {
+				defer wg.Done()
+				cn.stop()
+			}(cn)
+		}
+		wg.Wait()
+		cluster.master.node.Close()
+		fmt.Printf("Cluster stopped: %d nodes\n", len(cluster.nodes))
+	})
+}
+
+// Print the nodes of the cluster with their processes and output files
+func (cluster *Cluster) toString() string {
+	str := fmt.Sprintf("\n%s##### CLUSTER #####%s\n", CYAN, RESET)
+	str += fmt.Sprintf("%sMASTER%s\t%s\n", color_info, RESET, cluster.master.node.address)
+	for _, cn := range cluster.nodes {
+		address, _ := cluster.master.node.getLabel(cn.label)
+		str += fmt.Sprintf("%s%s%s\tpid %d\t%s\t%s\n", color_info, cn.label, RESET, cn.cmd.Process.Pid, cn.output_file, address)
+	}
+	str += fmt.Sprintf("%s###################%s\n", CYAN, RESET)
+	return str
+}
+
+// Copy the file at src into dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// Entry point of the "cluster" subcommand.
+// Starts the cluster and gives the console of the master node to the user.
+// The nodes are stopped when the console is closed or the process is interrupted
+func runCluster(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet(cmd_cluster, flag.ExitOnError)
+	top := flags.String("topology", topology_path, "Topology .csv file of the cluster")
+	dir := flags.String("dir", CLS_DIR, "Directory of the topology copies and of the output of the nodes")
+	bin := flags.String("bin", "", "Executable of the nodes. Default: this executable")
+	timeout := flags.Duration("timeout", CLS_START_TIMEOUT, "Time given to the nodes to register to the master")
+	scn := flags.String("scenario", "", "Scenario file to run on the master. The cluster stops with the scenario")
+	enc := flags.String("encoding", ENC_JSON, "Encoding of the messages of every node: "+ENC_JSON+" or "+ENC_BINARY)
+	hb := flags.Duration("hb", HB_INTERVAL, "Time between two heartbeats of the failure detectors. 0 to disable them")
+	queue := flags.Int("queue", POOL_QUEUE_SIZE, "Messages that can wait in the queue of each protocol of every node")
+	workers := flags.Int("workers", POOL_WORKERS, "Messages of each protocol handled at the same time by every node")
+	overload := flags.String("overload", POOL_BLOCK, "What to do when a queue is full: "+POOL_BLOCK+", "+POOL_DROP_OLDEST+" or "+POOL_DROP_NEW)
+	limit := flags.String("limit", "", "Rate limits of the messages of each peer on every node, by protocol: NAME=RATE:BURST,...")
+	limit_suspect := flags.Bool("limit-suspect", false, "Nodes report the peers over a rate limit as suspects")
+	persist := flags.String("persist", "", "Comma separated state saved by every node when it shuts down: "+PERSIST_CTOP+", "+PERSIST_DELIVERED)
+	keys := flags.String("keys", "", "Directory of the key files of the master and of the nodes, that keep their identity across runs")
+	port := flags.Int("port", 0, "Listen port of the master, node i of the topology listens on port+1+i. 0 lets the system pick them")
+	psk := flags.String("psk", "", "Key file of the private network of the cluster, or "+PSK_NEW+" for a fresh one")
+	gate := flags.Bool("gate", false, "Every node only connects to its neighbours in the topology and to the master")
+	links := flags.String("links", "", "Links file emulating latency, jitter, loss and bandwidth on the links of the nodes")
+	nabopt := flags.String("nabopt", OPT_NONE, "Modifications of the DolevU broadcast (/nab/) of every node: "+OPT_ALL+", "+OPT_NONE+" or NAME,...")
+	bdopt := flags.String("bdopt", OPT_NONE, "Optimisations of the Bracha-Dolev reliable broadcast of every node: "+OPT_ALL+", "+OPT_NONE+" or NAME,...")
+	flags.Parse(args)
+
+	if *bin == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Failed to find the executable of the nodes: %v", err)
+		}
+		*bin = executable
+	}
+
+	cluster, err := NewCluster(ctx, ClusterConfig{topology_file: *top, dir: *dir, bin: *bin, encoding: *enc, heartbeat: *hb, persist: *persist,
+		pool: PoolConfig{size: *queue, workers: *workers, policy: *overload}, limit: *limit, limit_suspect: *limit_suspect,
+		keys: *keys, port: *port, psk: *psk, gate: *gate, links: *links, nabopt: *nabopt, bdopt: *bdopt})
+	if err != nil {
+		log.Fatalf("Failed to start the cluster: %v", err)
+	}
+	defer cluster.Stop()
+
+	// Stop the nodes when the process is interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cluster.Stop()
+		os.Exit(0)
+	}()
+
+	err = cluster.waitNodes(ctx, *timeout)
+	if err != nil {
+		cluster.Stop()
+		log.Fatalf("Failed to start the cluster: %v", err)
+	}
+
+	master := cluster.master
+	console_address = master.node.address
+	cluster.setUp(ctx)
+	fmt.Print(cluster.toString())
+
+	if *scn != "" {
+		runScenario(ctx, master.node, *scn, master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+		return
+	}
+
+	printStartMessage(master.node, mod_help_mst)
+
+	manageConsoleInput(ctx, master.node, master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+}
@@ -1,11 +1,10 @@
 package main
 
-var master_address string = ""
-var thisnode_address string = ""
+import "time"
+
+var console_address string = ""		// Address of the node attached to this console. Errors are logged under it
 var color_info = GREEN
 var color_desc = CYAN
-var byzantine_status = false
-var MAX_BYZANTINES		= 0
 
 const (
 	// Byzantine related constants
@@ -20,19 +19,115 @@ const (
 	ADDR_DEFAULT	= "LAN"
 	ADDR_LOOPBACK	= "LOOPBACK"
 	ADDR_LAN		= "LAN"
-	ADDR_LB_POS		= 0
-	ADDR_LAN_POS	= 3
 	WHOLE_ADDR		= -1				// For a node, print the whole address
 	NODE_PRINTLAST	= 5					// For a node, print only the last n characters of its address
+	LISTEN_ALL_IP4		= "0.0.0.0"		// Listen on every interface
+	LISTEN_LOOPBACK_IP4	= "127.0.0.1"	// Listen on loopback only
+	NETWORK_CONFIG		= "../config/network.config"	// Listen addresses of the nodes, see addresses.go
+
+	// Discovery related constants
+	DISC_SERVICE		= "_argo._udp"			// mDNS service of the ARGO nodes
+	DISC_AGENT_PREFIX	= "argo/"				// User agent of a node with a label: DISC_AGENT_PREFIX + label
+	DISC_TIMEOUT		= 5 * time.Second		// Time given to a found peer to connect and tell its label
+	DISC_POLL			= 50 * time.Millisecond	// Time between two checks of the label of a peer
+
+	// Scenario related constants
+	SCN_CMD_TIMEOUT		= 10 * time.Second		// Time given to a node to run a command of a scenario and answer
+
+	// Private network related constants
+	PSK_FILE			= "../config/swarm.key"		// Key file of a node started without one, where the keys of the master are saved
+	PSK_HEADER			= "/key/swarm/psk/1.0.0/"	// First line of a swarm key file
+	PSK_SIZE			= 32						// Bytes of a key
+	PSK_FINGERPRINT		= 8							// Characters of the fingerprint of a key
+	PSK_NEW				= "new"						// Given as key file of a cluster, a fresh key is generated
+	KEY_EXT			= ".key"			// Extension of the key files of the nodes, see identity.go
+
+	// Link emulation related constants
+	LINKS_HEADER		= "NODE"			// First field of the header of a links file
+	LINK_ANY			= "*"				// Label of the default edge of a links file: *,*
+	LINK_UNIFORM		= "uniform"			// Jitter uniform in [-JITTER, JITTER]
+	LINK_NORMAL			= "normal"			// Jitter normal with standard deviation JITTER
+	LINK_EXPONENTIAL	= "exponential"		// Jitter exponential with mean JITTER
+	LINK_DIAL_ATTEMPTS	= 10					// Dials of a restored or added link, while the other end lets it through its gate
+	LINK_DIAL_RETRY		= 200 * time.Millisecond	// Time between two dials of a restored or added link
+
+	// Optimisations of the protocols, see parseOptimisations
+	OPT_ALL				= "all"
+	OPT_NONE			= "none"
+
+	// Optimisations of DolevU, the broadcast of /nab/, see protocol_broadcast.go
+	NAB_STOP			= "stop"			// A node that delivered a message does not relay its copies
+	NAB_EMPTY			= "empty"			// A node that delivered a message relays it once with an empty path, instead of its copies
+	NAB_IGNORE			= "ignore"			// Copies through a neighbour that delivered the message are dropped
+	NAB_SKIP			= "skip"			// Copies are not sent to the neighbours that delivered the message
+
+	// Optimisations of the Bracha-Dolev reliable broadcast, see protocol_bdopt.go
+	BDOPT_DIRECT		= "direct"			// A message received from the node that made it is delivered at once
+	BDOPT_EMPTY			= "empty"			// Once delivered, a message is relayed once with an empty path, and its paths no more
+	BDOPT_SKIP			= "skip"			// Messages are not sent to the neighbours that delivered them
+	BDOPT_IGNORE		= "ignore"			// Paths through a neighbour that delivered the message are ignored
+	BDOPT_IMPLICIT		= "implicit"		// The SEND of the source is its ECHO too
+	BDOPT_NOECHO		= "noecho"			// A node that sent READY does not send ECHO
+
+	// Simulation related constants
+	SIM_CLOCK_REAL		= "real"				// Simulated nodes run on the wall clock and talk through libp2p streams
+	SIM_CLOCK_VIRTUAL	= "virtual"				// Simulated nodes run on the virtual clock of the discrete-event scheduler
+	SIM_LINK_DELAY		= time.Millisecond		// Time needed by a message to cross a link on the virtual clock
+	SIM_BASE_PORT		= 10000					// Simulated node i listens on SIM_BASE_PORT+i
+
+	// Sweep related constants
+	SWP_OUTPUT			= "../logs/sweep.csv"	// Default results file of a sweep
+	SWP_PLACE_RANDOM	= "random"				// Byzantines are chosen at random with the seed of the run
+	SWP_PLACE_MAXDEGREE	= "maxdegree"			// Byzantines are the nodes with more neighbours
+	SWP_PLACE_MINDEGREE	= "mindegree"			// Byzantines are the nodes with less neighbours
+	SWP_FAULT_DELAY		= "1"					// Type1 byzantines
+	SWP_FAULT_DROP		= "2"					// Type2 byzantines
+	SWP_FAULT_ALTER		= "3"					// Type3 byzantines, one run for each alteration
+	SWP_CNT_INTERVAL	= 1500 * time.Millisecond	// Time between two CNT phase commands
+
+	// Cluster related constants
+	CLS_DIR				= "../logs/cluster"			// Topology copies and output of the nodes of a cluster
+	CLS_MASTER_LABEL	= "MASTER"				// Label of the master of a cluster, also the name of its key file
+	CLS_START_TIMEOUT	= 30 * time.Second		// Time given to the nodes to register to the master
+	CLS_STOP_TIMEOUT	= 5 * time.Second		// Time given to the nodes to exit before being killed
+	CLS_STEP_INTERVAL	= 1500 * time.Millisecond	// Time between two set up commands of the master
 
 	// Protocol related constants
-	PROTOCOL_CHAT	= "/chat/"
-	PROTOCOL_NAB	= "/nab/"			// This is actually a Byzantine Reliable Broadcast, granted by DolevU protocol
-	PROTOCOL_EXP	= "/exp/"			// Protocol fo Explorer algorithm (WARNING: explorer has been proved wrong)
-	PROTOCOL_DET	= "/det/"			// Protocol for Detector algorithm
-	PROTOCOL_EXP2	= "/exp2/"			// Protocol for Explorer2 algorithm
-	PROTOCOL_MST	= "/mst/"			// Protocol to manage master-slave operations
-	PROTOCOL_CRC	= "/crc/"			// Protocol for CombinedRC algorithm
+	// IDs are "/argo/<NAME>/<MAJOR.MINOR.PATCH>": bump the major version when a change
+	// to the messages or to the semantics of a protocol breaks older nodes (see versions.go)
+	PROTOCOL_CHAT	= "/argo/chat/1.0.0"
+	PROTOCOL_NAB	= "/argo/nab/1.0.0"		// This is actually a Byzantine Reliable Broadcast, granted by DolevU protocol
+	PROTOCOL_EXP	= "/argo/exp/1.0.0"		// Protocol fo Explorer algorithm (WARNING: explorer has been proved wrong)
+	PROTOCOL_DET	= "/argo/det/1.0.0"		// Protocol for Detector algorithm
+	PROTOCOL_EXP2	= "/argo/exp2/1.0.0"	// Protocol for Explorer2 algorithm
+	PROTOCOL_MST	= "/argo/mst/1.0.0"		// Protocol to manage master-slave operations
+	PROTOCOL_CRC	= "/argo/crc/1.0.0"		// Protocol for CombinedRC algorithm
+	PROTOCOL_HB		= "/argo/hb/1.0.0"		// Protocol of the heartbeats and leave messages of the failure detector
+	PROTOCOL_BRB	= "/argo/brb/1.0.0"		// Protocol for Bracha reliable broadcast, on fully connected networks
+	PROTOCOL_BDOPT	= "/argo/bdopt/1.0.0"	// Protocol for Bracha-Dolev reliable broadcast with optimisations, on partially connected networks
+	PROTOCOL_PREFIX	= "/argo/"
+	FRAME_MAX_SIZE	= 64 << 20			// Largest message accepted on a stream, log files included
+
+	// Worker pool related constants
+	POOL_QUEUE_SIZE		= 1024			// Default number of messages that can wait in the queue of a protocol
+	POOL_WORKERS		= 4				// Default number of messages of a protocol handled at the same time
+	POOL_BLOCK			= "block"		// When the queue is full, stop reading the stream until there is room
+	POOL_DROP_OLDEST	= "drop-oldest"	// When the queue is full, drop the oldest message of the queue
+	POOL_DROP_NEW		= "drop-new"	// When the queue is full, drop the new message
+	POOL_LOG_EVERY		= 100			// Overloads are logged once every POOL_LOG_EVERY
+
+	// Shutdown related constants
+	SHUTDOWN_TIMEOUT	= 2 * time.Second			// Time given to the leave messages to be sent
+	SHUTDOWN_LINGER		= 200 * time.Millisecond	// Time given to the leave messages to cross the connections before they are closed
+	PERSIST_CTOP		= "ctop"					// Save the cTop of the node at shutdown, as a topology file
+	PERSIST_DELIVERED	= "delivered"				// Save the messages delivered by the node at shutdown, as json
+
+	// Message encoding related constants
+	ENC_JSON			= "json"		// Messages are written as json objects, easy to read
+	ENC_BINARY			= "binary"		// Messages are written with the compact binary encoding of encoding.go
+	ENC_BINARY_MAGIC	= 0x01			// First byte of a binary message
+	ENC_ENTRY_STRING	= 0x00			// Entry of the address table that is a plain string
+	ENC_ENTRY_ADDR		= 0x01			// Entry of the address table that is a multiaddr with a peer ID
 
 	TYPE_BROADCAST	= "BROADCAST"
 	TYPE_DIRECT_MSG	= "DIRECTMSG" 
@@ -44,6 +139,18 @@ const (
 	TYPE_CRC_CNT	= "COMBINEDRC_CNT"	// Content type for combinedRC message exchange
 	TYPE_CRC_ROU	= "COMBINEDRC_ROU"	// Route type for combinedRC message exchange
 	TYPE_CRC_EXP	= "COMBINEDRC_EXP"	// Exploration type for combinedRC message exchange
+	TYPE_HEARTBEAT	= "HEARTBEAT"
+	TYPE_LEAVE		= "LEAVE"			// Sent by a node that shuts down
+	TYPE_BRB_SEND	= "BRB_SEND"		// Bracha reliable broadcast: message of the source
+	TYPE_BRB_ECHO	= "BRB_ECHO"		// Bracha reliable broadcast: echo of the message of the source
+	TYPE_BRB_READY	= "BRB_READY"		// Bracha reliable broadcast: the node is ready to deliver
+
+	// Failure detector related constants
+	HB_INTERVAL			= time.Second				// Default time between two heartbeats
+	HB_WINDOW			= 100						// Number of intervals between heartbeats remembered for each neighbour
+	HB_PHI_THRESHOLD	= 8.0						// A neighbour is suspected when its phi goes over this
+	HB_MIN_STDDEV		= 100 * time.Millisecond	// Heartbeats that always come on time don't make phi explode
+	HB_ACCEPTABLE_PAUSE	= 2 * time.Second			// Silence that is not suspicious, e.g. a node busy relaying a flood
 
 	// Commands
 	cmd_help 		= "-help"
@@ -65,6 +172,14 @@ const (
 	cmd_master		= "-master"
 	cmd_byzantine	= "-byzantine"
 	cmd_crc			= "-crc"
+	cmd_brb			= "-brb"
+	cmd_bdopt		= "-bdopt"
+	cmd_scenario	= "-scenario"
+
+	// Subcommands of the argo executable
+	cmd_sim			= "sim"
+	cmd_sweep		= "sweep"
+	cmd_cluster		= "cluster"
 
 	// Master commands
 	mst_top_acquire	= "TOPACQUIRE"
@@ -80,6 +195,21 @@ const (
 	mst_printprot	= "PROTOCOLS"
 	mst_byzantine	= "BYZ"
 	mst_reset		= "RESET"
+	mst_seed		= "SEED"
+	mst_cmd			= "COMMAND"			// Type of the messages that make a node run a console command
+	mst_cmd_done	= "COMMAND_DONE"	// Type of the answer of the node when the command has been run
+	mst_label		= "LABEL"			// Type of the messages that tell the master the label of a node
+	mst_psk			= "PSK"				// Type of the messages that give a fresh private network key to the nodes
+	mst_link		= "LINK"			// Type of the messages that change a link between two nodes, see rewiring.go
+	mst_link_cut	= "CUT"
+	mst_link_restore	= "RESTORE"
+	mst_link_add	= "ADD"
+	mst_link_remove	= "REMOVE"
+	mst_link_truth	= "TRUTH"			// The change of the link is made to the topology of the file too
+
+	// Scenario steps that are not node labels
+	SCN_MASTER		= "master"
+	SCN_WAIT		= "wait"
 	
 	// Mode in which some commands are called
 	mod_help_def	= "DEFAULT"
@@ -101,6 +231,8 @@ const (
 	mod_crc_exp		= "EXP"
 	mod_crc_rou		= "ROU"
 	mod_crc_cnt		= "SEND"
+	mod_bdopt_stats	= "STATS"
+	mod_broadcast_stats	= "STATS"
 	mod_graph_byz	= true
 	
 	
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+/*
+	DISCOVERY
+	A node started with a label and -discover finds the other ARGO nodes of the machine or of the LAN
+	with mDNS, instead of being given their addresses.
+	The label of a node travels in its libp2p user agent, "argo/<label>", that peers exchange
+	with the identify protocol as soon as they connect: a found peer is connected, its label is read,
+	and its address is recorded in the address book of the node, that is the labels map (see node.go).
+	The node then keeps the connection only if the topology file prescribes the peer as its neighbour,
+	and closes it otherwise. The topology file is never rewritten: labels are turned into addresses
+	in memory, by loadTopologyGraph.
+	Peers that are not neighbours are strangers: their heartbeats are neither sent nor received,
+	so that the short connection needed to read their label doesn't make them suspects.
+*/
+type Discovery struct {
+	mu			sync.Mutex						// Found peers are handled one at a time
+	label		string							// Label of this node
+	neighbours	map[string]bool					// Labels of the neighbours prescribed by the topology file, never changed
+	topology	*Topology
+	service		mdns.Service
+}
+
+// Option of createNode telling the label of the node to its peers
+func labelOption(label string) libp2p.Option {
+	return libp2p.UserAgent(DISC_AGENT_PREFIX + label)
+}
+
+// Label of a connected peer, from its user agent. "" if it is not known or the peer is not an ARGO node with a label
+func (n *Node) peerLabel(p peer.ID) string {
+	agent, err := n.Peerstore().Get(p, "AgentVersion")
+	if err != nil {
+		return ""
+	}
+	label, ok := strings.CutPrefix(fmt.Sprint(agent), DISC_AGENT_PREFIX)
+	if !ok {
+		return ""
+	}
+	return label
+}
+
+// Prepare the node to look for the neighbours of its label in its topology file.
+// The node must have been created with the labelOption of its label
+func (n *Node) setDiscovery(label string, topology *Topology) error {
+	d := &Discovery{
+		label:		label,
+		neighbours:	make(map[string]bool),
+		topology:	topology,
+	}
+	for _, neighbour := range LoadGraphFromCSV(n.topology_path).GetNeighbors(label) {
+		d.neighbours[neighbour] = true
+	}
+	if len(d.neighbours) == 0 {
+		return fmt.Errorf("no neighbours of %s in %s", label, n.topology_path)
+	}
+	n.setLabel(label, n.address)
+	n.discovery = d
+	return nil
+}
+
+// Start looking for the neighbours with mDNS, once the handlers of the node are set
+func (n *Node) startDiscovery(ctx context.Context) error {
+	d := n.discovery
+	d.service = mdns.NewMdnsService(n, DISC_SERVICE, &discoveryNotifee{ctx: ctx, node: n})
+	return d.service.Start()
+}
+
+// Stop looking for peers. The peers found so far stay connected
+func (n *Node) stopDiscovery() {
+	if n.discovery != nil && n.discovery.service != nil {
+		n.discovery.service.Close()
+	}
+}
+
+// Check whether a peer is a stranger: a node found by the discovery that is not a neighbour of this node
+func (n *Node) isStranger(p peer.ID) bool {
+	d := n.discovery
+	if d == nil || strings.HasSuffix(n.master_address, "/p2p/"+p.String()) {
+		return false
+	}
+	label := n.peerLabel(p)
+	return label != "" && !d.neighbours[label]
+}
+
+// Receives the peers found by mDNS
+type discoveryNotifee struct {
+	ctx		context.Context
+	node	*Node
+}
+
+func (dn *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == dn.node.ID() {
+		return
+	}
+	// mDNS must not wait for the connection
+	go dn.node.peerFound(dn.ctx, pi)
+}
+
+// Connect to a found peer to read its label, record it in the address book,
+// and keep the connection only if the peer is a neighbour
+func (n *Node) peerFound(ctx context.Context, pi peer.AddrInfo) {
+	d := n.discovery
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	connected := n.Network().Connectedness(pi.ID) == network.Connected
+	dial_ctx, cancel := context.WithTimeout(ctx, DISC_TIMEOUT)
+	defer cancel()
+	n.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+	err := n.Connect(dial_ctx, pi)
+	if err != nil {
+		// Some of the addresses announced by mDNS can't be reached from here: another one will be found
+		return
+	}
+
+	// A new connection is returned once the peers have exchanged their user agents,
+	// a connection opened by the peer may still be exchanging them
+	label := n.peerLabel(pi.ID)
+	for label == "" && connected && dial_ctx.Err() == nil {
+		clock.Sleep(dial_ctx, DISC_POLL)
+		label = n.peerLabel(pi.ID)
+	}
+	address := n.peerAddress(pi.ID)
+	if label == "" || address == "" {
+		if !connected {
+			n.Network().ClosePeer(pi.ID)
+		}
+		return
+	}
+
+	if old, ok := n.getLabel(label); !ok || old != address {
+		n.setLabel(label, address)
+		event := fmt.Sprintf("discover - Node %s found at %s", label, addressToPrint(address, NODE_PRINTLAST))
+		logEvent(n.ID().String(), PRINTOPTION, event)
+	}
+
+	if !d.neighbours[label] {
+		if !connected {
+			n.Network().ClosePeer(pi.ID)
+		}
+		return
+	}
+	if !connected {
+		connectNodes(ctx, n, address, d.topology)
+		return
+	}
+	// The neighbour found this node first
+	explorer2Mutex.Lock()
+	d.topology.ctop.AddNeighbour(n.address, address)
+	explorer2Mutex.Unlock()
+}
+
+// Print the address book of the node, with its neighbours first
+func printAddressBook(h *Node) {
+	d := h.discovery
+	if d == nil {
+		fmt.Printf("	Discovery not running\n")
+		return
+	}
+	var neighbours []string
+	for neighbour := range d.neighbours {
+		neighbours = append(neighbours, neighbour)
+	}
+	sort.Strings(neighbours)
+
+	h.labels_mu.Lock()
+	defer h.labels_mu.Unlock()
+	var labels []string
+	for label := range h.labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Printf("	%s (this node), %d nodes found\n", d.label, len(h.labels)-1)
+	for _, neighbour := range neighbours {
+		address, ok := h.labels[neighbour]
+		if !ok {
+			address = GREY + "not found yet" + RESET
+		}
+		fmt.Printf("	%s%s%s	%s\n", color_info, neighbour, RESET, address)
+	}
+	for _, label := range labels {
+		if !d.neighbours[label] && label != d.label {
+			fmt.Printf("	%s	%s (not a neighbour)\n", label, h.labels[label])
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+	MESSAGE ENCODING
+	Messages are written on the wire as json (ENC_JSON), easy to read while debugging,
+	or with a compact binary encoding (ENC_BINARY).
+	Every node decodes both of them, so the encoding only needs to be chosen by the sender:
+	a binary message starts with ENC_BINARY_MAGIC, a json one with '{'.
+
+	Binary encoding:
+		magic byte
+		table of the addresses of the message: count, then each entry
+			ENC_ENTRY_ADDR: multiaddr and peer ID as raw bytes, for "<ADDRESS>/p2p/<PEER_ID>"
+			ENC_ENTRY_STRING: any other string
+		version, id, instance id, type, content as strings
+		sender, source, target as indices in the table
+		neighbourhood and path as lists of indices in the table
+	Strings and byte slices are written as their length (uvarint) followed by their bytes.
+	Lists are written as their length + 1 (uvarint) followed by their elements, 0 being a nil list.
+	Each address is written once in the table, however many times it appears in the message.
+*/
+
+// Encode a message for the wire
+func encodeMessage(m Message, encoding string) ([]byte, error) {
+	switch encoding {
+	case ENC_JSON:
+		return json.Marshal(m)
+	case ENC_BINARY:
+		return encodeBinary(m)
+	}
+	return nil, fmt.Errorf("unknown encoding %s", encoding)
+}
+
+// Decode a message read from the wire, whatever its encoding
+func decodeMessage(data []byte) (Message, error) {
+	var m Message
+	if len(data) > 0 && data[0] == ENC_BINARY_MAGIC {
+		return decodeBinary(data)
+	}
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
+
+// Check that an encoding exists
+func validEncoding(encoding string) error {
+	if encoding != ENC_JSON && encoding != ENC_BINARY {
+		return fmt.Errorf("unknown encoding %s: use %s or %s", encoding, ENC_JSON, ENC_BINARY)
+	}
+	return nil
+}
+
+func encodeBinary(m Message) ([]byte, error) {
+	// Table of the addresses, in order of appearance
+	var table []string
+	index := make(map[string]uint64)
+	ref := func(s string) uint64 {
+		i, ok := index[s]
+		if !ok {
+			i = uint64(len(table))
+			index[s] = i
+			table = append(table, s)
+		}
+		return i
+	}
+	sender, source, target := ref(m.Sender), ref(m.Source), ref(m.Target)
+	neighbourhood := make([]uint64, len(m.Neighbourhood))
+	for i, a := range m.Neighbourhood {
+		neighbourhood[i] = ref(a)
+	}
+	path := make([]uint64, len(m.Path))
+	for i, a := range m.Path {
+		path[i] = ref(a)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(ENC_BINARY_MAGIC)
+	writeUvarint(&buf, uint64(len(table)))
+	for _, s := range table {
+		ma, id, ok := splitAddress(s)
+		if ok {
+			buf.WriteByte(ENC_ENTRY_ADDR)
+			writeBytes(&buf, ma)
+			writeBytes(&buf, id)
+		} else {
+			buf.WriteByte(ENC_ENTRY_STRING)
+			writeBytes(&buf, []byte(s))
+		}
+	}
+	for _, s := range []string{m.Version, m.ID, m.InstanceID, m.Type, m.Content} {
+		writeBytes(&buf, []byte(s))
+	}
+	for _, i := range []uint64{sender, source, target} {
+		writeUvarint(&buf, i)
+	}
+	writeList(&buf, m.Neighbourhood == nil, neighbourhood)
+	writeList(&buf, m.Path == nil, path)
+	return buf.Bytes(), nil
+}
+
+func decodeBinary(data []byte) (Message, error) {
+	var m Message
+	r := bytes.NewReader(data[1:])
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return m, err
+	}
+	if n > uint64(r.Len()) {
+		return m, fmt.Errorf("invalid address table of %d entries", n)
+	}
+	table := make([]string, n)
+	for i := range table {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return m, err
+		}
+		switch kind {
+		case ENC_ENTRY_ADDR:
+			ma, err := readBytes(r)
+			if err != nil {
+				return m, err
+			}
+			id, err := readBytes(r)
+			if err != nil {
+				return m, err
+			}
+			table[i], err = joinAddress(ma, id)
+			if err != nil {
+				return m, err
+			}
+		case ENC_ENTRY_STRING:
+			s, err := readBytes(r)
+			if err != nil {
+				return m, err
+			}
+			table[i] = string(s)
+		default:
+			return m, fmt.Errorf("invalid address table entry %d", kind)
+		}
+	}
+	lookup := func() (string, error) {
+		i, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if i >= uint64(len(table)) {
+			return "", fmt.Errorf("invalid address index %d", i)
+		}
+		return table[i], nil
+	}
+
+	for _, s := range []*string{&m.Version, &m.ID, &m.InstanceID, &m.Type, &m.Content} {
+		b, err := readBytes(r)
+		if err != nil {
+			return m, err
+		}
+		*s = string(b)
+	}
+	for _, s := range []*string{&m.Sender, &m.Source, &m.Target} {
+		*s, err = lookup()
+		if err != nil {
+			return m, err
+		}
+	}
+	for _, list := range []*[]string{&m.Neighbourhood, &m.Path} {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return m, err
+		}
+		if n == 0 {
+			continue // nil list
+		}
+		if n-1 > uint64(r.Len()) {
+			return m, fmt.Errorf("invalid list of %d entries", n-1)
+		}
+		*list = make([]string, n-1)
+		for i := range *list {
+			(*list)[i], err = lookup()
+			if err != nil {
+				return m, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// Split "<ADDRESS>/p2p/<PEER_ID>" into the raw bytes of the multiaddr and of the peer ID.
+// ok is false if s is not such an address, or if it wouldn't be written back exactly the same
+func splitAddress(s string) (ma []byte, id []byte, ok bool) {
+	i := strings.LastIndex(s, "/p2p/")
+	if i <= 0 {
+		return nil, nil, false
+	}
+	addr, err := multiaddr.NewMultiaddr(s[:i])
+	if err != nil || addr.String() != s[:i] {
+		return nil, nil, false
+	}
+	pid, err := peer.Decode(s[i+len("/p2p/"):])
+	if err != nil || pid.String() != s[i+len("/p2p/"):] {
+		return nil, nil, false
+	}
+	return addr.Bytes(), []byte(pid), true
+}
+
+// Inverse of splitAddress
+func joinAddress(ma []byte, id []byte) (string, error) {
+	addr, err := multiaddr.NewMultiaddrBytes(ma)
+	if err != nil {
+		return "", err
+	}
+	pid, err := peer.IDFromBytes(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/p2p/%s", addr, pid), nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	buf.Write(b[:n])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func writeList(buf *bytes.Buffer, is_nil bool, list []uint64) {
+	if is_nil {
+		writeUvarint(buf, 0)
+		return
+	}
+	writeUvarint(buf, uint64(len(list))+1)
+	for _, i := range list {
+		writeUvarint(buf, i)
+	}
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
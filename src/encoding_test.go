@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Address "<ADDRESS>/p2p/<PEER_ID>" of a new peer
+func testAddress(t *testing.T, ma string) string {
+	_, pub, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ma + "/p2p/" + id.String()
+}
+
+// Decode data, failing the test instead of panicking
+func decodeSafely(t *testing.T, data []byte) (m Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("decoding %x panicked: %v", data, r)
+		}
+	}()
+	return decodeMessage(data)
+}
+
+// Every field of a message comes back the same, with both encodings
+func TestEncodingRoundtrip(t *testing.T) {
+	a := testAddress(t, "/ip4/127.0.0.1/tcp/4001")
+	b := testAddress(t, "/ip6/::1/udp/4002/quic-v1")
+	c := testAddress(t, "/ip4/10.0.0.3/tcp/4003")
+	tests := []struct {
+		name	string
+		m		Message
+	}{
+		{"every field", Message{Version: "2", ID: "4f1c", InstanceID: a, Type: TYPE_BRB_SEND, Sender: b, Source: a, Target: c,
+			Content: "hello", Neighbourhood: []string{a, b, c}, Path: []string{a, b}}},
+		{"empty message", Message{}},
+		{"empty lists", Message{ID: "1", Neighbourhood: []string{}, Path: []string{}}},
+		{"nil path, empty neighbourhood", Message{ID: "2", Neighbourhood: []string{}}},
+		{"repeated addresses", Message{Sender: a, Source: a, Target: a, Neighbourhood: []string{a, a}, Path: []string{a, a, a}}},
+		{"plain strings", Message{Sender: "A", Source: "not/p2p/an address", Target: "/p2p/", Path: []string{"B", "", "/ip4/1.2.3.4/p2p/nope"}}},
+		{"content with quotes and unicode", Message{Content: "{\"x\": 1}\n\tçà 🙂", InstanceID: "instance"}},
+	}
+	for _, test := range tests {
+		for _, encoding := range []string{ENC_JSON, ENC_BINARY} {
+			data, err := encodeMessage(test.m, encoding)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", test.name, encoding, err)
+			}
+			m, err := decodeSafely(t, data)
+			if err != nil {
+				t.Errorf("%s, %s: %v", test.name, encoding, err)
+				continue
+			}
+			if encoding == ENC_JSON {
+				continue // json does not keep nil and empty lists apart
+			}
+			if !reflect.DeepEqual(m, test.m) {
+				t.Errorf("%s, %s: decoded %+v, expected %+v", test.name, encoding, m, test.m)
+			}
+		}
+	}
+}
+
+// Truncated and corrupted binary messages are rejected, without panics
+func TestEncodingInvalid(t *testing.T) {
+	a := testAddress(t, "/ip4/127.0.0.1/tcp/4001")
+	m := Message{Version: "2", ID: "4f1c", InstanceID: a, Type: TYPE_BRB_SEND, Sender: a, Source: "A", Target: a,
+		Content: "hello", Neighbourhood: []string{a, "B"}, Path: []string{"A"}}
+	data, err := encodeMessage(m, ENC_BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(data); n++ {
+		if _, err := decodeSafely(t, data[:n]); err == nil {
+			t.Errorf("message truncated to %d bytes of %d decoded", n, len(data))
+		}
+	}
+
+	magic := byte(ENC_BINARY_MAGIC)
+	tests := []struct {
+		name	string
+		data	[]byte
+	}{
+		{"magic only", []byte{magic}},
+		{"table longer than the message", []byte{magic, 100, ENC_ENTRY_STRING, 0}},
+		{"unknown table entry", []byte{magic, 1, 0x07, 0}},
+		{"invalid address", []byte{magic, 1, ENC_ENTRY_ADDR, 3, 'a', 'b', 'c', 1, 'x'}},
+		{"string longer than the message", []byte{magic, 1, ENC_ENTRY_STRING, 100, 'a'}},
+		{"index out of the table", []byte{magic, 1, ENC_ENTRY_STRING, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"list longer than the message", []byte{magic, 1, ENC_ENTRY_STRING, 0, 0, 0, 0, 0, 0, 0, 0, 0, 100, 0}},
+		{"varint overflow", []byte{magic, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+	for _, test := range tests {
+		if _, err := decodeSafely(t, test.data); err == nil {
+			t.Errorf("%s: decoded", test.name)
+		}
+	}
+
+	// Any corrupted byte gives an error or another message, never a panic
+	for i := 1; i < len(data); i++ {
+		for _, b := range []byte{0x00, 0x7f, 0xff} {
+			corrupted := append([]byte{}, data...)
+			corrupted[i] = b
+			decodeSafely(t, corrupted)
+		}
+	}
+}
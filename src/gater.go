@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+	TOPOLOGY GATE
+	A node started with -gate only connects to the neighbours that the topology file prescribes for it,
+	and to the master, so that an accidental -connect or a byzantine dialling extra peers
+	can't change the graph under test.
+	The gate is enforced from the first time the node loads its neighbourhood from the file
+	(auto mode, -topology LOAD, or TOPLOAD and RESET from the master), and follows every later load.
+	Before that, as when the node has to learn the topology from the network, every peer is let through.
+	Dials to other peers fail, connections from other peers are closed during the handshake,
+	and connections already open with other peers are closed when the gate is enforced.
+	Refused attempts are counted and logged with the "gate" event.
+*/
+type TopologyGater struct {
+	mu			sync.Mutex
+	node		*Node				// Node behind the gate, nil until the node is created
+	enforced	bool				// False until the neighbourhood is loaded from the topology file
+	allowed		map[peer.ID]bool	// Neighbours of the node in the topology file
+	refused		map[peer.ID]int		// Attempts refused for each peer
+}
+
+// Options of createNode putting the node behind a topology gate. No options and no gate if it is not enabled
+func gateOptions(enabled bool) ([]libp2p.Option, *TopologyGater) {
+	if !enabled {
+		return nil, nil
+	}
+	g := &TopologyGater{
+		allowed:	make(map[peer.ID]bool),
+		refused:	make(map[peer.ID]int),
+	}
+	return []libp2p.Option{libp2p.ConnectionGater(g)}, g
+}
+
+// Attach the gate to the node created with its options
+func (n *Node) setGater(g *TopologyGater) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.node = n
+	g.mu.Unlock()
+	n.gater = g
+}
+
+// Enforce the gate with the neighbourhood of the node, and close the connections with the other peers.
+// Neighbours whose address is not known yet (labels not resolved) can't be let through
+func (n *Node) enforceTopology(neighbourhood []string) {
+	g := n.gater
+	if g == nil {
+		return
+	}
+	allowed := make(map[peer.ID]bool)
+	unknown := 0
+	for _, neighbour := range neighbourhood {
+		p, err := peer.Decode(extractPeerIDFromMultiaddr(neighbour))
+		if err != nil {
+			unknown++
+			continue
+		}
+		allowed[p] = true
+	}
+	g.mu.Lock()
+	g.enforced = true
+	g.allowed = allowed
+	g.mu.Unlock()
+
+	event := fmt.Sprintf("gate - Topology enforced: %d neighbours allowed", len(allowed))
+	if unknown > 0 {
+		event += fmt.Sprintf(", %d without a known address", unknown)
+	}
+	logEvent(n.ID().String(), PRINTOPTION, event)
+
+	for _, p := range n.Network().Peers() {
+		if !g.allows(p) {
+			n.Network().ClosePeer(p)
+			event := fmt.Sprintf("gate - Connection with %s closed: not a neighbour in the topology", addressToPrint(p.String(), NODE_PRINTLAST))
+			logEvent(n.ID().String(), PRINTOPTION, event)
+		}
+	}
+}
+
+// Let a peer through the gate, or stop letting it, when the master changes the link with it.
+// The gate is changed even if it is not enforced yet
+func (n *Node) gatePeer(p peer.ID, allowed bool) {
+	g := n.gater
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if allowed {
+		g.allowed[p] = true
+	} else {
+		delete(g.allowed, p)
+	}
+}
+
+// Check whether the node can be connected to the peer
+func (g *TopologyGater) allows(p peer.ID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enforced || g.allowed[p] {
+		return true
+	}
+	return strings.HasSuffix(g.node.master_address, "/p2p/"+p.String())
+}
+
+// Let the peer through the gate, or count and log the refused attempt
+func (g *TopologyGater) check(p peer.ID, attempt string) bool {
+	if g.allows(p) {
+		return true
+	}
+	g.mu.Lock()
+	g.refused[p]++
+	refused := g.refused[p]
+	g.mu.Unlock()
+	if refused == 1 || refused%POOL_LOG_EVERY == 0 {
+		event := fmt.Sprintf("gate - %s %s refused: not a neighbour in the topology, %d times so far", attempt, addressToPrint(p.String(), NODE_PRINTLAST), refused)
+		logEvent(g.node.ID().String(), PRINTOPTION, event)
+	}
+	return false
+}
+
+// Dials of this node
+func (g *TopologyGater) InterceptPeerDial(p peer.ID) bool {
+	return g.check(p, "Dial to")
+}
+
+func (g *TopologyGater) InterceptAddrDial(p peer.ID, a multiaddr.Multiaddr) bool {
+	return true
+}
+
+// The peer of an incoming connection is only known once the connection is secured
+func (g *TopologyGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *TopologyGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if dir == network.DirOutbound {
+		// Already checked when dialling
+		return true
+	}
+	return g.check(p, "Connection from")
+}
+
+func (g *TopologyGater) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// Print the gate of the node and the peers it refused
+func printGate(h *Node) {
+	g := h.gater
+	if g == nil {
+		fmt.Printf("	No gate: the node connects to any peer\n")
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enforced {
+		fmt.Printf("	Not enforced yet: the topology was not loaded from %s\n", h.topology_path)
+		return
+	}
+	fmt.Printf("	%d neighbours allowed, and the master\n", len(g.allowed))
+	var refused []peer.ID
+	for p := range g.refused {
+		refused = append(refused, p)
+	}
+	sort.Slice(refused, func(i, j int) bool { return refused[i] < refused[j] })
+	for _, p := range refused {
+		fmt.Printf("		%s%s%s	%d attempts refused\n", RED, p, RESET, g.refused[p])
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 )
 
 // Graph represents a graph where nodes are identified by strings
@@ -320,4 +321,30 @@ func (g *Graph) GraphToString() string {
 		str += "]; "
 	}
 	return str
-}
\ No newline at end of file
+}
+
+// Returns a copy of the graph where every node is renamed following the labels map.
+// Nodes without a label keep their name
+func relabelGraph(g *Graph, labels map[string]string) *Graph {
+	relabel := func(node string) string {
+		if name, ok := labels[node]; ok {
+			return name
+		}
+		return node
+	}
+
+	// Nodes are taken in order, so that edges are always added in the same order
+	var nodes []string
+	for node := range g.adjList {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	graph := NewGraph()
+	for _, node := range nodes {
+		for _, neighbor := range g.adjList[node] {
+			graph.AddEdge(relabel(node), relabel(neighbor))
+		}
+	}
+	return graph
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+/*
+	IDENTITIES
+	The peer ID of a node comes from its private key. A node started without a key directory
+	gets a new random key, and so a new peer ID, every time it starts.
+	With a key directory, the key of a node is in the file <label>.key of the directory:
+	it is generated and saved on the first run, and loaded on the next ones,
+	so that the node keeps its peer ID across runs and across machines.
+	Together with a fixed listen port, the address of the node doesn't change either,
+	and a topology file with real addresses can be written once and reused.
+*/
+
+// Options of createNode giving the node the identity of the label, from a key file of the directory.
+// No options if the directory is empty: the node gets a random identity
+func identityOptions(dir string, label string) ([]libp2p.Option, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if label == "" {
+		return nil, fmt.Errorf("the key of a node needs its label")
+	}
+	key, err := loadOrCreateKey(keyFile(dir, label))
+	if err != nil {
+		return nil, err
+	}
+	return []libp2p.Option{libp2p.Identity(key)}, nil
+}
+
+// File of the key of the label in the directory
+func keyFile(dir string, label string) string {
+	return filepath.Join(dir, label+KEY_EXT)
+}
+
+// Load the private key in the file, or generate it and save it in the file if there is none
+func loadOrCreateKey(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// The key is the identity of the node: only its owner can read it
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	LINK EMULATION
+	The links between the nodes can be given the behaviour of a real network, edge by edge of the topology,
+	with a links file in the format:
+		NODE,NEIGHBOUR,LATENCY,JITTER,DISTRIBUTION,LOSS,BANDWIDTH
+		*,*,5ms,1ms,uniform,0,0
+		A,B,50ms,10ms,normal,0.05,100KB
+	An edge is given by the labels of its two nodes, in any order, and holds in both directions.
+	The edge *,* is the default of the edges that are not listed. Edges with the master are never emulated.
+	Every message sent on an emulated link:
+		- is lost with probability LOSS
+		- takes size/BANDWIDTH to be transmitted, after the messages sent before it (BANDWIDTH in B, KB, MB or GB per second, 0 for no cap)
+		- then travels for LATENCY plus a jitter drawn from DISTRIBUTION: uniform in [-JITTER, JITTER],
+		  normal with standard deviation JITTER, or exponential with mean JITTER
+	Like on a stream, messages of a link arrive in the order they were sent: jitter never reorders them.
+	Emulation is applied by the sender, so that each end applies it to its own messages.
+*/
+type LinkConfig struct {
+	latency		time.Duration
+	jitter		time.Duration
+	dist		string			// Distribution of the jitter: LINK_UNIFORM, LINK_NORMAL or LINK_EXPONENTIAL
+	loss		float64			// Probability that a message is lost
+	bandwidth	float64			// Bytes per second, 0 if there is no cap
+}
+
+// Links of a links file, by edge
+type LinkTable struct {
+	links	map[linkKey]LinkConfig
+}
+
+// An edge is identified by the labels of its nodes, in order
+type linkKey struct {
+	a	string
+	b	string
+}
+
+func newLinkKey(a string, b string) linkKey {
+	if a > b {
+		a, b = b, a
+	}
+	return linkKey{a: a, b: b}
+}
+
+// Load the links of a links file, see LINK EMULATION
+func loadLinks(path string) (*LinkTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid links file %s: %v", path, err)
+	}
+
+	table := &LinkTable{links: make(map[linkKey]LinkConfig)}
+	for i, line := range lines {
+		if i == 0 && line[0] == LINKS_HEADER {
+			continue
+		}
+		if len(line) < 3 {
+			return nil, fmt.Errorf("invalid link %q in %s: use NODE,NEIGHBOUR,LATENCY,JITTER,DISTRIBUTION,LOSS,BANDWIDTH", strings.Join(line, ","), path)
+		}
+		config, err := parseLinkConfig(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid link %s-%s in %s: %v", line[0], line[1], path, err)
+		}
+		table.links[newLinkKey(line[0], line[1])] = config
+	}
+	return table, nil
+}
+
+// Parse LATENCY,JITTER,DISTRIBUTION,LOSS,BANDWIDTH. Missing or empty fields are 0, or LINK_UNIFORM
+func parseLinkConfig(fields []string) (LinkConfig, error) {
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+	config := LinkConfig{dist: LINK_UNIFORM}
+	var err error
+	if fields[0] != "" {
+		config.latency, err = time.ParseDuration(fields[0])
+		if err != nil || config.latency < 0 {
+			return config, fmt.Errorf("invalid latency %q", fields[0])
+		}
+	}
+	if fields[1] != "" {
+		config.jitter, err = time.ParseDuration(fields[1])
+		if err != nil || config.jitter < 0 {
+			return config, fmt.Errorf("invalid jitter %q", fields[1])
+		}
+	}
+	switch fields[2] {
+	case "":
+	case LINK_UNIFORM, LINK_NORMAL, LINK_EXPONENTIAL:
+		config.dist = fields[2]
+	default:
+		return config, fmt.Errorf("unknown distribution %q: use %s, %s or %s", fields[2], LINK_UNIFORM, LINK_NORMAL, LINK_EXPONENTIAL)
+	}
+	if fields[3] != "" {
+		config.loss, err = strconv.ParseFloat(fields[3], 64)
+		if err != nil || config.loss < 0 || config.loss > 1 {
+			return config, fmt.Errorf("invalid loss %q: use a probability between 0 and 1", fields[3])
+		}
+	}
+	if fields[4] != "" {
+		config.bandwidth, err = parseBandwidth(fields[4])
+		if err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// Parse a bandwidth in bytes per second, e.g. "1500", "100KB", "10MB"
+func parseBandwidth(s string) (float64, error) {
+	unit := 1.0
+	number := strings.ToUpper(s)
+	for _, u := range []struct {
+		suffix	string
+		size	float64
+	}{{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(number, u.suffix); ok {
+			number, unit = n, u.size
+			break
+		}
+	}
+	bandwidth, err := strconv.ParseFloat(number, 64)
+	if err != nil || bandwidth < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return bandwidth * unit, nil
+}
+
+// Config of the edge between two labels, or of the default edge. False if the edge is not emulated
+func (lt *LinkTable) get(a string, b string) (LinkConfig, bool) {
+	if config, ok := lt.links[newLinkKey(a, b)]; ok {
+		return config, true
+	}
+	config, ok := lt.links[newLinkKey(LINK_ANY, LINK_ANY)]
+	return config, ok
+}
+
+func (lc LinkConfig) String() string {
+	s := fmt.Sprintf("latency %s", lc.latency)
+	if lc.jitter > 0 {
+		s += fmt.Sprintf(", jitter %s %s", lc.jitter, lc.dist)
+	}
+	if lc.loss > 0 {
+		s += fmt.Sprintf(", loss %g%%", lc.loss*100)
+	}
+	if lc.bandwidth > 0 {
+		s += fmt.Sprintf(", bandwidth %g B/s", lc.bandwidth)
+	}
+	return s
+}
+
+/*
+	EMULATED TRANSPORT
+	Wraps the transport of a node, and sends the messages of the emulated links
+	once their time has come, in the order they were sent.
+*/
+type emulatedTransport struct {
+	Transport
+	node		*Node
+	label		string					// Label of this node
+	table		*LinkTable
+	mu			sync.Mutex
+	rng			*rand.Rand				// Losses and jitters
+	links		map[peer.ID]*emulatedLink
+}
+
+// Link to a peer, with the messages waiting to be sent on it
+type emulatedLink struct {
+	label		string
+	config		LinkConfig
+	free		time.Time				// When the last message will have been transmitted
+	last		time.Time				// When the last message will arrive
+	queue		[]delayedMessage		// Messages waiting, in the order they arrive
+	send_mu		sync.Mutex				// Held while sending the messages of the queue
+	sent		int
+	lost		int
+}
+
+type delayedMessage struct {
+	ctx			context.Context
+	at			time.Time
+	protocol	protocol.ID
+	m			Message
+}
+
+// Emulate the links of the table on the messages that the node sends.
+// The node is known by label in the table. Must be called once the node is seeded
+func (n *Node) setLinks(table *LinkTable, label string) {
+	if table == nil {
+		return
+	}
+	n.transport = &emulatedTransport{
+		Transport:	n.transport,
+		node:		n,
+		label:		label,
+		table:		table,
+		rng:		rand.New(rand.NewSource(n.rng.Int63())),
+		links:		make(map[peer.ID]*emulatedLink),
+	}
+}
+
+// Label of a peer: from the address book, or from its user agent. "" if it is not known
+func (n *Node) labelOf(p peer.ID) string {
+	n.labels_mu.Lock()
+	for label, address := range n.labels {
+		if strings.HasSuffix(address, "/p2p/"+p.String()) {
+			n.labels_mu.Unlock()
+			return label
+		}
+	}
+	n.labels_mu.Unlock()
+	return n.peerLabel(p)
+}
+
+// Link to the peer. Nil if it is not emulated, or not known yet
+func (t *emulatedTransport) link(target peer.ID) *emulatedLink {
+	t.mu.Lock()
+	l, ok := t.links[target]
+	t.mu.Unlock()
+	if ok {
+		return l
+	}
+	if strings.HasSuffix(t.node.master_address, "/p2p/"+target.String()) {
+		return nil
+	}
+	label := t.node.labelOf(target)
+	if label == "" {
+		// The label of the peer may be learned later
+		return nil
+	}
+	config, emulated := t.table.get(t.label, label)
+	if emulated {
+		l = &emulatedLink{label: label, config: config}
+	}
+	t.mu.Lock()
+	t.links[target] = l
+	t.mu.Unlock()
+	return l
+}
+
+// Jitter of a message on the link. Must be called with t.mu locked
+func (t *emulatedTransport) jitter(config LinkConfig) time.Duration {
+	j := float64(config.jitter)
+	switch config.dist {
+	case LINK_NORMAL:
+		j *= t.rng.NormFloat64()
+	case LINK_EXPONENTIAL:
+		j *= t.rng.ExpFloat64()
+	default:
+		j *= 2*t.rng.Float64() - 1
+	}
+	return time.Duration(j)
+}
+
+// Messages of emulated links are queued on the link, and sent when their time comes.
+// Errors of the transport are then printed, since the caller is long gone
+func (t *emulatedTransport) Send(ctx context.Context, target peer.ID, protocol protocol.ID, m Message) error {
+	l := t.link(target)
+	if l == nil {
+		return t.Transport.Send(ctx, target, protocol, m)
+	}
+
+	encoding := t.Transport.Encoding()
+	t.mu.Lock()
+	if l.config.loss > 0 && t.rng.Float64() < l.config.loss {
+		l.lost++
+		t.mu.Unlock()
+		event := fmt.Sprintf("link %s - Message to %s lost on the link %s-%s", addressToPrint(m.ID, NODE_PRINTLAST), addressToPrint(target.String(), NODE_PRINTLAST), t.label, l.label)
+		logEvent(t.node.ID().String(), PRINTOPTION, event)
+		return nil
+	}
+	now := clock.Now()
+	start := now
+	if l.free.After(start) {
+		start = l.free
+	}
+	l.free = start
+	if l.config.bandwidth > 0 {
+		data, err := encodeMessage(m, encoding)
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		// The frame of the message has its length on 4 bytes, see writeFrame
+		seconds := float64(len(data)+4) / l.config.bandwidth
+		l.free = start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	delay := time.Duration(math.Max(0, float64(l.config.latency+t.jitter(l.config))))
+	at := l.free.Add(delay)
+	if at.Before(l.last) {
+		at = l.last
+	}
+	l.last = at
+	l.sent++
+	l.queue = append(l.queue, delayedMessage{ctx: ctx, at: at, protocol: protocol, m: m})
+	t.mu.Unlock()
+
+	clock.AfterFunc(ctx, at.Sub(now), func(context.Context) {
+		t.flush(target, l)
+	})
+	return nil
+}
+
+// Send the messages of the link whose time has come, in order
+func (t *emulatedTransport) flush(target peer.ID, l *emulatedLink) {
+	l.send_mu.Lock()
+	defer l.send_mu.Unlock()
+	t.mu.Lock()
+	now := clock.Now()
+	ready := 0
+	for ready < len(l.queue) && !l.queue[ready].at.After(now) {
+		ready++
+	}
+	messages := l.queue[:ready]
+	l.queue = l.queue[ready:]
+	t.mu.Unlock()
+
+	for _, d := range messages {
+		err := t.Transport.Send(d.ctx, target, d.protocol, d.m)
+		if err != nil {
+			printError(err)
+		}
+	}
+}
+
+// Print the emulated links of the node
+func printLinks(h *Node) {
+	t, ok := h.transport.(*emulatedTransport)
+	if !ok {
+		fmt.Printf("	No link emulation\n")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var peers []peer.ID
+	for p, l := range t.links {
+		if l != nil {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return t.links[peers[i]].label < t.links[peers[j]].label })
+	if len(peers) == 0 {
+		fmt.Printf("	No emulated link used yet\n")
+	}
+	for _, p := range peers {
+		l := t.links[p]
+		fmt.Printf("	%s%s-%s%s	%s, %d messages sent, %d lost\n", color_info, t.label, l.label, RESET, l.config, l.sent, l.lost)
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-/*
-	TO DO
-	-	WHEN A NODE IS CLOSED, CLOSE THE CONNECTION WITH ALL ITS PEERS
-*/
-
 func main() {
 
 	// Create a context
@@ -19,9 +18,44 @@ func main() {
 	// Cancel this function to avoid content leak
 	defer cancel()
 
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == cmd_sim {
+		runSimulation(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == cmd_sweep {
+		runSweep(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == cmd_cluster {
+		runCluster(ctx, os.Args[2:])
+		return
+	}
+
 	dest := flag.String("d", "", "Destination multiaddr string of the master node")
 	mod := flag.String("m", "", "Start in auto mod. Must be followed by a valid -n value")
 	nod := flag.String("n", "", "Replace node")
+	top := flag.String("t", topology_path, "Topology .csv file of the node")
+	loopback := flag.Bool("loopback", false, "Only listen on the loopback address")
+	port := flag.Int("port", 0, "Listen port of the node. 0 lets the system pick it")
+	ip := flag.String("ip", "", "Listen IP of the node. Default: every interface")
+	quic := flag.Bool("quic", false, "Listen on QUIC too")
+	discover := flag.Bool("discover", false, "Find the neighbours of the label (-n) in the topology file with mDNS, and connect to them")
+	gate := flag.Bool("gate", false, "Only connect to the neighbours of the node in the topology file, and to the master, once the topology is loaded")
+	psk := flag.String("psk", "", "Key file of the private network of the experiment: the node only talks to the nodes with the same key")
+	listen := flag.String("listen", "", "Comma separated multiaddresses to listen on. Overrides -ip, -port, -quic and "+NETWORK_CONFIG)
+	keys := flag.String("keys", "", "Directory of the key files of the nodes: the node keeps the identity of its label (-n) across runs")
+	queue := flag.Int("queue", POOL_QUEUE_SIZE, "Messages that can wait in the queue of each protocol")
+	workers := flag.Int("workers", POOL_WORKERS, "Messages of each protocol handled at the same time")
+	overload := flag.String("overload", POOL_BLOCK, "What to do when a queue is full: "+POOL_BLOCK+", "+POOL_DROP_OLDEST+" or "+POOL_DROP_NEW)
+	limit := flag.String("limit", "", "Rate limits of the messages of each peer, by protocol: NAME=RATE:BURST,... e.g. crc=100:200,nab=50")
+	limit_suspect := flag.Bool("limit-suspect", false, "Report the peers over a rate limit as suspects")
+	links := flag.String("links", "", "Links file emulating latency, jitter, loss and bandwidth on the links of the node, by label (-n)")
+	nabopt := flag.String("nabopt", OPT_NONE, "Modifications of the DolevU broadcast (/nab/): "+OPT_ALL+", "+OPT_NONE+" or NAME,... among "+strings.Join(NAB_OPTIMISATIONS, ","))
+	bdopt := flag.String("bdopt", OPT_NONE, "Optimisations of the Bracha-Dolev reliable broadcast: "+OPT_ALL+", "+OPT_NONE+" or NAME,... among "+strings.Join(BDOPT_OPTIMISATIONS, ","))
+	persist := flag.String("persist", "", "Comma separated state to save when the node shuts down: "+PERSIST_CTOP+", "+PERSIST_DELIVERED)
+	hb := flag.Duration("hb", HB_INTERVAL, "Time between two heartbeats of the failure detector. 0 to disable it")
+	enc := flag.String("encoding", ENC_JSON, "Encoding of the messages sent by this node: "+ENC_JSON+" or "+ENC_BINARY)
 	help := flag.Bool("help", false, "Display help")
 
 	flag.Parse()
@@ -31,32 +65,141 @@ func main() {
 
 		os.Exit(0)
 	}
+	err := validEncoding(*enc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool_config := PoolConfig{size: *queue, workers: *workers, policy: *overload}
+	err = validPoolConfig(pool_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits, err := parseRateLimits(*limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nabopt_enabled, err := parseOptimisations(*nabopt, NAB_OPTIMISATIONS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bdopt_enabled, err := parseOptimisations(*bdopt, BDOPT_OPTIMISATIONS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var link_table *LinkTable
+	if *links != "" {
+		if *nod == "" {
+			log.Fatal("-links needs the label of the node (-n)")
+		}
+		link_table, err = loadLinks(*links)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Create the proper data structs
-	readMaxByzantines(BYZANTINE_CONFIG, &MAX_BYZANTINES)
 	topology := NewTopology()
 	receivedMessages := NewMessageContainer()
 	deliveredMessages := NewMessageContainer()
 	sentMessages := NewMessageContainer()
 	disjointPaths := NewDisjointPaths()
-	h := createNode()
-	thisnode_address = getNodeAddress(h, ADDR_DEFAULT)
+	options, err := identityOptions(*keys, *nod)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listen_config := ListenConfig{ip: *ip, port: *port, quic: *quic, loopback: *loopback}
+	if *listen != "" {
+		listen_config.addrs, err = parseListenAddrs(*listen)
+	} else if *ip == "" && *port == 0 && !*quic && !*loopback {
+		listen_config.addrs, err = readListenAddrs(NETWORK_CONFIG)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	options = append(options, listenOptions(listen_config)...)
+	psk_options, psk_id, err := pskOptions(*psk)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if psk_id != "" && *quic {
+		log.Fatal("Private networks only work on TCP: use -psk without -quic")
+	}
+	options = append(options, psk_options...)
+	if *discover && (*nod == "" || *mod != "") {
+		log.Fatal("-discover needs the label of the node (-n), and doesn't rewrite the topology file (no -m)")
+	}
+	if *nod != "" {
+		options = append(options, labelOption(*nod))
+	}
+	if *gate && *discover {
+		log.Fatal("-gate needs the addresses of the neighbours in the topology file, that -discover only finds while running")
+	}
+	gate_options, gater := gateOptions(*gate)
+	options = append(options, gate_options...)
+	node := createNode(options...)
+	if node == nil {
+		log.Fatal("Failed to create the node")
+	}
+	address_type := ADDR_DEFAULT
+	if *loopback {
+		address_type = ADDR_LOOPBACK
+	}
+	address := getNodeAddress(node, address_type)
+	if address == "" {
+		log.Fatalf("No usable address among %v", node.Addrs())
+	}
+	h := NewNode(node, address)
+	h.topology_path = *top
+	h.psk_path, h.psk_id = *psk, psk_id
+	h.setGater(gater)
+	if *discover {
+		err = h.setDiscovery(*nod, topology)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	h.transport.SetEncoding(*enc)
+	h.pool_config = pool_config
+	h.limiter.setLimits(limits, *limit_suspect)
+	h.dolevu.setOptimisations(nabopt_enabled)
+	h.bdopt.setOptimisations(bdopt_enabled)
+	console_address = h.address
+	readMaxByzantines(BYZANTINE_CONFIG, &h.max_byzantines)
+	var seed int64
+	readSeed(BYZANTINE_CONFIG, &seed)
+	h.setSeed(seed)
+	h.setLinks(link_table, *nod)
+
+	err = persistState(h, *persist, topology, deliveredMessages)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.startFailureDetector(ctx, *hb)
+
+	// Leave the network gracefully when the node is interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		h.shutdown(ctx)
+		os.Exit(0)
+	}()
 
 	if *mod == start_automatic && *nod != "" && *dest != "" {
-		master_address = *dest
-		ReplaceInCSV(topology_path, getNodeAddress(h, ADDR_DEFAULT), *nod)
+		h.master_address = *dest
+		ReplaceInCSV(h.topology_path, h.address, *nod)
 		runNode_knownTopology(ctx, h, receivedMessages, deliveredMessages, sentMessages, disjointPaths, topology)
-		connectNodes(ctx, h, master_address, topology)
+		connectNodes(ctx, h, h.master_address, topology)
 		sendAddressToMaster(ctx, h, *nod)
 		manageConsoleInput(ctx, h, receivedMessages, deliveredMessages, disjointPaths, topology)
 	} else if *mod == start_automatic && *nod != "" {
-		ReplaceInCSV(topology_path, getNodeAddress(h, ADDR_DEFAULT), *nod)
+		ReplaceInCSV(h.topology_path, h.address, *nod)
 		runNode_knownTopology(ctx, h, receivedMessages, deliveredMessages, sentMessages, disjointPaths, topology)
 		manageConsoleInput(ctx, h, receivedMessages, deliveredMessages, disjointPaths, topology)
 	} else if *mod == "" && *dest != "" {
-		master_address = *dest
+		h.master_address = *dest
 		runNode(ctx, h, receivedMessages, deliveredMessages, sentMessages, disjointPaths, topology)
-		connectNodes(ctx, h, master_address, topology)
+		connectNodes(ctx, h, h.master_address, topology)
 		if *nod != "" {sendAddressToMaster(ctx, h, *nod)}
 		manageConsoleInput(ctx, h, receivedMessages, deliveredMessages, disjointPaths, topology)
 	} else {
@@ -64,6 +207,6 @@ func main() {
 		manageConsoleInput(ctx, h, receivedMessages, deliveredMessages, disjointPaths, topology)
 	}
 
-	// Wait forever
+	// Wait until the node is interrupted
 	select {}
 }
@@ -1,42 +1,121 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"crypto/sha1"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
 
-func handleMaster(s network.Stream, ctx context.Context, thisNode host.Host, messageContainer *MessageContainer, delivered_messages *MessageContainer, topology *Topology, disjointPaths *DisjointPaths) error {
-	// Read the buffer and extract the message
-	buf := bufio.NewReader(s)
-	message, err := buf.ReadString('\n')
-	if err != nil {
-		printError(err)
+// Check whether a message comes from the master of the node, and log it as refused otherwise.
+// The sender is checked by the transport
+func fromMaster(thisNode *Node, m Message, event string, what string) bool {
+	if thisNode.master_address != "" && extractPeerIDFromMultiaddr(m.Sender) == extractPeerIDFromMultiaddr(thisNode.master_address) {
+		return true
 	}
+	event = fmt.Sprintf("%s - %s from %s refused: not the master", event, what, addressToPrint(m.Sender, NODE_PRINTLAST))
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	return false
+}
 
-	// Transform the message into a json object with all the information
-	var m Message
-	err = json.Unmarshal([]byte(message), &m)
-	if err != nil {
-		printError(err)
+func handleMaster(m Message, ctx context.Context, thisNode *Node, messageContainer *MessageContainer, delivered_messages *MessageContainer, topology *Topology, disjointPaths *DisjointPaths) error {
+	if m.Type == mst_cmd {
+		// Managed by node, for its master only
+		if !fromMaster(thisNode, m, "scenario "+m.ID[len(m.ID)-5:], "Command") {
+			return nil
+		}
+		fmt.Printf("Master command: %s\n", m.Content)
+		cmd_err := executeCommand(ctx, thisNode, m.Content, messageContainer, delivered_messages, disjointPaths, topology)
+		// Tell the master that the command has been run, with its error if it failed
+		m.Type = mst_cmd_done
+		m.Sender = thisNode.address
+		m.Source = thisNode.address
+		m.Content = ""
+		if cmd_err != nil {
+			m.Content = cmd_err.Error()
+		}
+		err := sendToMaster(ctx, thisNode, m)
+		if err != nil {
+			printError(err)
+		}
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return nil
+	}
+
+	if m.Type == mst_cmd_done {
+		// Managed by Master when a node has run a command of a scenario
+		result := "OK"
+		if m.Content != "" {
+			result = "FAILED: " + m.Content
+		}
+		event := fmt.Sprintf("scenario %s - node %s ran the command - %s", m.ID[len(m.ID)-5:], addressToPrint(m.Source, NODE_PRINTLAST), result)
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		thisNode.commandDone(m.ID, m.Content)
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return nil
+	}
+
+	if m.Type == mst_seed {
+		// Managed by node, for its master only
+		if !fromMaster(thisNode, m, "seed", "Random seed") {
+			return nil
+		}
+		seed, err := strconv.ParseInt(m.Content, 10, 64)
+		if err != nil {
+			printError(err)
+			return err
+		}
+		thisNode.setSeed(seed)
+		fmt.Printf("Random seed set to %d\n", seed)
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return nil
+	}
+
+	if m.Type == mst_psk {
+		// Managed by node, for its master only
+		if !fromMaster(thisNode, m, "psk", "Private network key") {
+			return nil
+		}
+		err := receivePSK(m, thisNode)
+		if err != nil {
+			printError(err)
+		}
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return err
+	}
+
+	if m.Type == mst_link {
+		// Managed by node, for its master only
+		if !fromMaster(thisNode, m, "link", "Link change") {
+			return nil
+		}
+		err := receiveLinkChange(ctx, m, thisNode, topology)
+		if err != nil {
+			printError(err)
+		}
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return err
+	}
+
+	if m.Type == mst_label {
+		// Managed by Master when a node sends its label to Force in topology.csv
+		thisNode.forceLabel(m.Content, m.Source) // Scenarios address the node by its label
+		fmt.Printf("Topology updated: node %s -> %s\n", m.Content, addressToPrint(m.Source, NODE_PRINTLAST))
+		fmt.Printf("\n%s_> %s", GREEN, RESET)
+		return nil
 	}
 
 	if m.Type == mst_top {
 		// Managed by node
-		saveReceivedTop(m)
+		saveReceivedTop(m, thisNode.topology_path)
 		fmt.Println("Topology updated!")
 		fmt.Printf("\n%s_> %s", GREEN, RESET)
 		return nil
@@ -49,8 +128,7 @@ func handleMaster(s network.Stream, ctx context.Context, thisNode host.Host, mes
 		fmt.Println(topology.ctop.toString())
 	} else if m.Content == mst_top_load {
 		// Managed by node
-		topology_graph := LoadGraphFromCSV(topology_path)
-		topology.ctop.loadNeigh(topology_graph, getNodeAddress(thisNode, ADDR_DEFAULT))
+		thisNode.loadNeighbourhood(topology)
 		// topology.ctop = *loadCTop(topology_graph) // Uncomment this to laod the whole topology
 		fmt.Println(topology.ctop.toString())	
 	} else if m.Content == mst_connectall {
@@ -62,29 +140,26 @@ func handleMaster(s network.Stream, ctx context.Context, thisNode host.Host, mes
 	} else if m.Content == mst_crc_exp {
 		// Managed by node
 		// Generate an ID for the message
-		timestamp := time.Now().Unix()
-		hasher := sha1.New()
-		hasher.Write([]byte(fmt.Sprintf("%d", timestamp)))
-		msgid := fmt.Sprintf("%x", hasher.Sum(nil))
-		neighbourhood := topology.ctop.GetNeighbourhood(getNodeAddress(thisNode, ADDR_DEFAULT))
+		msgid := thisNode.newMessageID()
+		neighbourhood := topology.ctop.GetNeighbourhood(thisNode.address)
 		var visitedSet []string
 		var crc_message Message = 
 		Message{
 			ID: msgid, 
 			Type: TYPE_CRC_EXP, 
 			Sender: "", 
-			Source: getNodeAddress(thisNode, ADDR_DEFAULT), 
+			Source: thisNode.address, 
 			Target: "",
 			Content: "",
 			Neighbourhood: neighbourhood,
 			Path: visitedSet,
 		}
 		// Apply byzantine: uncomment the following line to make byzantines create troubles at the beginning
-		if applyByzantine(thisNode, &crc_message) {return nil} // drops the message if byzantine is of type 2
+		if applyByzantine(ctx, thisNode, &crc_message) {return nil} // drops the message if byzantine is of type 2
 		sendCombinedRC(ctx, thisNode, crc_message, topology, disjointPaths)
 	} else if m.Content == mst_graph {
 		// Managed by node
-		g := generateGraph(topology, mod_graph_byz)
+		g := generateGraph(topology, mod_graph_byz, thisNode.max_byzantines)
 		event := g.GraphToString()
 		logEvent(thisNode.ID().String(), false, event)
 		g.PrintGraph()
@@ -99,55 +174,33 @@ func handleMaster(s network.Stream, ctx context.Context, thisNode host.Host, mes
 		printHelp_ProtocolInfo(thisNode)
 	} else if m.Content == mst_log {
 		// Managed by node
-		timestamp := time.Now().Unix()
-		hasher := sha1.New()
-		hasher.Write([]byte(fmt.Sprintf("%d", timestamp)))
-		msgid := fmt.Sprintf("%x", hasher.Sum(nil))
+		msgid := thisNode.newMessageID()
 		var neighbourhood []string
 		var visitedSet []string
 		var log_master_message Message = 
 		Message{
 			ID: msgid, 
 			Type: TYPE_MASTER, 
-			Sender: getNodeAddress(thisNode, ADDR_DEFAULT), 
-			Source: getNodeAddress(thisNode, ADDR_DEFAULT), 
+			Sender: thisNode.address, 
+			Source: thisNode.address, 
 			Target: "",
 			Content: "",
 			Neighbourhood: neighbourhood,
 			Path: visitedSet,
 		}
 		sendLogToMaster(ctx, thisNode, log_master_message)
-	} else if len(m.Content) == 1 {
-		// Managed by Master when a node sends a letter to Force in topology.csv
-		ReplaceInCSV(topology_path, m.Source, m.Content)
-		fmt.Printf("Topology updated: node %s -> %s\n", m.Content, addressToPrint(m.Source, NODE_PRINTLAST))
 	} else if m.Content == mst_reset {
 		// Managed by node
-		readMaxByzantines(BYZANTINE_CONFIG, &MAX_BYZANTINES)
+		readMaxByzantines(BYZANTINE_CONFIG, &thisNode.max_byzantines)
 		totalReset(thisNode, messageContainer, delivered_messages, disjointPaths, topology)
 		// Load Topology
-		topology_graph := LoadGraphFromCSV(topology_path)
-		topology.ctop.loadNeigh(topology_graph, getNodeAddress(thisNode, ADDR_DEFAULT))
+		thisNode.loadNeighbourhood(topology)
 		fmt.Println(topology.ctop.toString())
 		// Connect all nodes
 		connectAllNodes(ctx, thisNode, topology)
 	} else if m.Content == cmd_byzantine {
 		// Managed by node
-		if !byzantine_status {		
-			var err error
-			bz, err = LoadByzantineConfig(BYZANTINE_CONFIG)
-			if err != nil {
-				printError(err)
-			}		
-			color_info = RED
-			event := fmt.Sprintf("byzantine - Node %s is now a byzantine", addressToPrint(thisNode.ID().String(), NODE_PRINTLAST))
-			logEvent(thisNode.ID().String(), PRINTOPTION, event)
-		} else {
-			event := fmt.Sprintf("byzantine - Node %s is no more a byzantine", addressToPrint(thisNode.ID().String(), NODE_PRINTLAST))
-			logEvent(thisNode.ID().String(), PRINTOPTION, event)
-			color_info = GREEN
-		}
-		byzantine_status = !byzantine_status
+		toggleByzantine(thisNode)
 	} else {
 		// Managed by Master when a node sends a log
 		saveReceivedLog(m)
@@ -160,36 +213,17 @@ func handleMaster(s network.Stream, ctx context.Context, thisNode host.Host, mes
 
 
 // Send master message
-func sendMaster(ctx context.Context, thisNode host.Host, m Message) {
-	m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
-	dataBytes, err := json.Marshal(m)
-	if err != nil {
-		printError(err)
-	}
-	msg := string(dataBytes)
+func sendMaster(ctx context.Context, thisNode *Node, m Message) {
+	m.Sender = thisNode.address
 
 	// Cycle through the peers connected to the current node
-	for _, p := range thisNode.Network().Peers() {
-		// open a new stream
-		stream, err := openStream(ctx, thisNode, p, PROTOCOL_MST)
-		if err != nil {
-			printError(err)
-		}
-
-		message := fmt.Sprintf("%s\n", msg)
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(message))
-		if err != nil {
-			printError(err)
-		}
+	for _, p := range thisNode.peers() {
+		send(ctx, thisNode, p, m, PROTOCOL_MST)
 
 		if m.Content == mst_crc_exp {
 			// sleep for 1.5 seconds to allow the message to be processed
-			time.Sleep(1500 * time.Millisecond)
+			clock.Sleep(ctx, 1500 * time.Millisecond)
 		}
-
-		
 	}
 }
 
@@ -221,9 +255,9 @@ func parseCommandString(input string) map[string]string {
 }
 
 // Send this node's topology file to the master node
-func sendTopology(ctx context.Context, thisNode host.Host, m Message) error {
+func sendTopology(ctx context.Context, thisNode *Node, m Message) error {
     // Prepare topology file
-	topfile := topology_path
+	topfile := thisNode.topology_path
 
     // Open log file
     f, err := os.Open(topfile)
@@ -240,29 +274,15 @@ func sendTopology(ctx context.Context, thisNode host.Host, m Message) error {
 	m.Content = string(top_str)
 
 
-	for _, p := range thisNode.Network().Peers() {
-		stream, err := openStream(ctx, thisNode, p, PROTOCOL_MST)
-		if err != nil {
-			printError(err)
-		}
-		defer stream.Close()
-
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-		}
-		message := fmt.Sprintf("%s\n", string(dataBytes))
-		_, err = stream.Write([]byte(message))
-		if err != nil {
-			printError(err)
-		}
+	for _, p := range thisNode.peers() {
+		send(ctx, thisNode, p, m, PROTOCOL_MST)
 	}
     
     return nil
 }
 
 // Send this node's log file to the master node
-func sendLogToMaster(ctx context.Context, thisNode host.Host, m Message) error {
+func sendLogToMaster(ctx context.Context, thisNode *Node, m Message) error {
     // Prepare log file path
     nodeID := addressToPrint(thisNode.ID().String(), NODE_PRINTLAST)
     logFile := fmt.Sprintf("%s/%s.log", LOGDIR, nodeID)
@@ -282,7 +302,7 @@ func sendLogToMaster(ctx context.Context, thisNode host.Host, m Message) error {
 	m.Content = string(log_str)
 
     // Parse master_address as multiaddr and get peer info
-    maddr, err := multiaddr.NewMultiaddr(master_address)
+    maddr, err := multiaddr.NewMultiaddr(thisNode.master_address)
     if err != nil {
         printError(err)
     }
@@ -291,50 +311,38 @@ func sendLogToMaster(ctx context.Context, thisNode host.Host, m Message) error {
         printError(err)
     }
 
-    stream, err := openStream(ctx, thisNode, peerInfo.ID, PROTOCOL_MST)
-    if err != nil {
-        printError(err)
-    }
-    defer stream.Close()
+	send(ctx, thisNode, peerInfo.ID, m, PROTOCOL_MST)
+    return nil
+}
 
-	dataBytes, err := json.Marshal(m)
+// Send a message to the master node
+func sendToMaster(ctx context.Context, thisNode *Node, m Message) error {
+	master_id, err := peer.Decode(extractPeerIDFromMultiaddr(thisNode.master_address))
 	if err != nil {
-		printError(err)
+		return err
 	}
-	message := fmt.Sprintf("%s\n", string(dataBytes))
-	_, err = stream.Write([]byte(message))
-	if err != nil {
-		printError(err)
-	}
-    return nil
+	send(ctx, thisNode, master_id, m, PROTOCOL_MST)
+	return nil
 }
 
-// Send the correspondant node letter to the master to replace it in the Topology
-func sendAddressToMaster(ctx context.Context, thisNode host.Host, letter string) error {
-	timestamp := time.Now().Unix()
-	hasher := sha1.New()
-	hasher.Write([]byte(fmt.Sprintf("%d", timestamp)))
-	msgid := fmt.Sprintf("%x", hasher.Sum(nil))
+// Send the correspondant node label to the master to replace it in the Topology
+func sendAddressToMaster(ctx context.Context, thisNode *Node, label string) error {
+	msgid := thisNode.newMessageID()
 	var neighbourhood []string
 	var visitedSet []string
 	var m Message = 
 	Message {
 		ID: msgid,
-		Type: TYPE_MASTER,
-		Sender: getNodeAddress(thisNode, ADDR_DEFAULT),
-		Source: getNodeAddress(thisNode, ADDR_DEFAULT),
+		Type: mst_label,
+		Sender: thisNode.address,
+		Source: thisNode.address,
 		Target: "",
-		Content: letter,
+		Content: label,
 		Neighbourhood: neighbourhood,
 		Path: visitedSet,
 	}
 
-	dataBytes, err := json.Marshal(m)
-	if err != nil {
-		printError(err)
-	}
-
-	master_maddr, err := multiaddr.NewMultiaddr(master_address)
+	master_maddr, err := multiaddr.NewMultiaddr(thisNode.master_address)
 	if err != nil {
 		printError(err)
 	}
@@ -344,87 +352,66 @@ func sendAddressToMaster(ctx context.Context, thisNode host.Host, letter string)
 		printError(err)
 	}
 
-	msg := string(dataBytes)
-	msg += "\n"
-
-	stream, err := openStream(ctx, thisNode, master_info.ID, PROTOCOL_MST)
-	if err != nil {
-		printError(err)
-	}
-
-	// Write the message on the stream
-	_, err = stream.Write([]byte(msg))
-	if err != nil {
-		printError(err)
-	}
+	send(ctx, thisNode, master_info.ID, m, PROTOCOL_MST)
 
 	return nil
 }
 
-func randomInt(min, max int) int {
-	return rand.Intn(max-min+1) + min
+// Distribute a new seed of the run to the nodes. The master uses it too
+func sendSeed(ctx context.Context, thisNode *Node, m Message, seed int64) {
+	thisNode.setSeed(seed)
+	fmt.Printf("Random seed set to %d\n", seed)
+	m.Type = mst_seed
+	m.Content = strconv.FormatInt(seed, 10)
+	sendMaster(ctx, thisNode, m)
+}
+
+func randomInt(rng *rand.Rand, min, max int) int {
+	return rng.Intn(max-min+1) + min
 }
 
-func selectByzantines(ctx context.Context, thisNode host.Host, topology *Topology) {
+func selectByzantines(ctx context.Context, thisNode *Node, topology *Topology) {
 	// Read MAX_BYZANTINES from config file
-	readMaxByzantines(BYZANTINE_CONFIG, &MAX_BYZANTINES)
-	if MAX_BYZANTINES == 0 {
+	readMaxByzantines(BYZANTINE_CONFIG, &thisNode.max_byzantines)
+	if thisNode.max_byzantines == 0 {
 		fmt.Println("No byzantine nodes selected (MAX_BYZANTINES = 0)")
 		return
 	}
 	// Get node addresses directly from peers, not from topology
 	var nodes []peer.ID
-	for _, peerID := range thisNode.Network().Peers() {
+	for _, peerID := range thisNode.peers() {
 		addr := peerID
 		nodes = append(nodes, addr)
 	}
-	if MAX_BYZANTINES >= len(nodes) {
-		fmt.Printf("MAX_BYZANTINES (%d) is greater than or equal to the number of nodes (%d). All nodes will be byzantine.\n", MAX_BYZANTINES, len(nodes))
+	if thisNode.max_byzantines >= len(nodes) {
+		fmt.Printf("MAX_BYZANTINES (%d) is greater than or equal to the number of nodes (%d). All nodes will be byzantine.\n", thisNode.max_byzantines, len(nodes))
 	}
 	selected := make(map[peer.ID]bool)
-	for len(selected) < MAX_BYZANTINES && len(selected) < len(nodes) {
-		n := nodes[randomInt(0, len(nodes)-1)]
+	for len(selected) < thisNode.max_byzantines && len(selected) < len(nodes) {
+		n := nodes[randomInt(thisNode.rng, 0, len(nodes)-1)]
 		selected[n] = true
 	}
 
 	// Send a message to the selected nodes to become byzantine
-	for p := range selected {
-		timestamp := time.Now().Unix()
-		hasher := sha1.New()
-		hasher.Write([]byte(fmt.Sprintf("%d", timestamp)))
-		msgid := fmt.Sprintf("%x", hasher.Sum(nil))
+	for _, p := range nodes {
+		if !selected[p] {
+			continue
+		}
+		msgid := thisNode.newMessageID()
 		var neighbourhood []string
 		var visitedSet []string
 		var m Message = 
 		Message {
 			ID: msgid,
 			Type: TYPE_MASTER,
-			Sender: getNodeAddress(thisNode, ADDR_DEFAULT),
-			Source: getNodeAddress(thisNode, ADDR_DEFAULT),
+			Sender: thisNode.address,
+			Source: thisNode.address,
 			Target: p.String(),
 			Content: cmd_byzantine,
 			Neighbourhood: neighbourhood,
 			Path: visitedSet,
 		}
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-		}
-		msg := string(dataBytes)
-		msg += "\n"
-
-		stream, err := openStream(ctx, thisNode, p, PROTOCOL_MST)
-		if err != nil || stream == nil {
-			printError(err)
-			continue
-		}
-		defer stream.Close()
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(msg))
-		if err != nil {
-			printError(err)
-		}
+		send(ctx, thisNode, p, m, PROTOCOL_MST)
 
 		fmt.Printf("Node %s selected as byzantine\n", addressToPrint(p.String(), NODE_PRINTLAST))
 	}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	MEMORY TRANSPORT
+	Transports of the same MemoryNetwork exchange messages without sockets:
+	a message is handed to the handler of the target on the clock, delay after being sent.
+	On the virtual clock this makes the network a discrete-event simulation.
+	Links between transports are made with Link and Unlink.
+	If the network has a connection check, a link can only be used while the check
+	says that its two ends are connected: this way the links can follow connections
+	that are made and closed outside the memory network.
+*/
+type MemoryNetwork struct {
+	mu			sync.Mutex
+	delay		time.Duration						// Time needed by a message to cross a link
+	transports	map[peer.ID]*MemoryTransport
+	links		map[peer.ID]map[peer.ID]bool
+	delivered	map[protocol.ID]int					// Number of messages delivered, for each protocol
+	connected	func(a peer.ID, b peer.ID) bool		// Connection check, nil if links are always usable
+}
+
+type MemoryTransport struct {
+	network		*MemoryNetwork
+	id			peer.ID
+	address		string
+	handlers	map[protocol.ID]peerMessageHandler
+	encoding	string								// Messages are copied through this encoding
+}
+
+// Return a new MemoryNetwork whose links have the given delay
+func NewMemoryNetwork(delay time.Duration) *MemoryNetwork {
+	return &MemoryNetwork{
+		delay:		delay,
+		transports:	make(map[peer.ID]*MemoryTransport),
+		links:		make(map[peer.ID]map[peer.ID]bool),
+		delivered:	make(map[protocol.ID]int),
+	}
+}
+
+// Return a new transport of the network with the given identity
+func (mn *MemoryNetwork) NewTransport(id peer.ID, address string) *MemoryTransport {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	t := &MemoryTransport{
+		network:	mn,
+		id:			id,
+		address:	address,
+		handlers:	make(map[protocol.ID]peerMessageHandler),
+		encoding:	ENC_JSON,
+	}
+	mn.transports[id] = t
+	mn.links[id] = make(map[peer.ID]bool)
+	return t
+}
+
+// Link two transports. Links are bidirectional
+func (mn *MemoryNetwork) Link(a peer.ID, b peer.ID) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if mn.links[a] == nil || mn.links[b] == nil {
+		return
+	}
+	mn.links[a][b] = true
+	mn.links[b][a] = true
+}
+
+// Remove the link between two transports
+func (mn *MemoryNetwork) Unlink(a peer.ID, b peer.ID) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	delete(mn.links[a], b)
+	delete(mn.links[b], a)
+}
+
+// Set the connection check of the links
+func (mn *MemoryNetwork) SetConnectionCheck(connected func(a peer.ID, b peer.ID) bool) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.connected = connected
+}
+
+// Check whether the link from a to b exists and can be used. Must be called with mn.mu locked
+func (mn *MemoryNetwork) isLinked(a peer.ID, b peer.ID) bool {
+	if !mn.links[a][b] {
+		return false
+	}
+	return mn.connected == nil || mn.connected(a, b)
+}
+
+// Number of messages delivered so far, for each protocol
+func (mn *MemoryNetwork) Delivered() map[protocol.ID]int {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	delivered := make(map[protocol.ID]int)
+	for p, n := range mn.delivered {
+		delivered[p] = n
+	}
+	return delivered
+}
+
+func (t *MemoryTransport) ID() peer.ID {
+	return t.id
+}
+
+func (t *MemoryTransport) Address() string {
+	return t.address
+}
+
+func (t *MemoryTransport) Neighbours() []peer.ID {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	var peers []peer.ID
+	for p := range t.network.links[t.id] {
+		if t.network.isLinked(t.id, p) {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// The target gets its own copy of the message, as if it had read it from a stream
+func (t *MemoryTransport) Send(ctx context.Context, target peer.ID, protocol protocol.ID, m Message) error {
+	mn := t.network
+	mn.mu.Lock()
+	linked := mn.isLinked(t.id, target)
+	var handler peerMessageHandler
+	if linked {
+		handler = mn.transports[target].handlers[protocol]
+	}
+	encoding := t.encoding
+	mn.mu.Unlock()
+
+	if !linked {
+		return fmt.Errorf("failed to send message to %s: not connected", target)
+	}
+	if handler == nil {
+		return fmt.Errorf("failed to send message to %s: protocol %s not supported", target, protocol)
+	}
+
+	dataBytes, err := encodeMessage(m, encoding)
+	if err != nil {
+		return err
+	}
+	copy, err := decodeMessage(dataBytes)
+	if err != nil {
+		return err
+	}
+
+	clock.AfterFunc(ctx, mn.delay, func(ctx context.Context) {
+		mn.mu.Lock()
+		mn.delivered[protocol]++
+		mn.mu.Unlock()
+		err := handler(ctx, t.id, copy)
+		if err != nil {
+			printError(err)
+		}
+	})
+	return nil
+}
+
+func (t *MemoryTransport) SetEncoding(encoding string) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.encoding = encoding
+}
+
+func (t *MemoryTransport) Encoding() string {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	return t.encoding
+}
+
+func (t *MemoryTransport) SetHandler(protocol protocol.ID, handler peerMessageHandler) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.handlers[protocol] = handler
+}
@@ -3,6 +3,7 @@ package main
 import "fmt"
 
 type Message struct {
+	Version			string			`json:"version"`			// Version of the protocol of the message, set when sent
 	ID				string			`json:"id"`
 	InstanceID		string			`json:"instanceid"`
 	Type 			string			`json:"type"`
@@ -56,6 +57,9 @@ func msgToString(m Message) string {
 		ne = ""
 	case TYPE_CRC_CNT :
 		ne = ""
+	case TYPE_BRB_SEND, TYPE_BRB_ECHO, TYPE_BRB_READY :
+		ta = ""
+		ne = ""
 	}
 
 	msg := id + iid + ty + se + so + ta + co + ne + pa
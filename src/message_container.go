@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
-	"time"
 )
 
 /*
@@ -105,6 +105,9 @@ func (mc *MessageContainer) Reset() {
 func (mc *MessageContainer) countNodeDisjointPaths(msg_id string) int {
 	// Get all the messages corresponding to the ID msg_id
 	messages := mc.Get(msg_id)
+	if len(messages) == 0 {
+		return 0
+	}
 	
 	// Create a new graph
 	graph := NewGraph()
@@ -118,7 +121,7 @@ func (mc *MessageContainer) countNodeDisjointPaths(msg_id string) int {
 	//graph.PrintGraph()
 	
 	// Count the number of node disjoint paths
-	source := messages[0].Sender
+	source := messages[0].Source
 	target := messages[0].Target
 	return graph.FordFulkerson(source, target)
 }
@@ -167,8 +170,9 @@ func (mc *MessageContainer) countNodeDisjointPaths_intersection(msg_id string) [
 
 // GetDisjointPathsMinCut finds the maximum set of node-disjoint paths
 // among all Message.Path of messages[msg_id], using Edmonds–Karp (BFS).
-func (mc *MessageContainer) GetDisjointPathsEdmondKarp(msg_id string) [][]string {
-    timestamp_start := time.Now()
+// node_id is the node owning the container, used for logging.
+func (mc *MessageContainer) GetDisjointPathsEdmondKarp(msg_id string, node_id string) [][]string {
+    timestamp_start := clock.Now()
     messages := mc.Get(msg_id)
     if len(messages) == 0 {
         return nil
@@ -255,9 +259,9 @@ func (mc *MessageContainer) GetDisjointPathsEdmondKarp(msg_id string) [][]string
         result = append(result, path)
     }
 
-    timestamp_end := time.Now()
+    timestamp_end := clock.Now()
 	event := fmt.Sprintf("DJP_COUNT: %d - performed in time %f seconds", len(result), timestamp_end.Sub(timestamp_start).Seconds())
-	logEvent(addressToPrint(thisnode_address, NODE_PRINTLAST), PRINTOPTION, event)
+	logEvent(addressToPrint(node_id, NODE_PRINTLAST), PRINTOPTION, event)
 
     return result
 }
@@ -266,8 +270,9 @@ func (mc *MessageContainer) GetDisjointPathsEdmondKarp(msg_id string) [][]string
 // GetDisjointPathsBrute tries every subset of message paths and
 // returns the largest node-disjoint collection (NP-complete approach)
 // runs in O(2^m * m * l) with m paths of length up to l
-func (mc *MessageContainer) GetDisjointPathsBrute(msg_id string) [][]string {
-    timestamp_start := time.Now()
+// node_id is the node owning the container, used for logging.
+func (mc *MessageContainer) GetDisjointPathsBrute(msg_id string, node_id string) [][]string {
+    timestamp_start := clock.Now()
     messages := mc.Get(msg_id)
     n := len(messages)
     if n == 0 {
@@ -316,9 +321,185 @@ func (mc *MessageContainer) GetDisjointPathsBrute(msg_id string) [][]string {
         }
     }
 
-    timestamp_end := time.Now()
+    timestamp_end := clock.Now()
 	event := fmt.Sprintf("DJP_COUNT - performed in time %f seconds", timestamp_end.Sub(timestamp_start).Seconds())
-	logEvent(addressToPrint(thisnode_address, NODE_PRINTLAST), PRINTOPTION, event)
+	logEvent(addressToPrint(node_id, NODE_PRINTLAST), PRINTOPTION, event)
 
     return best
 }
+
+// Check whether a path is already among the paths of msg_id
+func (mc *MessageContainer) hasPath(msg_id string, path []string) bool {
+    for _, m := range mc.Get(msg_id) {
+        if len(m.Path) != len(path) {
+            continue
+        }
+        equal := true
+        for i := range path {
+            if m.Path[i] != path[i] {
+                equal = false
+                break
+            }
+        }
+        if equal {
+            return true
+        }
+    }
+    return false
+}
+
+// Check whether k node-disjoint paths are among the paths of msg_id.
+// Unlike GetDisjointPathsEdmondKarp, paths are never combined, so a path made up by a byzantine
+// can't be joined with pieces of other paths. All the nodes of a path count: paths must not contain
+// their endpoints, and the empty path (a message received from its source) is disjoint from any other.
+// Choosing the paths is a set packing: it is made with branch and bound (see packPaths),
+// so that the paths of a dense network are checked in polynomial time in practice
+func (mc *MessageContainer) hasDisjointPaths(msg_id string, k int) bool {
+    // Give an index to the nodes of the paths, and turn each path into the set of its nodes
+    index := make(map[string]int)
+    var paths []pathSet
+    for _, m := range mc.Get(msg_id) {
+        if len(m.Path) == 0 {
+            k--
+            continue
+        }
+        var nodes []int
+        for _, node := range m.Path {
+            i, ok := index[node]
+            if !ok {
+                i = len(index)
+                index[node] = i
+            }
+            nodes = append(nodes, i)
+        }
+        paths = append(paths, pathSet{nodes: nodes})
+    }
+    if k <= 0 {
+        return true
+    }
+    words := (len(index) + 63) / 64
+    for i := range paths {
+        paths[i].mask = make([]uint64, words)
+        for _, node := range paths[i].nodes {
+            paths[i].mask[node/64] |= 1 << (node % 64)
+        }
+    }
+    // Short paths first: they meet less paths
+    sort.SliceStable(paths, func(i, j int) bool {
+        return len(paths[i].nodes) < len(paths[j].nodes)
+    })
+    return packPaths(paths, k, len(index))
+}
+
+// A path as the set of its nodes, by index
+type pathSet struct {
+    nodes   []int
+    mask    []uint64
+}
+
+func (p pathSet) meets(q pathSet) bool {
+    for i := range p.mask {
+        if p.mask[i]&q.mask[i] != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// Check whether k pairwise disjoint paths are among paths, sorted by length.
+// Combining paths can only give more disjoint paths, so if the max-flow on the nodes of the paths
+// is less than k there is no choice. Otherwise paths are taken greedily, and only if that fails
+// both choices are tried for the first path: either it is taken, and the paths that meet it are not, or it is not
+func packPaths(paths []pathSet, k int, nodes int) bool {
+    if k <= 0 {
+        return true
+    }
+    if len(paths) < k || pathsMaxFlow(paths, nodes, k) < k {
+        return false
+    }
+
+    var taken []pathSet
+    for _, p := range paths {
+        free := true
+        for _, t := range taken {
+            if p.meets(t) {
+                free = false
+                break
+            }
+        }
+        if free {
+            taken = append(taken, p)
+            if len(taken) == k {
+                return true
+            }
+        }
+    }
+
+    first := paths[0]
+    var rest []pathSet
+    for _, p := range paths[1:] {
+        if !p.meets(first) {
+            rest = append(rest, p)
+        }
+    }
+    return packPaths(rest, k-1, nodes) || packPaths(paths[1:], k, nodes)
+}
+
+// Number of node-disjoint paths from the first nodes to the last nodes of the paths,
+// in the graph made by all the paths, up to limit. Each node is split in an in and an out
+// vertex joined by an edge of capacity 1, so that at most one path goes through it
+func pathsMaxFlow(paths []pathSet, nodes int, limit int) int {
+    source, sink := 2*nodes, 2*nodes+1
+    capacity := make([]map[int]int, 2*nodes+2)
+    for v := range capacity {
+        capacity[v] = make(map[int]int)
+    }
+    for v := 0; v < nodes; v++ {
+        capacity[2*v][2*v+1] = 1
+    }
+    link := func(u, v int) {
+        if _, ok := capacity[u][v]; !ok {
+            capacity[u][v] = limit
+            if _, ok := capacity[v][u]; !ok {
+                capacity[v][u] = 0
+            }
+        }
+    }
+    for _, p := range paths {
+        link(source, 2*p.nodes[0])
+        for i := 0; i+1 < len(p.nodes); i++ {
+            link(2*p.nodes[i]+1, 2*p.nodes[i+1])
+        }
+        link(2*p.nodes[len(p.nodes)-1]+1, sink)
+    }
+
+    // Edmonds-Karp: every augmenting path found with BFS carries one more path
+    flow := 0
+    for flow < limit {
+        parent := make([]int, len(capacity))
+        for v := range parent {
+            parent[v] = -1
+        }
+        parent[source] = source
+        queue := []int{source}
+        for len(queue) > 0 && parent[sink] == -1 {
+            u := queue[0]
+            queue = queue[1:]
+            for v, c := range capacity[u] {
+                if c > 0 && parent[v] == -1 {
+                    parent[v] = u
+                    queue = append(queue, v)
+                }
+            }
+        }
+        if parent[sink] == -1 {
+            break
+        }
+        for v := sink; v != source; v = parent[v] {
+            capacity[parent[v]][v]--
+            capacity[v][parent[v]]++
+        }
+        flow++
+    }
+    return flow
+}
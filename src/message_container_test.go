@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Container with one copy of the message "m" for each path
+func pathsContainer(paths [][]string) *MessageContainer {
+	mc := NewMessageContainer()
+	for _, path := range paths {
+		mc.Add(Message{ID: "m", Path: path})
+	}
+	return mc
+}
+
+// Try every choice of k paths, as hasDisjointPaths used to
+func bruteDisjointPaths(paths [][]string, k int) bool {
+	used := make(map[string]bool)
+	var pick func(start int, k int) bool
+	pick = func(start int, k int) bool {
+		if k == 0 {
+			return true
+		}
+		for i := start; i < len(paths); i++ {
+			free := true
+			for _, node := range paths[i] {
+				if used[node] {
+					free = false
+					break
+				}
+			}
+			if !free {
+				continue
+			}
+			for _, node := range paths[i] {
+				used[node] = true
+			}
+			found := pick(i+1, k-1)
+			for _, node := range paths[i] {
+				delete(used, node)
+			}
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+	return pick(0, k)
+}
+
+// Simple paths from source to target in the graph, without their endpoints, with at most max_inner nodes
+func innerPaths(g *Graph, source string, target string, max_inner int) [][]string {
+	var paths [][]string
+	visited := map[string]bool{source: true}
+	var visit func(node string, path []string)
+	visit = func(node string, path []string) {
+		neighbours := append([]string{}, g.adjList[node]...)
+		sort.Strings(neighbours)
+		for _, next := range neighbours {
+			if next == target {
+				if node != source {
+					paths = append(paths, append([]string{}, path...))
+				}
+				continue
+			}
+			if visited[next] || len(path) == max_inner {
+				continue
+			}
+			visited[next] = true
+			visit(next, append(path, next))
+			visited[next] = false
+		}
+	}
+	visit(source, nil)
+	return paths
+}
+
+func TestHasDisjointPaths(t *testing.T) {
+	tests := []struct {
+		name	string
+		paths	[][]string
+		k		int
+		want	bool
+	}{
+		{"no paths", nil, 1, false},
+		{"nothing needed", nil, 0, true},
+		{"empty path", [][]string{{}}, 1, true},
+		{"empty path is disjoint", [][]string{{}, {"A", "B"}}, 2, true},
+		{"shared node", [][]string{{"A", "B"}, {"B", "C"}}, 2, false},
+		{"disjoint", [][]string{{"A", "B"}, {"C"}, {"D", "E"}}, 3, true},
+		// The first shortest path blocks the two others: greedy choice fails
+		{"greedy fails", [][]string{{"A", "D"}, {"A", "B"}, {"C", "D"}}, 2, true},
+		// A max-flow on the paths finds A-M-B and C-N-D, but every two paths meet
+		{"paths are not combined", [][]string{{"A", "M", "D"}, {"C", "M", "B"}, {"A", "N", "B"}, {"C", "N", "D"}}, 2, false},
+	}
+	for _, test := range tests {
+		got := pathsContainer(test.paths).hasDisjointPaths("m", test.k)
+		if got != test.want {
+			t.Errorf("%s: hasDisjointPaths(%d) = %v, expected %v", test.name, test.k, got, test.want)
+		}
+	}
+}
+
+// Random choices of paths of a small network give the same answer as trying every choice
+func TestHasDisjointPathsBrute(t *testing.T) {
+	g := LoadGraphFromCSV("../topologies/10nodes_4connected.csv")
+	all := innerPaths(g, "A", "F", 4)
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 200; run++ {
+		var paths [][]string
+		for _, i := range rng.Perm(len(all))[:1+rng.Intn(12)] {
+			paths = append(paths, all[i])
+		}
+		mc := pathsContainer(paths)
+		for k := 1; k <= 5; k++ {
+			want := bruteDisjointPaths(paths, k)
+			if got := mc.hasDisjointPaths("m", k); got != want {
+				t.Fatalf("paths %v: hasDisjointPaths(%d) = %v, expected %v", paths, k, got, want)
+			}
+		}
+	}
+}
+
+// Thousands of paths of a dense network are checked at once
+func TestHasDisjointPathsDense(t *testing.T) {
+	g := LoadGraphFromCSV("../topologies/20nodes_18connected.csv")
+	// The only node that is not a neighbour of A, so that there is no empty path
+	var target string
+	for node := range g.nodes {
+		if node != "A" && !g.isEdgePresent("A", node) {
+			target = node
+		}
+	}
+	paths := innerPaths(g, "A", target, 3)
+	mc := pathsContainer(paths)
+
+	start := time.Now()
+	for _, test := range []struct {
+		k		int
+		want	bool
+	}{
+		{7, true},
+		{13, true},
+		{18, true},
+		{19, false},	// The target has 18 neighbours
+	} {
+		if got := mc.hasDisjointPaths("m", test.k); got != test.want {
+			t.Errorf("%d paths: hasDisjointPaths(%d) = %v, expected %v", len(paths), test.k, got, test.want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("%d paths checked in %s", len(paths), elapsed)
+	}
+}
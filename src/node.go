@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	A Node is an ARGO process: a libp2p host together with the state
+	that belongs to that single process in the network.
+	Many nodes may live in the same OS process (see simulator.go),
+	so nothing in here must be shared between nodes.
+*/
+type Node struct {
+	host.Host
+
+	address				string			// Full multiaddress of this node, "<ADDRESS>/p2p/<PEER_ID>"
+	master_address		string			// Full multiaddress of the master node, "" if there is none
+	byzantine_status	bool			// True if this node is currently a byzantine
+	bz					Byzantine		// Byzantine behaviour, loaded from BYZANTINE_CONFIG
+	max_byzantines		int				// Number of byzantines tolerated in the network
+	topology_path		string			// Path of the .csv file describing the topology
+	labels				map[string]string	// Node label in the topology file -> node address. Empty if the file already contains addresses
+	labels_mu			sync.Mutex		// Labels are written by the master handlers while the console reads them
+	commands			map[string]*commandAnswer	// Commands of a scenario sent by this master, waiting for the answer of their node, see scenario.go
+	commands_mu			sync.Mutex
+	rewired				map[linkKey]bool	// Edges added (true) or removed (false) by the master to the topology of the file, see rewiring.go
+	transport			Transport		// Used by the protocols to exchange messages
+	seed				int64			// Seed of the run, written in the log so that the run can be replayed
+	rng					*rand.Rand		// Random source of every random choice of this node
+	msg_count			atomic.Uint64	// Messages made by this node, so that each one gets its own ID
+	detector			*FailureDetector	// Suspicion level of the neighbours, from their heartbeats
+	bracha				*Bracha			// Broadcasts of the Bracha reliable broadcast, see protocol_bracha.go
+	bdopt				*BDopt			// Broadcasts of the Bracha-Dolev reliable broadcast, see protocol_bdopt.go
+	dolevu				*DolevU			// Modifications of the broadcast of /nab/ and their counters, see protocol_broadcast.go
+	pool_config			PoolConfig		// Queue and workers of the protocols, see worker_pool.go
+	pools				map[protocol.ID]*workerPool
+	pools_mu			sync.Mutex
+	limiter				*RateLimiter	// Limits on the messages that each peer can send, see rate_limiter.go
+	discovery			*Discovery		// Neighbours found with mDNS, see discovery.go. Nil if the node doesn't look for them
+	psk_path			string			// Key file of the private network of the node, see psk.go. "" if it has none
+	psk_id				string			// Fingerprint of the key in use, "" if the node talks to any node
+	gater				*TopologyGater	// Keeps the node to its neighbours, see gater.go. Nil if the node connects to any peer
+	shutdown_hooks		[]shutdownHook	// State saved when the node shuts down, in order
+	shutdown_once		sync.Once
+}
+
+// Something to save when the node shuts down
+type shutdownHook struct {
+	name	string
+	save	func() error
+}
+
+// Return a new Node wrapping the host h, reachable at address
+func NewNode(h host.Host, address string) *Node {
+	return &Node{
+		Host:			h,
+		address:		address,
+		master_address:	"",
+		topology_path:	topology_path,
+		labels:			make(map[string]string),
+		commands:		make(map[string]*commandAnswer),
+		rewired:		make(map[linkKey]bool),
+		transport:		newLibp2pTransport(h, address),
+		rng:			rand.New(rand.NewSource(0)),
+		detector:		NewFailureDetector(),
+		bracha:			NewBracha(),
+		bdopt:			NewBDopt(),
+		dolevu:			NewDolevU(),
+		pool_config:	PoolConfig{size: POOL_QUEUE_SIZE, workers: POOL_WORKERS, policy: POOL_BLOCK},
+		pools:			make(map[protocol.ID]*workerPool),
+		limiter:		NewRateLimiter(),
+	}
+}
+
+// Seed the random source of the node.
+// Every node of a run gets the same seed, mixed with the node ID
+// so that nodes don't make the same choices
+func (n *Node) setSeed(seed int64) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(n.ID()))
+	n.seed = seed
+	n.rng = rand.New(rand.NewSource(seed ^ int64(hasher.Sum64())))
+
+	event := fmt.Sprintf("seed - Random source seeded with %d", seed)
+	logEvent(n.ID().String(), false, event)
+}
+
+// Return the ID of a new message made by this node, from the node ID, the time and a counter:
+// messages made at the same time, as on the virtual clock, get different IDs
+func (n *Node) newMessageID() string {
+	count := n.msg_count.Add(1)
+	hasher := sha1.New()
+	hasher.Write([]byte(fmt.Sprintf("%s/%d/%d", n.ID(), clock.Now().UnixNano(), count)))
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// Protocols whose handlers trust the sender of the messages, as if links were authenticated
+var authenticatedProtocols = map[protocol.ID]bool{
+	PROTOCOL_MST:	true,
+	PROTOCOL_NAB:	true,
+	PROTOCOL_BRB:	true,
+	PROTOCOL_BDOPT:	true,
+	PROTOCOL_HB:	true,
+}
+
+// Set the handler for the messages of a protocol.
+// Messages sent with an incompatible version of the protocol are refused, and so are the ones
+// over the rate limit of their peer, or not sent by their sender on authenticated protocols. The others wait in the queue of the protocol for a worker to handle them
+func (n *Node) setHandler(ctx context.Context, protocol protocol.ID, handler messageHandler) {
+	deliver := func(event_ctx context.Context, m Message) error {
+		return handler(withEvent(ctx, event_ctx), m)
+	}
+	if _, virtual := clock.(*VirtualClock); !virtual {
+		pool := newWorkerPool(n.ID().String(), protocol, n.poolConfig(protocol), handler)
+		n.pools_mu.Lock()
+		if old, ok := n.pools[protocol]; ok {
+			old.close()
+		}
+		n.pools[protocol] = pool
+		n.pools_mu.Unlock()
+		deliver = func(event_ctx context.Context, m Message) error {
+			pool.push(ctx, m)
+			return nil
+		}
+	}
+
+	n.transport.SetHandler(protocol, func(event_ctx context.Context, from peer.ID, m Message) error {
+		if !compatibleVersions(m.Version, protocolVersion(protocol)) {
+			event := fmt.Sprintf("version %s - Message from %s refused: version %q is not compatible with %s", addressToPrint(m.ID, NODE_PRINTLAST), addressToPrint(m.Sender, NODE_PRINTLAST), m.Version, protocol)
+			logEvent(n.ID().String(), PRINTOPTION, event)
+			return nil
+		}
+		if authenticatedProtocols[protocol] && extractPeerIDFromMultiaddr(m.Sender) != from.String() {
+			event := fmt.Sprintf("auth %s - Message from %s refused: sent by %s", addressToPrint(m.ID, NODE_PRINTLAST), addressToPrint(m.Sender, NODE_PRINTLAST), addressToPrint(from.String(), NODE_PRINTLAST))
+			logEvent(n.ID().String(), PRINTOPTION, event)
+			return nil
+		}
+		allowed, limited := n.limiter.allow(from, protocol)
+		if !allowed {
+			n.overLimit(from, protocol, m, limited)
+			return nil
+		}
+		return deliver(event_ctx, m)
+	})
+}
+
+// Queue and workers of a protocol.
+// Master messages are never dropped, and they are handled one at a time, in the order they were sent
+func (n *Node) poolConfig(protocol protocol.ID) PoolConfig {
+	config := n.pool_config
+	if protocol == PROTOCOL_MST {
+		config.workers = 1
+		config.policy = POOL_BLOCK
+	}
+	return config
+}
+
+// Worker pools of the protocols of this node, sorted by protocol
+func (n *Node) getPools() []*workerPool {
+	n.pools_mu.Lock()
+	defer n.pools_mu.Unlock()
+	var pools []*workerPool
+	for _, p := range n.pools {
+		pools = append(pools, p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].protocol < pools[j].protocol })
+	return pools
+}
+
+// Save something when the node shuts down, after the peers have been told that the node is leaving
+func (n *Node) onShutdown(name string, save func() error) {
+	n.shutdown_hooks = append(n.shutdown_hooks, shutdownHook{name: name, save: save})
+}
+
+// Get the neighbours of this node, sorted by ID
+// so that messages are always sent to the peers in the same order
+func (n *Node) peers() []peer.ID {
+	return n.transport.Neighbours()
+}
+
+// Replace the label with the address of the node in the topology file, and remember it.
+// Nodes may send their labels at the same time, so the file is only written by one of them at a time
+func (n *Node) forceLabel(label string, address string) {
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	ReplaceInCSV(n.topology_path, address, label)
+	n.labels[label] = address
+}
+
+// Remember the address of the node with the given label, without writing the topology file
+func (n *Node) setLabel(label string, address string) {
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	n.labels[label] = address
+}
+
+// Get the address of the node with the given label
+func (n *Node) getLabel(label string) (string, bool) {
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	address, ok := n.labels[label]
+	return address, ok
+}
+
+// Number of labels known by this node
+func (n *Node) countLabels() int {
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	return len(n.labels)
+}
+
+// Load the topology graph from this node's topology file.
+// If the file uses labels instead of addresses, labels are translated into addresses.
+// The edges changed by the master are changed in the graph too
+func (n *Node) loadTopologyGraph() *Graph {
+	topology_graph := LoadGraphFromCSV(n.topology_path)
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	if len(n.labels) > 0 {
+		topology_graph = relabelGraph(topology_graph, n.labels)
+	}
+	n.applyRewiring(topology_graph)
+	return topology_graph
+}
+
+// Load the neighbourhood of this node from its topology file in the cTop, and enforce it on the gate.
+// BDopt gets the size of the network from here
+func (n *Node) loadNeighbourhood(topology *Topology) {
+	topology_graph := n.loadTopologyGraph()
+	topology.ctop.loadNeigh(topology_graph, n.address)
+	n.bdopt.setNetworkSize(len(topology_graph.nodes))
+	n.enforceTopology(topology.ctop.GetNeighbourhood(n.address))
+}
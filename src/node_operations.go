@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/libp2p/go-libp2p"
@@ -13,27 +14,6 @@ import (
 	"github.com/multiformats/go-multiaddr"
 )
 
-// Gets a string with the complete address of a node
-// In the h.Addrs() array, the element in pos 3 (= ADDR_LAN_POS) is the LAN address
-// and the element in pos 0 (=ADDR_LB_POS) is the loopback address
-// The address is returned in the format "<ADDRESS>/p2p/<PEER_ID>"
-func getNodeAddress(h host.Host, ADDRESS_TYPE string) string {
-	if ADDRESS_TYPE == ADDR_LAN {
-		return fmt.Sprintf("%s/p2p/%s", h.Addrs()[ADDR_LAN_POS], h.ID())
-	} else if ADDRESS_TYPE == ADDR_LOOPBACK {
-		return fmt.Sprintf("%s/p2p/%s", h.Addrs()[ADDR_LB_POS], h.ID())
-	}
-	return ""
-	/*
-	for _, addr := range h.Addrs() {
-		if addr.Protocols()[0].Code == multiaddr.P_IP4 && addr.Protocols()[1].Code == multiaddr.P_TCP {
-			return fmt.Sprintf("%s/p2p/%s", addr, h.ID())
-		}
-	}
-	return ""
-	*/
-}
-
 // Extract Peer ID from a string Multiaddress
 func extractPeerIDFromMultiaddr(addr string) string {
     parts := strings.Split(addr, "/p2p/")
@@ -45,8 +25,8 @@ func extractPeerIDFromMultiaddr(addr string) string {
 
 
 // Creates a node
-func createNode() host.Host {
-	node, err := libp2p.New()
+func createNode(opts ...libp2p.Option) host.Host {
+	node, err := libp2p.New(opts...)
 	if err != nil {
 		printError(err)		
 	}
@@ -70,145 +50,99 @@ func getStreamEndpoints(s network.Stream, h host.Host, ADDRESS_TYPE string) stri
 		fmt.Printf("%d - %s\n", i, a)
 	}
 
-	if ADDRESS_TYPE == ADDR_LAN {
-		return fmt.Sprintf("%s/p2p/%s",senderAddrs[ADDR_LAN_POS], senderID)
-	} else if ADDRESS_TYPE == ADDR_LOOPBACK {
-		return fmt.Sprintf("%s/p2p/%s", senderAddrs[ADDR_LB_POS], senderID)
+	a := selectAddress(senderAddrs, ADDRESS_TYPE)
+	if a == nil {
+		return ""
 	}
-	return ""
+	return fmt.Sprintf("%s/p2p/%s", a, senderID)
 }
 
 // Run the node by setting the stream handler 
-func runNode(ctx context.Context, h host.Host, messageContainer *MessageContainer, 
+func runNode(ctx context.Context, h *Node, messageContainer *MessageContainer, 
 			deliveredMessages *MessageContainer, sentMessages *MessageContainer, 
 			disjointPaths *DisjointPaths, topology *Topology) {
-	fmt.Println("Running node: ", getNodeAddress(h, ADDR_DEFAULT))
-	topology.nodeID = getNodeAddress(h, ADDR_DEFAULT)
+	fmt.Println("Running node: ", h.address)
+	h.dolevu.setKnownTopology(false)
+	setStreamHandlers(ctx, h, messageContainer, deliveredMessages, sentMessages, disjointPaths, topology)
 
-	// Set stream handler for direct messages
-	h.SetStreamHandler(PROTOCOL_CHAT, func (s network.Stream)  {
-		//fmt.Println("/chat/1.0.0 stream created for node ", getNodeAddress(h))
-		err := handleStream(s, messageContainer)
+	// Look for the neighbours only when their messages can be handled
+	if h.discovery != nil {
+		err := h.startDiscovery(ctx)
 		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
+			printError(err)
 		}
-	})
+	}
 
-	// Set stream handler for Naive Broadcast messages
-	h.SetStreamHandler(PROTOCOL_NAB, func (s network.Stream)  {
-		err := handleBroadcast(s, ctx, h, messageContainer)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
-	})
+	printStartMessage(h, mod_help_prot)
+	printNodeInfo(h)
+}
 
-	// Set stream handler for Detector messages
-	h.SetStreamHandler(PROTOCOL_DET, func (s network.Stream)  {
-		err := handleDetector(s, ctx, h, topology, messageContainer)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
-	})
 
-	// Set stream handler for master-slave messages
-	h.SetStreamHandler(PROTOCOL_MST, func (s network.Stream)  {
-		err := handleMaster(s, ctx, h, messageContainer, deliveredMessages, topology, disjointPaths)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
-	})
-	
-	// Set stream handler for combinedRC messages
-	h.SetStreamHandler(PROTOCOL_CRC, func (s network.Stream)  {
-		err := handleCombinedRC(s, ctx, h, topology, messageContainer, deliveredMessages, sentMessages, disjointPaths)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
-	})
+// Run the node by setting the stream handler 
+func runNode_knownTopology(ctx context.Context, h *Node, messageContainer *MessageContainer, 
+						deliveredMessages *MessageContainer, sentMessages *MessageContainer,
+						disjointPaths *DisjointPaths, topology *Topology) {
+	fmt.Println("Running node: ", h.address)
+	h.dolevu.setKnownTopology(true)
+	setStreamHandlers(ctx, h, messageContainer, deliveredMessages, sentMessages, disjointPaths, topology)
+
+	// Load the neighbourhood in cTop from a file
+	h.loadNeighbourhood(topology)
 
 	printStartMessage(h, mod_help_prot)
 	printNodeInfo(h)
 }
 
-
-// Run the node by setting the stream handler 
-func runNode_knownTopology(ctx context.Context, h host.Host, messageContainer *MessageContainer, 
+// Set the stream handlers of all the protocols on the node.
+// Every node owns its data structs, so that more nodes can run in the same process
+func setStreamHandlers(ctx context.Context, h *Node, messageContainer *MessageContainer, 
 						deliveredMessages *MessageContainer, sentMessages *MessageContainer,
 						disjointPaths *DisjointPaths, topology *Topology) {
-	fmt.Println("Running node: ", getNodeAddress(h, ADDR_DEFAULT))
-	topology.nodeID = getNodeAddress(h, ADDR_DEFAULT)
+	topology.nodeID = h.address
 
-	// Set stream handler for direct messages
-	h.SetStreamHandler(PROTOCOL_CHAT, func (s network.Stream)  {
-		//fmt.Println("/chat/1.0.0 stream created for node ", getNodeAddress(h))
-		err := handleStream(s, messageContainer)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
+	// Set handler for direct messages
+	h.setHandler(ctx, PROTOCOL_CHAT, func (ctx context.Context, m Message) error {
+		return handleChat(m, messageContainer)
 	})
 
-	// Set stream handler for Naive Broadcast messages
-	h.SetStreamHandler(PROTOCOL_NAB, func (s network.Stream)  {
-		err := handleBroadcast(s, ctx, h, messageContainer)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
+	// Set handler for Naive Broadcast messages
+	h.setHandler(ctx, PROTOCOL_NAB, func (ctx context.Context, m Message) error {
+		return handleBroadcast(m, ctx, h, messageContainer, deliveredMessages)
 	})
 
-	// Set stream handler for Detector messages
-	h.SetStreamHandler(PROTOCOL_DET, func (s network.Stream)  {
-		err := handleDetector(s, ctx, h, topology, messageContainer)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
+	// Set handler for Detector messages
+	h.setHandler(ctx, PROTOCOL_DET, func (ctx context.Context, m Message) error {
+		return handleDetector(m, ctx, h, topology, messageContainer)
 	})
 
-	// Set stream handler for master-slave messages
-	h.SetStreamHandler(PROTOCOL_MST, func (s network.Stream)  {
-		err := handleMaster(s, ctx, h, messageContainer, deliveredMessages, topology, disjointPaths)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
+	// Set handler for master-slave messages
+	h.setHandler(ctx, PROTOCOL_MST, func (ctx context.Context, m Message) error {
+		return handleMaster(m, ctx, h, messageContainer, deliveredMessages, topology, disjointPaths)
 	})
 
-	// Set stream handler for combinedRC messages
-	h.SetStreamHandler(PROTOCOL_CRC, func (s network.Stream)  {
-		err := handleCombinedRC(s, ctx, h, topology, messageContainer, deliveredMessages, sentMessages, disjointPaths)
-		if err != nil {
-			s.Reset()
-		} else {
-			s.Close()
-		}
+	// Set handler for combinedRC messages
+	h.setHandler(ctx, PROTOCOL_CRC, func (ctx context.Context, m Message) error {
+		return handleCombinedRC(m, ctx, h, topology, messageContainer, deliveredMessages, sentMessages, disjointPaths)
 	})
 
-	// Load the neighbourhood in cTop from a file
-	topology_graph := LoadGraphFromCSV(topology_path)
-	topology.ctop.loadNeigh(topology_graph, getNodeAddress(h, ADDR_DEFAULT))
+	// Set handler for Bracha reliable broadcast messages
+	h.setHandler(ctx, PROTOCOL_BRB, func (ctx context.Context, m Message) error {
+		return handleBracha(m, ctx, h, deliveredMessages)
+	})
 
-	printStartMessage(h, mod_help_prot)
-	printNodeInfo(h)
+	// Set handler for Bracha-Dolev reliable broadcast messages
+	h.setHandler(ctx, PROTOCOL_BDOPT, func (ctx context.Context, m Message) error {
+		return handleBDopt(m, ctx, h, deliveredMessages)
+	})
+
+	// Set handler for the heartbeats of the failure detector
+	h.setHandler(ctx, PROTOCOL_HB, func (ctx context.Context, m Message) error {
+		return handleHeartbeat(m, h, topology)
+	})
 }
 
 // Connects two nodes
-func connectNodes(ctx context.Context, sourceNode host.Host, targetNode_address string, topology *Topology) {
+func connectNodes(ctx context.Context, sourceNode *Node, targetNode_address string, topology *Topology) {
 	
 	// Turn the destination into a multiaddr.
 	targetNode_maddr, err := multiaddr.NewMultiaddr(targetNode_address)
@@ -233,19 +167,19 @@ func connectNodes(ctx context.Context, sourceNode host.Host, targetNode_address
 	}
 
 	// Add the connection to the topology
-	if targetNode_address != master_address {
-		topology.ctop.AddNeighbour(getNodeAddress(sourceNode, ADDR_DEFAULT), targetNode_address)
+	if targetNode_address != sourceNode.master_address {
+		topology.ctop.AddNeighbour(sourceNode.address, targetNode_address)
 	}
 
 	// Print the mischief
-	printResult := fmt.Sprintf("Connection established between \n - Node %s \n - Node %s\n", getNodeAddress(sourceNode, ADDR_DEFAULT), targetNode_address)
+	printResult := fmt.Sprintf("Connection established between \n - Node %s \n - Node %s\n", sourceNode.address, targetNode_address)
 	fmt.Println(printResult)
 
 }
 
 
 // Disconnects two nodes
-func disconnectNodes(ctx context.Context, sourceNode host.Host, targetNode_address string) {
+func disconnectNodes(ctx context.Context, sourceNode *Node, targetNode_address string) {
 	// Turn the destination into a multiaddr.
 	targetNode_maddr, err := multiaddr.NewMultiaddr(targetNode_address)
 	if err != nil {
@@ -264,14 +198,63 @@ func disconnectNodes(ctx context.Context, sourceNode host.Host, targetNode_addre
 		printError(err)
 	}
 
-	printResult := fmt.Sprintf("Connection closed between \n - Node %s \n - Node %s\n", getNodeAddress(sourceNode, ADDR_DEFAULT), targetNode_address)
+	printResult := fmt.Sprintf("Connection closed between \n - Node %s \n - Node %s\n", sourceNode.address, targetNode_address)
 	fmt.Println(printResult)
 
 }
 
+// Leave the network: tell the peers that the node is leaving, save the state that was asked for,
+// then close all the connections and the host. Only the first call does something
+func (n *Node) shutdown(ctx context.Context) {
+	n.shutdown_once.Do(func() {
+		event := fmt.Sprintf("shutdown - Leaving the network, %d peers", len(n.peers()))
+		logEvent(n.ID().String(), PRINTOPTION, event)
+		n.stopFailureDetector()
+		n.stopDiscovery()
+
+		ctx, cancel := context.WithTimeout(ctx, SHUTDOWN_TIMEOUT)
+		defer cancel()
+		sendLeave(ctx, n)
+
+		for _, hook := range n.shutdown_hooks {
+			err := hook.save()
+			if err != nil {
+				printError(fmt.Errorf("failed to save %s: %w", hook.name, err))
+				continue
+			}
+			event := fmt.Sprintf("shutdown - Saved %s", hook.name)
+			logEvent(n.ID().String(), PRINTOPTION, event)
+		}
+
+		// Give the leave messages some time to cross the connections before closing them
+		clock.Sleep(ctx, SHUTDOWN_LINGER)
+		for _, p := range n.Network().Peers() {
+			err := n.Network().ClosePeer(p)
+			if err != nil {
+				printError(err)
+			}
+		}
+		event = "shutdown - Connections closed"
+		logEvent(n.ID().String(), PRINTOPTION, event)
+
+		// Statistics of the queues, to be read after a headless run
+		for _, p := range n.getPools() {
+			p.close()
+			event := fmt.Sprintf("queue - %s", p.toString())
+			logEvent(n.ID().String(), false, event)
+		}
+
+		err := n.Close()
+		if err != nil {
+			printError(err)
+		}
+		os.Stdout.Sync() // Log files are written at every event, only the console may be behind
+	})
+}
+
 // Connects this node with all the nodes in the topology
-func connectAllNodes(ctx context.Context, sourceNode host.Host, topology *Topology) {
-	for _, node := range topology.ctop.GetNeighbourhood(getNodeAddress(sourceNode, ADDR_DEFAULT)) {
+func connectAllNodes(ctx context.Context, sourceNode *Node, topology *Topology) {
+	for _, node := range topology.ctop.GetNeighbourhood(sourceNode.address) {
 		connectNodes(ctx, sourceNode, node, topology)
 	}
 }
@@ -279,26 +262,20 @@ func connectAllNodes(ctx context.Context, sourceNode host.Host, topology *Topolo
 
 // Counts the connections of a node
 //lint:ignore U1000 Unused function for future use
-func countNodePeers(sourceNode host.Host) int {
+func countNodePeers(sourceNode *Node) int {
 	return len(sourceNode.Network().Peers())
 }
 
 // Acquire the topology from the network and load it in the cTop
-func acquireTopology(h host.Host, topology *Topology) {
-	peers := h.Network().Peers()
+func acquireTopology(h *Node, topology *Topology) {
+	peers := h.peers()
     for _, peer := range peers {
-        // Obtain the ip4 tcp address from the peer
-        var peer_address string		
-        for _, addr := range h.Peerstore().Addrs(peer) {
-            if addr.Protocols()[0].Code == multiaddr.P_IP4 && addr.Protocols()[1].Code == multiaddr.P_TCP {
-                peer_address = fmt.Sprintf("%s/p2p/%s", addr, peer)
-                break
-            }
-        }
+        // Obtain the address of the peer, chosen as the address of this node
+        peer_address := h.peerAddress(peer)
 
         // Add the connection to the topology. Do not add the master address
-        if len(peer_address) > 0 && peer_address != master_address {
-            topology.ctop.AddNeighbour(getNodeAddress(h, ADDR_DEFAULT), peer_address)
+        if len(peer_address) > 0 && peer_address != h.master_address {
+            topology.ctop.AddNeighbour(h.address, peer_address)
         }
     }
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// Messages made at the same virtual time get different IDs, on the same node and on different nodes
+func TestNewMessageID(t *testing.T) {
+	old_clock := clock
+	clock = NewVirtualClock(clock_start)
+	defer func() { clock = old_clock }()
+
+	network := mocknet.New()
+	defer network.Close()
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		h, err := network.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := NewNode(h, getNodeAddress(h, ADDR_LOOPBACK))
+		for j := 0; j < 100; j++ {
+			id := n.newMessageID()
+			if ids[id] {
+				t.Fatalf("ID %s made twice", id)
+			}
+			ids[id] = true
+		}
+	}
+}
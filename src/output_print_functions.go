@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/libp2p/go-libp2p/core/host"
 )
 
 // Print shell newline
@@ -18,12 +17,12 @@ func printError(err error) {
 	header := fmt.Sprintf("\n%s!!!!----- ERROR -----!!!!%s\n", RED, RESET)	
 	fmt.Println(header)
 	event := fmt.Sprintf("ERROR \n\t %s", err)
-	logEvent(addressToPrint(thisnode_address, NODE_PRINTLAST), false, event)
+	logEvent(addressToPrint(console_address, NODE_PRINTLAST), false, event)
 	//panic(err)
 }
 
 // Message to print when starting a node
-func printStartMessage(h host.Host, help_mod string) {
+func printStartMessage(h *Node, help_mod string) {
 
 	if help_mod == mod_help_def {
 		header := fmt.Sprintf("\n%s------- HELP -------%s\n", color_info, RESET)
@@ -134,7 +133,7 @@ func printHelp_node() {
 }
 
 // Print protocols related information
-func printHelp_ProtocolInfo(h host.Host) {
+func printHelp_ProtocolInfo(h *Node) {
 
 	connect := fmt.Sprintf(
 		"%sCONNECT:%s \n" +
@@ -142,7 +141,7 @@ func printHelp_ProtocolInfo(h host.Host) {
 		"\t-connect %s \n\n" +
 		"\t%sConnect this node to its neighbours in the topology%s \n" +
 		"\t-connectall \n",
-		color_info, RESET, color_info, RESET, getNodeAddress(h, ADDR_DEFAULT), color_info, RESET,
+		color_info, RESET, color_info, RESET, h.address, color_info, RESET,
 	)
 
 	connect_desc := fmt.Sprintf(
@@ -154,14 +153,16 @@ func printHelp_ProtocolInfo(h host.Host) {
 		"%sSEND:%s	\n" + 
 		"\t%sSend a message MESSAGE from another node to this node%s \n" +
 		"\t-send %s -msg \"MESSAGE\" \n",
-		color_info, RESET, color_info, RESET, getNodeAddress(h, ADDR_DEFAULT),
+		color_info, RESET, color_info, RESET, h.address,
 	)
 
 	bcast := fmt.Sprintf(
 		"%sBROADCAST:%s \n" +
 		"\t%sSend a broadcast with message MESSAGE from any node to this node%s \n" +
-		"\t-broadcast %s -msg \"MESSAGE\"\n",
-		color_info, RESET, color_info, RESET, getNodeAddress(h, ADDR_DEFAULT),
+		"\t-broadcast %s -msg \"MESSAGE\"\n" +
+		"\t%sLog the messages sent by this node for each broadcast%s \n" +
+		"\t-broadcast %s \n",
+		color_info, RESET, color_info, RESET, h.address, color_info, RESET, mod_broadcast_stats,
 	)
 
 	detector := fmt.Sprintf(
@@ -200,7 +201,7 @@ func printHelp_ProtocolInfo(h host.Host) {
 		"\t-crc %s %s\n" +
 		"\t%sSend CombinedRC message%s \n" +
 		"\t-crc %s -msg %s \"MESSAGE\" \n",
-		color_info, RESET, color_info, RESET, mod_crc_exp, color_info, RESET, mod_crc_rou, getNodeAddress(h, ADDR_DEFAULT), color_info, RESET, mod_crc_cnt, getNodeAddress(h, ADDR_DEFAULT),
+		color_info, RESET, color_info, RESET, mod_crc_exp, color_info, RESET, mod_crc_rou, h.address, color_info, RESET, mod_crc_cnt, h.address,
 	)
 
 	fmt.Printf("%s", connect)
@@ -211,7 +212,31 @@ func printHelp_ProtocolInfo(h host.Host) {
 	//fmt.Printf("%s", explorer)
 	//fmt.Printf("%s", explorer_desc)
 	//fmt.Printf("%s", explorer2)
+	bracha := fmt.Sprintf(
+		"%sBRACHA:%s \n" +
+		"\t%sBroadcast MESSAGE to every node with Bracha reliable broadcast%s \n" +
+		"\t-brb -msg \"MESSAGE\" \n",
+		color_info, RESET, color_info, RESET,
+	)
+
+	bracha_desc := fmt.Sprintf(
+		"\t%sThe network must be fully connected, with more than 3 times the admissible byzantines%s \n",
+		color_desc, RESET,
+	)
+
+	bdopt := fmt.Sprintf(
+		"%sBRACHA-DOLEV:%s \n" +
+		"\t%sBroadcast MESSAGE to every node with Bracha over Dolev, with the optimisations of BDopt%s \n" +
+		"\t-bdopt -msg \"MESSAGE\" \n" +
+		"\t%sLog the messages sent by this node for each broadcast%s \n" +
+		"\t-bdopt %s \n",
+		color_info, RESET, color_info, RESET, color_info, RESET, mod_bdopt_stats,
+	)
+
 	fmt.Printf("%s", combinedRC)
+	fmt.Printf("%s", bracha)
+	fmt.Printf("%s", bracha_desc)
+	fmt.Printf("%s", bdopt)
 }
 
 // Print messages related information
@@ -227,7 +252,7 @@ func printHelp_MessagesInfo() {
 	)
 
 	deliver_desc := fmt.Sprintf(
-		"\n\t%sThese delivery modes are performed using disjoint paths and \n\tmay conflict with the correctness of Explorer2 protocol%s \n",
+		"\n\t%sThese delivery modes are performed using disjoint paths and \n\tmay conflict with the correctness of Explorer2 protocol. \n\tBroadcast messages are delivered as soon as they can be, with no need of -deliver%s \n",
 		color_desc, RESET,
 	)
 
@@ -349,6 +374,30 @@ func printHelp_MasterInfo() {
 		color_info, RESET, mst_reset,
 	)
 
+	seed := fmt.Sprintf(
+		"\t%sGive a new random seed to the nodes, or the given one%s \n" +
+		"\t-master %s [SEED]\n",
+		color_info, RESET, mst_seed,
+	)
+
+	psk := fmt.Sprintf(
+		"\t%sGive a fresh private network key to the nodes, used from their next start%s \n" +
+		"\t-master %s\n",
+		color_info, RESET, mst_psk,
+	)
+
+	link := fmt.Sprintf(
+		"\t%sCut, restore, add or remove the link between two nodes, given by label. TRUTH changes the topology of the file too%s \n" +
+		"\t-master %s %s|%s|%s|%s A B [%s]\n",
+		color_info, RESET, mst_link, mst_link_cut, mst_link_restore, mst_link_add, mst_link_remove, mst_link_truth,
+	)
+
+	scenario := fmt.Sprintf(
+		"\t%sRun the steps of a scenario file%s \n" +
+		"\t%s FILE\n",
+		color_info, RESET, cmd_scenario,
+	)
+
 	sendtop := fmt.Sprintf(
 		"\t%sGiven on a node's shell, sends its topology file to Master%s \n" +
 		"\t%s[NODE SHELL]>%s-master %s\n",
@@ -371,6 +420,10 @@ func printHelp_MasterInfo() {
 	fmt.Println(djp)
 	fmt.Println(prots)
 	fmt.Println(reset)
+	fmt.Println(seed)
+	fmt.Println(psk)
+	fmt.Println(link)
+	fmt.Println(scenario)
 	fmt.Println(sendtop)
 	fmt.Println(logs)
 
@@ -378,22 +431,55 @@ func printHelp_MasterInfo() {
 
 
 // Print node information
-func printNodeInfo(h host.Host) {
+func printNodeInfo(h *Node) {
 	fmt.Printf("\n%s##### NODE INFORMATION #####%s\n", CYAN, RESET)
-	fmt.Println("Node address:", getNodeAddress(h, ADDR_DEFAULT))//h.Addrs()[0])
+	fmt.Println("Node address:", h.address)//h.Addrs()[0])
     fmt.Println("host.ID:", h.ID())
 	fmt.Println("Peers: ", h.Network().Peers())
 
+	fmt.Printf("\n%sProtocols of this node:%s\n", CYAN, RESET)
+	for _, p := range argoProtocols(h.Mux().Protocols()) {
+		fmt.Printf("	%s\n", p)
+	}
+
+	fmt.Printf("\n%sProtocol queues:%s\n", CYAN, RESET)
+	for _, p := range h.getPools() {
+		fmt.Printf("	%s\n", p.toString())
+	}
+
+	fmt.Printf("\n%sRate limits:%s\n", CYAN, RESET)
+	printRateLimits(h)
+
+	fmt.Printf("\n%sPrivate network:%s\n", CYAN, RESET)
+	printPSK(h)
+
+	fmt.Printf("\n%sLink emulation:%s\n", CYAN, RESET)
+	printLinks(h)
+
+	fmt.Printf("\n%sTopology gate:%s\n", CYAN, RESET)
+	printGate(h)
+
+	fmt.Printf("\n%sDolevU optimisations:%s\n", CYAN, RESET)
+	printOptimisations(h.dolevu.enabled, NAB_OPTIMISATIONS)
+
+	fmt.Printf("\n%sBDopt optimisations:%s\n", CYAN, RESET)
+	printOptimisations(h.bdopt.enabled, BDOPT_OPTIMISATIONS)
+
+	fmt.Printf("\n%sAddress book:%s\n", CYAN, RESET)
+	printAddressBook(h)
+
+	fmt.Printf("\n%sSuspected neighbours:%s\n", CYAN, RESET)
+	printSuspects(h)
+
 	fmt.Printf("\n%sThis node's multiaddresses:%s\n", CYAN, RESET)
-	fmt.Printf("	Loopback Address: %s\n", h.Addrs()[ADDR_LB_POS])
-	fmt.Printf("	LAN Address: %s\n", h.Addrs()[ADDR_LAN_POS])
-	
-	/*
-	// Print all multiaddresses
+	// The one chosen as the address of the node is highlighted
 	for i, la := range h.Addrs() {
-		fmt.Printf("	%d. %v\n",i, la)
+		if h.address == fmt.Sprintf("%s/p2p/%s", la, h.ID()) {
+			fmt.Printf("	%d. %s%v%s\n", i, color_info, la, RESET)
+		} else {
+			fmt.Printf("	%d. %v\n", i, la)
+		}
 	}
-		*/
 
 	fmt.Printf("%s############################%s\n", CYAN, RESET)
 	fmt.Println()
@@ -438,7 +524,7 @@ func printMessage(message string) {
 
 
 // Print all the opened streams of an host
-func printOpenedStream(h host.Host) {
+func printOpenedStream(h *Node) {
 	header := fmt.Sprintf("\n%s####### NETWORK INFO #######%s\n", CYAN, RESET)
 	footer := fmt.Sprintf("\n%s############################%s\n", CYAN, RESET)
 	fmt.Print(header)
@@ -457,7 +543,7 @@ func printOpenedStream(h host.Host) {
 
 // Returns a list of all messages
 // !! CAREFUL !! : the messages here are NOT IN CHRONOLOGICAL ORDER, because MessageContainer is a dictionnary, not a list!
-func allMessages(messageContainer MessageContainer, mod string) string {
+func allMessages(messageContainer *MessageContainer, mod string) string {
 	var mod_string string = ""
 	var color = ""
 	var color_msg_top = ""
@@ -2,25 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
-	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
 
 // Function to manage a CNT message
-func receive_CNT(ctx context.Context, thisNode host.Host, m *Message, top *Topology, messageContainer *MessageContainer, disjointPaths *DisjointPaths) error {
+func receive_CNT(ctx context.Context, thisNode *Node, m *Message, top *Topology, messageContainer *MessageContainer, disjointPaths *DisjointPaths) error {
 	messageContainer.Add(*m)
 	
-	if m.Target == getNodeAddress(thisNode, ADDR_DEFAULT) {
+	if m.Target == thisNode.address {
 		event := fmt.Sprintf("receive_CNT %s - Content from %s received from %s!", m.ID[len(m.ID)-5:], addressToPrint(m.Source, NODE_PRINTLAST), addressToPrint(m.Sender, NODE_PRINTLAST))
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
 		fmt.Print(msgToString(*m))
 	} else {
 		// Forward this message to the next node in the path
-		thisPeer, idx := findElement(m.Path, getNodeAddress(thisNode, ADDR_DEFAULT))
+		thisPeer, idx := findElement(m.Path, thisNode.address)
 		old_sender := m.Sender
 		m.Sender = thisPeer
 		
@@ -43,26 +41,7 @@ func receive_CNT(ctx context.Context, thisNode host.Host, m *Message, top *Topol
 			return err
 		}
 
-		stream, err := openStream(ctx, thisNode, peer_info.ID, PROTOCOL_CRC)
-		if err != nil {
-			printError(err)
-			return err
-		}
-
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-			return err
-		}
-		msg := string(dataBytes)
-		msg += "\n" 
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(msg))
-		if err != nil {
-			printError(err)
-			return err
-		}
+		send(ctx, thisNode, peer_info.ID, *m, PROTOCOL_CRC)
 
 		event := fmt.Sprintf("receive_CNT %s - Content from %s forwarded to %s",m.ID[len(m.ID)-5:], addressToPrint(old_sender, NODE_PRINTLAST), addressToPrint(m.Path[idx+1], NODE_PRINTLAST))
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
@@ -73,10 +52,10 @@ func receive_CNT(ctx context.Context, thisNode host.Host, m *Message, top *Topol
 }
 
 // Send function for CombinedRC CNT messages
-func send_CRC_CNT(ctx context.Context, thisNode host.Host, m Message, top *Topology, disjointPaths *DisjointPaths) {
+func send_CRC_CNT(ctx context.Context, thisNode *Node, m Message, top *Topology, disjointPaths *DisjointPaths) {
 
 	// Add the sender
-	m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
+	m.Sender = thisNode.address
 	m.Neighbourhood = []string{}
 
 	// Send routed messages to target node
@@ -103,24 +82,7 @@ func send_CRC_CNT(ctx context.Context, thisNode host.Host, m Message, top *Topol
 			continue
 		}
 
-		stream, err := openStream(ctx, thisNode, peer_info.ID, PROTOCOL_CRC)
-		if err != nil {
-			printError(err)
-			continue
-		}
-
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-		}
-		msg := string(dataBytes) 
-		msg += "\n"
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(msg))
-		if err != nil {
-			printError(err)
-		}
+		send(ctx, thisNode, peer_info.ID, m, PROTOCOL_CRC)
 
 		event := fmt.Sprintf("send_CNT %s - Content sent to %s for %s",m.ID[len(m.ID)-5:], addressToPrint(path[1], NODE_PRINTLAST), addressToPrint(m.Target, NODE_PRINTLAST))
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
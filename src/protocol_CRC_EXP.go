@@ -4,16 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
-
-	"github.com/libp2p/go-libp2p/core/host"
 )
 
 // function to manage an EXP2 message
-func receive_EXP2(ctx context.Context, thisNode host.Host, m *Message, top *Topology,
+func receive_EXP2(ctx context.Context, thisNode *Node, m *Message, top *Topology,
 		messageContainer *MessageContainer, deliveredMessages *MessageContainer) error {
 	
-	m.Content = time.Now().Format("05.00000")
+	m.Content = clock.Now().Format("05.00000")
 
 	inst := addressToPrint(m.Sender, NODE_PRINTLAST)
 	m.InstanceID += "_"+inst
@@ -39,33 +36,33 @@ func receive_EXP2(ctx context.Context, thisNode host.Host, m *Message, top *Topo
 	defer explorer2Mutex.Unlock()
 
 	// Start counting BFT Logics
-	timestamp_start := time.Now()
+	timestamp_start := clock.Now()
 
 	// Modification 4: check whether m is in deliveredMessages
 	if len(deliveredMessages.Get(m.ID)) == 0 {
-		m.Target = getNodeAddress(thisNode, ADDR_DEFAULT)
+		m.Target = thisNode.address
 		messageContainer.Add(*m)
 
 		// Modification 1: check whether source is equal to sender
 		if m.Source == m.Sender && len(m.Path) == 1 && m.Path[0] == m.Source {
-			BFT_deliver_and_relay(ctx, thisNode, *messageContainer, *deliveredMessages, *m, top)
-		} else if len(messageContainer.GetDisjointPathsBrute(m.ID)) > MAX_BYZANTINES  {
-			BFT_deliver_and_relay(ctx, thisNode, *messageContainer, *deliveredMessages, *m, top)
+			BFT_deliver_and_relay(ctx, thisNode, messageContainer, deliveredMessages, *m, top)
+		} else if len(messageContainer.GetDisjointPathsBrute(m.ID, thisNode.address)) > thisNode.max_byzantines  {
+			BFT_deliver_and_relay(ctx, thisNode, messageContainer, deliveredMessages, *m, top)
 		} else {
 			// Send the message to all the nodes who never ever received the message
-			for _, p := range thisNode.Network().Peers() {
-				if p.String() == extractPeerIDFromMultiaddr(master_address) {continue}
+			for _, p := range thisNode.peers() {
+				if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {continue}
 
 				// Only forward the message if p is not in m.path or if it doesen't exist in any of the paths of the instances of m.ID that are present in messageContainer
 				if !messageContainer.lookInPaths(m.ID, p.String()) && !contains(m.Path, p.String()) {
-					m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
+					m.Sender = thisNode.address
 					send(ctx, thisNode, p, *m, PROTOCOL_CRC)					
 				} 
 			}
 		}
 	} else {
 		// Enters this if the message has already been delivered by the node
-		del := BFT_deliver(*messageContainer, *deliveredMessages, *m, top)
+		del := BFT_deliver(messageContainer, deliveredMessages, *m, top)
 		if  del {
 			deliveredMessages.Add(*m)
 			messageContainer.RemoveMessage(*m)
@@ -78,26 +75,21 @@ func receive_EXP2(ctx context.Context, thisNode host.Host, m *Message, top *Topo
 		*/
 	}
 
-	timestamp_end := time.Now()
+	timestamp_end := clock.Now()
 	event = fmt.Sprintf("BFT_execution %s - performed in time %f seconds", m.ID[len(m.ID)-5:], timestamp_end.Sub(timestamp_start).Seconds())
 	logEvent(thisNode.ID().String(), false, event)
 	return nil
 }
 
-func sendEXP2(ctx context.Context, thisNode host.Host, exp_msg Message) {
+func sendEXP2(ctx context.Context, thisNode *Node, exp_msg Message) {
 	
 	// Add the sender
-	exp_msg.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
-	dataBytes, err := json.Marshal(exp_msg)
-	if err != nil {
-		printError(err)
-	}
-	msg := string(dataBytes)
+	exp_msg.Sender = thisNode.address
 
 	// Cycle through the peers connected to the current node
-	for _, p := range thisNode.Network().Peers() {
+	for _, p := range thisNode.peers() {
 
-		if p.String() == extractPeerIDFromMultiaddr(master_address) {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
 			continue // Do not send the message to the master node
 		}
 
@@ -106,19 +98,7 @@ func sendEXP2(ctx context.Context, thisNode host.Host, exp_msg Message) {
 		if (contains(exp_msg.Path, p.String())) {
 			printShell()
 		} else {
-			stream, err := openStream(ctx, thisNode, p, PROTOCOL_CRC)
-			if err != nil {
-				printError(err)
-			}
-
-			message := fmt.Sprintf("%s\n", msg)
-
-			// Write the message on the stream
-			_, err = stream.Write([]byte(message))
-			if err != nil {
-				printError(err)
-			}
-			stream.Close() // <-- chiudi sempre lo stream dopo la scrittura
+			send(ctx, thisNode, p, exp_msg, PROTOCOL_CRC)
 
 			event := fmt.Sprintf("send_EXP2 %s - Forwarded message from %s to node %s", exp_msg.ID[len(exp_msg.ID)-5:], addressToPrint(exp_msg.Sender, NODE_PRINTLAST), addressToPrint(p.String(), NODE_PRINTLAST))
 			logEvent(thisNode.ID().String(), PRINTOPTION, event)
@@ -127,7 +107,7 @@ func sendEXP2(ctx context.Context, thisNode host.Host, exp_msg Message) {
 }
 
 // Helper function to handle common delivery logic
-func manageDelivery(messageContainer MessageContainer, deliveredMessages MessageContainer, m Message, top *Topology) bool {
+func manageDelivery(messageContainer *MessageContainer, deliveredMessages *MessageContainer, m Message, top *Topology) bool {
     // Add the message to the delivered messages
     messages := messageContainer.Get(m.ID)
 
@@ -165,14 +145,14 @@ func manageDelivery(messageContainer MessageContainer, deliveredMessages Message
 }
 
 // Delivery function for BFT
-func BFT_deliver(messageContainer MessageContainer, deliveredMessages MessageContainer, m Message, top *Topology) bool {
+func BFT_deliver(messageContainer *MessageContainer, deliveredMessages *MessageContainer, m Message, top *Topology) bool {
     // Handle the common delivery logic
     return manageDelivery(messageContainer, deliveredMessages, m, top)
 }
 
 // Delivery and relay function for BFT
-func BFT_deliver_and_relay(ctx context.Context, thisNode host.Host,
-    messageContainer MessageContainer, deliveredMessages MessageContainer,
+func BFT_deliver_and_relay(ctx context.Context, thisNode *Node,
+    messageContainer *MessageContainer, deliveredMessages *MessageContainer,
     m Message, top *Topology) {
 
     // Deliver the message
@@ -187,35 +167,17 @@ func BFT_deliver_and_relay(ctx context.Context, thisNode host.Host,
     // Prepare the message for relaying
     m.Path = []string{} // Clear the path
     old_sender := m.Sender
-    m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
-
-    dataBytes, err := json.Marshal(m)
-    if err != nil {
-        printError(err)
-        return
-    }
-    msg := string(dataBytes)
+    m.Sender = thisNode.address
 
     // Modification 3: relay the message to peers not in any path of the delivered messages
-    for _, p := range thisNode.Network().Peers() {
+    for _, p := range thisNode.peers() {
 
-		if p.String() == extractPeerIDFromMultiaddr(master_address) {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
 			continue // Do not send the message to the master node
 		}
 
         if !deliveredMessages.lookInPaths(m.ID, p.String()) {
-            stream, err := openStream(ctx, thisNode, p, PROTOCOL_CRC)
-            if err != nil {
-                printError(err)
-                continue
-            }
-
-            message := fmt.Sprintf("%s\n", msg)
-            _, err = stream.Write([]byte(message))
-            if err != nil {
-                printError(err)
-            }
-            stream.Close()
+            send(ctx, thisNode, p, m, PROTOCOL_CRC)
 
             event := fmt.Sprintf("delandrelay_EXP2 %s - Forward message from %s on node %s", m.ID[len(m.ID)-5:], addressToPrint(old_sender, NODE_PRINTLAST), addressToPrint(p.String(), NODE_PRINTLAST))
             logEvent(thisNode.ID().String(), PRINTOPTION, event)
@@ -2,19 +2,17 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
-	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
 
 // Function to manage a ROU message
-func receive_ROU(ctx context.Context, thisNode host.Host, m *Message, top *Topology, messageContainer *MessageContainer, disjointPaths *DisjointPaths) error {
+func receive_ROU(ctx context.Context, thisNode *Node, m *Message, top *Topology, messageContainer *MessageContainer, disjointPaths *DisjointPaths) error {
 	messageContainer.Add(*m)
 
-	if m.Target == getNodeAddress(thisNode, ADDR_DEFAULT) {
+	if m.Target == thisNode.address {
 		// reverse the path and add it into DisjointPaths
 		for i, j := 0, len(m.Path)-1; i < j; i, j = i+1, j-1 {
             m.Path[i], m.Path[j] = m.Path[j], m.Path[i]
@@ -24,7 +22,7 @@ func receive_ROU(ctx context.Context, thisNode host.Host, m *Message, top *Topol
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
 	} else {
 		// Forward this message to the next node in the path
-		thisPeer, idx := findElement(m.Path, getNodeAddress(thisNode, ADDR_DEFAULT))
+		thisPeer, idx := findElement(m.Path, thisNode.address)
 		old_sender := m.Sender
 		m.Sender = thisPeer
 
@@ -48,26 +46,7 @@ func receive_ROU(ctx context.Context, thisNode host.Host, m *Message, top *Topol
 			return err
 		}
 
-		stream, err := openStream(ctx, thisNode, peer_info.ID, PROTOCOL_CRC)
-		if err != nil {
-			printError(err)
-			return err
-		}
-
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-			return err
-		}
-		msg := string(dataBytes)
-		msg += "\n" 
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(msg))
-		if err != nil {
-			printError(err)
-			return err
-		}
+		send(ctx, thisNode, peer_info.ID, *m, PROTOCOL_CRC)
 
 		event := fmt.Sprintf("receive_ROU %s - Route from %s forwarded to %s", m.ID[len(m.ID)-5:], addressToPrint(old_sender, NODE_PRINTLAST), addressToPrint(m.Path[idx+1], NODE_PRINTLAST))
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
@@ -78,14 +57,14 @@ func receive_ROU(ctx context.Context, thisNode host.Host, m *Message, top *Topol
 }
 
 // Send function for CombinedRC ROU messages
-func send_CRC_ROU(ctx context.Context, thisNode host.Host, m Message, top *Topology, disjointPaths *DisjointPaths) {
+func send_CRC_ROU(ctx context.Context, thisNode *Node, m Message, top *Topology, disjointPaths *DisjointPaths) {
 
 	// Add the sender
-	m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
+	m.Sender = thisNode.address
 	m.Neighbourhood = []string{}
 
 	// Create a graph
-	g := generateGraph(top, mod_graph_byz)
+	g := generateGraph(top, mod_graph_byz, thisNode.max_byzantines)
 	//g.PrintGraph()
 
 	// Find Disjoint Paths
@@ -116,24 +95,7 @@ func send_CRC_ROU(ctx context.Context, thisNode host.Host, m Message, top *Topol
 			continue
 		}
 
-		stream, err := openStream(ctx, thisNode, peer_info.ID, PROTOCOL_CRC)
-		if err != nil {
-			printError(err)
-			continue
-		}
-
-		dataBytes, err := json.Marshal(m)
-		if err != nil {
-			printError(err)
-		}
-		msg := string(dataBytes) 
-		msg += "\n"
-
-		// Write the message on the stream
-		_, err = stream.Write([]byte(msg))
-		if err != nil {
-			printError(err)
-		}
+		send(ctx, thisNode, peer_info.ID, m, PROTOCOL_CRC)
 
 		event := fmt.Sprintf("send_ROU %s - Route sent to %s for %s", m.ID[len(m.ID)-5:], addressToPrint(path[1], NODE_PRINTLAST), addressToPrint(m.Target, NODE_PRINTLAST))
 		logEvent(thisNode.ID().String(), PRINTOPTION, event)
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+/*
+	BRACHA-DOLEV RELIABLE BROADCAST (BDopt)
+	Byzantine reliable broadcast for partially connected networks: the SEND, ECHO and READY of Bracha
+	(see protocol_bracha.go) are not sent to every node but broadcast with Dolev, along paths.
+	See @ Practical Byzantine Reliable Broadcast on Partially Connected Networks - 2021 - Bonomi, Decouchant, Farina, Rahli, Tixeuil.
+	Every SEND, ECHO and READY is a Dolev broadcast of its own, made by its origin (m.InstanceID):
+		- the origin sends the message to its neighbours with an empty path;
+		- a node adds the sender to the path and relays the message to its neighbours that are not in the path.
+		  The path starts with the origin, or with a node that delivered the message (see empty);
+		- a node delivers the message when it has f+1 node-disjoint paths from the origin (see MessageContainer.hasDisjointPaths),
+		  and gives it to Bracha as the vote of the origin.
+	The network must be 2f+1 connected, with more than 3f nodes. n is the number of nodes of the topology file,
+	counted when the node loads its neighbourhood (see Node.loadNeighbourhood).
+	Each optimisation can be switched on and off (-bdopt flag, BDOPT_* in constants.go):
+		direct		a message received from its origin is delivered at once
+		empty		once delivered, a message is relayed once with an empty path, and its paths are no more relayed.
+					A message with an empty path from a neighbour that is not its origin counts as a path through that neighbour
+		skip		messages are not sent to the neighbours that relayed them with an empty path
+		ignore		paths through a neighbour that relayed the message with an empty path are ignored
+		implicit	the SEND of the source counts as its ECHO, and the source sends no ECHO
+		noecho		a node that sent READY does not send ECHO
+	skip and ignore only work with empty. For each broadcast the node counts the messages it sent, by type,
+	and how many times each optimisation applied: messages not sent for empty, skip, implicit and noecho,
+	paths for direct and ignore. They are logged with the "stats_BDOPT" event at delivery and by -bdopt STATS.
+*/
+type BDopt struct {
+	mu			sync.Mutex
+	enabled		map[string]bool						// Optimisations switched on, set before the node starts
+	nodes		int									// Number of nodes of the topology file, 0 if the file has none
+	bracha		*Bracha								// Votes of Bracha, by origin
+	paths		*MessageContainer					// Paths received for each Dolev broadcast not delivered yet, without the endpoints
+	instances	map[string]*dolevInstance			// Dolev broadcasts, see dolevKey
+	broadcasts	map[brachaKey]*bdoptBroadcast		// Bracha broadcasts
+}
+
+// Optimisations of BDopt, in the order they are printed
+var BDOPT_OPTIMISATIONS = []string{BDOPT_DIRECT, BDOPT_EMPTY, BDOPT_SKIP, BDOPT_IGNORE, BDOPT_IMPLICIT, BDOPT_NOECHO}
+
+// State of the Dolev broadcast of a SEND, ECHO or READY at this node
+type dolevInstance struct {
+	delivered	bool
+	done		map[string]bool		// Peer IDs of the neighbours that relayed the message with an empty path
+}
+
+// Size of the network and counters of a Bracha broadcast at this node
+type bdoptBroadcast struct {
+	n			int
+	sent		map[string]int		// Messages sent, by type
+	optimised	map[string]int		// Times each optimisation applied
+}
+
+// Return a new BDopt with every optimisation switched off, as the modifications of DolevU
+func NewBDopt() *BDopt {
+	return &BDopt{
+		enabled:	make(map[string]bool),
+		bracha:		NewBracha(),
+		paths:		NewMessageContainer(),
+		instances:	make(map[string]*dolevInstance),
+		broadcasts:	make(map[brachaKey]*bdoptBroadcast),
+	}
+}
+
+// Switch on the given optimisations, and off the others
+func (bd *BDopt) setOptimisations(enabled map[string]bool) {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bd.enabled = enabled
+}
+
+// Check whether an optimisation is switched on
+func (bd *BDopt) on(opt string) bool {
+	return bd.enabled[opt]
+}
+
+// Set the number of nodes of the topology file
+func (bd *BDopt) setNetworkSize(n int) {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bd.nodes = n
+}
+
+// Forget every broadcast, keeping the optimisations and the size of the network
+func (bd *BDopt) Reset() {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bd.bracha.Reset()
+	bd.paths.Reset()
+	bd.instances = make(map[string]*dolevInstance)
+	bd.broadcasts = make(map[brachaKey]*bdoptBroadcast)
+}
+
+// A Dolev broadcast is identified by the Bracha broadcast, the type, the origin and the content of its message
+func dolevKey(m Message) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s", m.ID, m.Source, m.Type, m.InstanceID, m.Content)
+}
+
+// State of the Dolev broadcast with the given key. Must be called with bd.mu locked
+func (bd *BDopt) instance(key string) *dolevInstance {
+	inst, ok := bd.instances[key]
+	if !ok {
+		inst = &dolevInstance{done: make(map[string]bool)}
+		bd.instances[key] = inst
+	}
+	return inst
+}
+
+// State of the Bracha broadcast of m. Must be called with bd.mu locked
+func (bd *BDopt) broadcast(thisNode *Node, m Message) *bdoptBroadcast {
+	key := brachaKey{id: m.ID, source: m.Source}
+	bc, ok := bd.broadcasts[key]
+	if !ok {
+		bc = &bdoptBroadcast{
+			n:			bd.networkSize(thisNode),
+			sent:		make(map[string]int),
+			optimised:	make(map[string]int),
+		}
+		bd.broadcasts[key] = bc
+	}
+	return bc
+}
+
+// Number of nodes of the topology file, or of the nodes connected to this node if the file has none.
+// Must be called with bd.mu locked
+func (bd *BDopt) networkSize(thisNode *Node) int {
+	if bd.nodes == 0 {
+		return brachaNodes(thisNode)
+	}
+	return bd.nodes
+}
+
+// Neighbours to relay a message to: the ones not in the path, but the origin and the master.
+// With skip, the neighbours that relayed the message with an empty path are skipped too,
+// and their number is returned. Nothing is counted here. Must be called with bd.mu locked
+func (bd *BDopt) targets(thisNode *Node, path []string, origin string, inst *dolevInstance) (targets []peer.ID, skipped int) {
+	for _, p := range thisNode.peers() {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
+			continue // Do not send the message to the master node
+		}
+		if contains(path, p.String()) || p.String() == extractPeerIDFromMultiaddr(origin) {
+			continue
+		}
+		if bd.on(BDOPT_SKIP) && inst.done[p.String()] {
+			skipped++
+			continue
+		}
+		targets = append(targets, p)
+	}
+	return targets, skipped
+}
+
+// Neighbours to relay a message of type msg_type to, counting the messages sent and the neighbours skipped.
+// Must be called with bd.mu locked
+func (bd *BDopt) relayTargets(thisNode *Node, path []string, origin string, inst *dolevInstance, bc *bdoptBroadcast, msg_type string) []peer.ID {
+	targets, skipped := bd.targets(thisNode, path, origin, inst)
+	bc.sent[msg_type] += len(targets)
+	if skipped > 0 {
+		bc.optimised[BDOPT_SKIP] += skipped
+	}
+	return targets
+}
+
+// Handle a stream of the Bracha-Dolev reliable broadcast
+func handleBDopt(m Message, ctx context.Context, thisNode *Node, deliveredMessages *MessageContainer) error {
+	// Apply byzantine modifications
+	// returns true if byzantine is type 2 [drop messages], so this function must be stopped
+	if applyByzantine(ctx, thisNode, &m) {return nil}
+
+	receive_BDOPT(ctx, thisNode, m, deliveredMessages)
+	return nil
+}
+
+// Function to manage a SEND, ECHO or READY relayed along a path
+func receive_BDOPT(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	origin := m.InstanceID
+	// Nodes the message went through, from its origin or from a node that delivered it
+	path := append(append([]string{}, m.Path...), m.Sender)
+	// Nodes between the origin and this node
+	between := path
+	if between[0] == origin {
+		between = between[1:]
+	}
+	if contains(between, extractPeerIDFromMultiaddr(origin)) || contains(path, thisNode.ID().String()) {
+		event := fmt.Sprintf("receive_BDOPT %s - %s from %s refused: invalid path", m.ID[len(m.ID)-5:], m.Type, addressToPrint(m.Sender, NODE_PRINTLAST))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		return
+	}
+	empty := len(m.Path) == 0 && m.Sender != origin
+
+	bd := thisNode.bdopt
+	key := dolevKey(m)
+	bd.mu.Lock()
+	bc := bd.broadcast(thisNode, m)
+	inst := bd.instance(key)
+	if empty {
+		inst.done[extractPeerIDFromMultiaddr(m.Sender)] = true
+	} else if bd.on(BDOPT_IGNORE) {
+		for _, node := range between {
+			if inst.done[extractPeerIDFromMultiaddr(node)] {
+				bc.optimised[BDOPT_IGNORE]++
+				bd.mu.Unlock()
+				return
+			}
+		}
+	}
+
+	delivered := false
+	if inst.delivered {
+		if bd.on(BDOPT_EMPTY) {
+			// The message has already been relayed with an empty path
+			targets, _ := bd.targets(thisNode, path, origin, inst)
+			bc.optimised[BDOPT_EMPTY] += len(targets)
+			bd.mu.Unlock()
+			return
+		}
+	} else {
+		if !bd.paths.hasPath(key, between) {
+			bd.paths.Add(Message{ID: key, Path: between})
+		}
+		if bd.on(BDOPT_DIRECT) && len(between) == 0 {
+			bc.optimised[BDOPT_DIRECT]++
+			delivered = true
+		} else {
+			delivered = bd.paths.hasDisjointPaths(key, thisNode.max_byzantines+1)
+		}
+		inst.delivered = delivered
+	}
+
+	// Relay the path, or an empty path once the message is delivered
+	relay := m
+	relay.Sender = thisNode.address
+	relay.Path = path
+	if delivered && bd.on(BDOPT_EMPTY) {
+		relay.Path = []string{}
+		bd.paths.deleteElement(key)
+	}
+	targets := bd.relayTargets(thisNode, path, origin, inst, bc, m.Type)
+	n := bc.n
+	bd.mu.Unlock()
+
+	for _, p := range targets {
+		send(ctx, thisNode, p, relay, PROTOCOL_BDOPT)
+	}
+
+	if delivered {
+		event := fmt.Sprintf("dolev_BDOPT %s - %s of %s delivered, through %d nodes", m.ID[len(m.ID)-5:], m.Type, addressToPrint(origin, NODE_PRINTLAST), len(between))
+		logEvent(thisNode.ID().String(), false, event)
+		bracha_BDOPT(ctx, thisNode, m, origin, n, deliveredMessages)
+	}
+}
+
+// Give Bracha the SEND, ECHO or READY delivered by Dolev, as the vote of its origin
+func bracha_BDOPT(ctx context.Context, thisNode *Node, m Message, origin string, n int, deliveredMessages *MessageContainer) {
+	bd := thisNode.bdopt
+	f := thisNode.max_byzantines
+	step := bd.bracha.receive(m, origin, n, f)
+	if step.refused {
+		event := fmt.Sprintf("receive_BDOPT %s - SEND from %s refused: it is not the source %s", m.ID[len(m.ID)-5:], addressToPrint(origin, NODE_PRINTLAST), addressToPrint(m.Source, NODE_PRINTLAST))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		return
+	}
+	if m.Type == TYPE_BRB_SEND && bd.on(BDOPT_IMPLICIT) {
+		echo := m
+		echo.Type = TYPE_BRB_ECHO
+		implicit := bd.bracha.receive(echo, m.Source, n, f)
+		step.ready = step.ready || implicit.ready
+	}
+
+	if step.deliver {
+		deliveredMessages.Add(m)
+		event := fmt.Sprintf("deliver_BDOPT %s - Message from %s delivered after %f seconds, with n=%d and f=%d: %s", m.ID[len(m.ID)-5:], addressToPrint(m.Source, NODE_PRINTLAST), clock.Now().Sub(step.start).Seconds(), n, f, m.Content)
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		logEvent(thisNode.ID().String(), PRINTOPTION, bd.statsEvent(brachaKey{id: m.ID, source: m.Source}))
+	}
+	if step.echo {
+		if step.late_echo && bd.on(BDOPT_NOECHO) {
+			bd.saved(thisNode, m, BDOPT_NOECHO)
+		} else if m.Source == thisNode.address && bd.on(BDOPT_IMPLICIT) {
+			bd.saved(thisNode, m, BDOPT_IMPLICIT)
+		} else {
+			m.Type = TYPE_BRB_ECHO
+			originate_BDOPT(ctx, thisNode, m, deliveredMessages)
+		}
+	}
+	if step.ready {
+		m.Type = TYPE_BRB_READY
+		originate_BDOPT(ctx, thisNode, m, deliveredMessages)
+	}
+}
+
+// Count the messages not sent to the neighbours by an optimisation of this node's own messages
+func (bd *BDopt) saved(thisNode *Node, m Message, opt string) {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bc := bd.broadcast(thisNode, m)
+	for _, p := range thisNode.peers() {
+		if p.String() != extractPeerIDFromMultiaddr(thisNode.master_address) {
+			bc.optimised[opt]++
+		}
+	}
+}
+
+// Start the Dolev broadcast of a SEND, ECHO or READY made by this node, and deliver it to itself
+func originate_BDOPT(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	m.InstanceID = thisNode.address
+	m.Sender = thisNode.address
+	m.Target = ""
+	m.Path = []string{}
+	m.Neighbourhood = []string{}
+
+	bd := thisNode.bdopt
+	bd.mu.Lock()
+	bc := bd.broadcast(thisNode, m)
+	inst := bd.instance(dolevKey(m))
+	inst.delivered = true
+	targets := bd.relayTargets(thisNode, m.Path, m.InstanceID, inst, bc, m.Type)
+	n := bc.n
+	bd.mu.Unlock()
+
+	for _, p := range targets {
+		send(ctx, thisNode, p, m, PROTOCOL_BDOPT)
+	}
+	event := fmt.Sprintf("send_BDOPT %s - %s sent to %d neighbours", m.ID[len(m.ID)-5:], m.Type, len(targets))
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+
+	bracha_BDOPT(ctx, thisNode, m, m.InstanceID, n, deliveredMessages)
+}
+
+// Start a Bracha-Dolev reliable broadcast of the content of m, with this node as the source
+func sendBDopt(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	bd := thisNode.bdopt
+	bd.mu.Lock()
+	n := bd.networkSize(thisNode)
+	bd.mu.Unlock()
+	f := thisNode.max_byzantines
+	if n <= 3*f {
+		event := fmt.Sprintf("send_BDOPT %s - Only %d nodes for %d byzantines: delivery is not granted with n <= 3f", m.ID[len(m.ID)-5:], n, f)
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	}
+
+	m.Type = TYPE_BRB_SEND
+	m.Source = thisNode.address
+	originate_BDOPT(ctx, thisNode, m, deliveredMessages)
+}
+
+// Event with the counters of a broadcast
+func (bd *BDopt) statsEvent(key brachaKey) string {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bc, ok := bd.broadcasts[key]
+	if !ok {
+		return ""
+	}
+	sent := bc.sent[TYPE_BRB_SEND] + bc.sent[TYPE_BRB_ECHO] + bc.sent[TYPE_BRB_READY]
+	event := fmt.Sprintf("stats_BDOPT %s - %d messages sent: SEND=%d ECHO=%d READY=%d - optimisations:", key.id[len(key.id)-5:], sent, bc.sent[TYPE_BRB_SEND], bc.sent[TYPE_BRB_ECHO], bc.sent[TYPE_BRB_READY])
+	for _, opt := range BDOPT_OPTIMISATIONS {
+		if bd.on(opt) {
+			event += fmt.Sprintf(" %s=%d", opt, bc.optimised[opt])
+		} else {
+			event += fmt.Sprintf(" %s=off", opt)
+		}
+	}
+	return event
+}
+
+// Log the counters of every broadcast
+func logBDoptStats(thisNode *Node) {
+	bd := thisNode.bdopt
+	bd.mu.Lock()
+	var keys []brachaKey
+	for key := range bd.broadcasts {
+		keys = append(keys, key)
+	}
+	bd.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id == keys[j].id {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].id < keys[j].id
+	})
+	if len(keys) == 0 {
+		fmt.Println("No BDopt broadcast so far")
+	}
+	for _, key := range keys {
+		logEvent(thisNode.ID().String(), PRINTOPTION, bd.statsEvent(key))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Counters of a Bracha-Dolev broadcast, summed on all the nodes
+type bdoptCounters struct {
+	delivered	int
+	sent		int
+	optimised	map[string]int
+}
+
+// Broadcast a message from node A of a virtual simulation with the given optimisations, and sum the counters of the nodes
+func runBDoptBroadcast(t *testing.T, topology_file string, bdopt string) bdoptCounters {
+	ctx := context.Background()
+	sim, err := NewSimulation(ctx, SimulationConfig{topology_file: topology_file, clock: SIM_CLOCK_VIRTUAL, seed: 1, bdopt: bdopt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	source := sim.Get("A")
+	clock.Run(ctx, func(ctx context.Context) {
+		err := executeCommand(ctx, source.node, cmd_bdopt+" "+cmd_msg+" \"hello\"", source.receivedMessages, source.deliveredMessages, source.disjointPaths, source.topology)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	counters := bdoptCounters{optimised: make(map[string]int)}
+	for _, sn := range sim.sortedNodes() {
+		sn.deliveredMessages.mu.Lock()
+		counters.delivered += len(sn.deliveredMessages.messages)
+		sn.deliveredMessages.mu.Unlock()
+		bd := sn.node.bdopt
+		bd.mu.Lock()
+		for _, bc := range bd.broadcasts {
+			for _, count := range bc.sent {
+				counters.sent += count
+			}
+			for opt, count := range bc.optimised {
+				counters.optimised[opt] += count
+			}
+		}
+		bd.mu.Unlock()
+	}
+	return counters
+}
+
+// Skip only counts the messages that it does not send
+func TestBDoptSkipCounter(t *testing.T) {
+	topology_file := "../topologies/10nodes_4connected.csv"
+	inTestLayout(t, &topology_file)
+
+	empty := runBDoptBroadcast(t, topology_file, BDOPT_EMPTY)
+	skip := runBDoptBroadcast(t, topology_file, BDOPT_EMPTY + "," + BDOPT_SKIP)
+	if empty.delivered != 10 || skip.delivered != 10 {
+		t.Fatalf("%d and %d nodes delivered, expected 10", empty.delivered, skip.delivered)
+	}
+	if skip.optimised[BDOPT_SKIP] == 0 {
+		t.Fatalf("skip never counted")
+	}
+	if skip.sent + skip.optimised[BDOPT_SKIP] != empty.sent {
+		t.Errorf("skip counted %d messages, but %d messages sent instead of %d", skip.optimised[BDOPT_SKIP], skip.sent, empty.sent)
+	}
+	t.Logf("%d messages sent with empty, %d with empty,skip, %v", empty.sent, skip.sent, skip.optimised)
+}
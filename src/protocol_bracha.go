@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+	BRACHA RELIABLE BROADCAST
+	Byzantine reliable broadcast of Bracha, for fully connected networks with authenticated links,
+	see @ Asynchronous Byzantine Agreement Protocols - 1987 - Bracha.
+	It is the baseline for the Dolev-style protocols, that relay the messages along paths.
+	With n nodes and at most f byzantines, n > 3f:
+		- the source sends SEND to every node;
+		- a node sends ECHO to every node when it receives the SEND from the source;
+		- a node sends READY to every node when it has more than (n+f)/2 ECHO, or f+1 READY, for the same content;
+		- a node delivers the content when it has 2f+1 READY for it.
+	Every node sends its ECHO and READY to itself too. Only the first ECHO and the first READY of each node count.
+	n is the number of nodes connected to this node, this node included, and the master excluded.
+	Nodes trust the sender of the messages: the transport refuses the messages whose sender is not the peer
+	that sent them, see setHandler.
+*/
+type Bracha struct {
+	mu			sync.Mutex
+	instances	map[brachaKey]*brachaInstance
+}
+
+// A broadcast is identified by its message and its source
+type brachaKey struct {
+	id		string
+	source	string
+}
+
+// State of a broadcast at this node
+type brachaInstance struct {
+	start		time.Time			// When this node heard of the broadcast first
+	echoes		map[string]string	// Node address -> content of its ECHO
+	readys		map[string]string	// Node address -> content of its READY
+	echoed		bool				// ECHO sent
+	ready		bool				// READY sent
+	delivered	bool
+}
+
+// Return a new Bracha, with no broadcast going on
+func NewBracha() *Bracha {
+	return &Bracha{
+		instances:	make(map[brachaKey]*brachaInstance),
+	}
+}
+
+// Forget every broadcast
+func (b *Bracha) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.instances = make(map[brachaKey]*brachaInstance)
+}
+
+// State of the broadcast of m, created if it is the first time the node hears of it.
+// Must be called with b.mu locked
+func (b *Bracha) instance(m Message) *brachaInstance {
+	key := brachaKey{id: m.ID, source: m.Source}
+	inst, ok := b.instances[key]
+	if !ok {
+		inst = &brachaInstance{
+			start:	clock.Now(),
+			echoes:	make(map[string]string),
+			readys:	make(map[string]string),
+		}
+		b.instances[key] = inst
+	}
+	return inst
+}
+
+// What a node has to do after a message of the Bracha reliable broadcast
+type brachaStep struct {
+	refused		bool		// The SEND does not come from the source
+	echo		bool		// Send ECHO
+	late_echo	bool		// The ECHO is due but the node has already sent READY
+	ready		bool		// Send READY
+	deliver		bool
+	start		time.Time	// When this node heard of the broadcast first
+}
+
+// Count the SEND, ECHO or READY of the voter, with n nodes of which at most f byzantines
+func (b *Bracha) receive(m Message, voter string, n int, f int) brachaStep {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	inst := b.instance(m)
+	step := brachaStep{start: inst.start}
+	switch m.Type {
+	case TYPE_BRB_SEND:
+		if voter != m.Source {
+			step.refused = true
+			return step
+		}
+		if !inst.echoed {
+			inst.echoed = true
+			step.echo = true
+			step.late_echo = inst.ready
+		}
+	case TYPE_BRB_ECHO:
+		if _, ok := inst.echoes[voter]; !ok {
+			inst.echoes[voter] = m.Content
+		}
+		if !inst.ready && 2*countVotes(inst.echoes, m.Content) > n+f {
+			inst.ready = true
+			step.ready = true
+		}
+	case TYPE_BRB_READY:
+		if _, ok := inst.readys[voter]; !ok {
+			inst.readys[voter] = m.Content
+		}
+		readys := countVotes(inst.readys, m.Content)
+		if !inst.ready && readys > f {
+			inst.ready = true
+			step.ready = true
+		}
+		if !inst.delivered && readys > 2*f {
+			inst.delivered = true
+			step.deliver = true
+		}
+	}
+	return step
+}
+
+// Number of votes for a content
+func countVotes(votes map[string]string, content string) int {
+	count := 0
+	for _, c := range votes {
+		if c == content {
+			count++
+		}
+	}
+	return count
+}
+
+// Number of nodes of the network as seen by this node: its peers but the master, and itself
+func brachaNodes(thisNode *Node) int {
+	n := 1
+	for _, p := range thisNode.peers() {
+		if p.String() != extractPeerIDFromMultiaddr(thisNode.master_address) {
+			n++
+		}
+	}
+	return n
+}
+
+// Handle a stream of the Bracha reliable broadcast
+func handleBracha(m Message, ctx context.Context, thisNode *Node, deliveredMessages *MessageContainer) error {
+	// Apply byzantine modifications
+	// returns true if byzantine is type 2 [drop messages], so this function must be stopped
+	if applyByzantine(ctx, thisNode, &m) {return nil}
+
+	receive_BRB(ctx, thisNode, m, deliveredMessages)
+	return nil
+}
+
+// Function to manage a SEND, ECHO or READY message
+func receive_BRB(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	n := brachaNodes(thisNode)
+	f := thisNode.max_byzantines
+
+	step := thisNode.bracha.receive(m, m.Sender, n, f)
+	if step.refused {
+		event := fmt.Sprintf("receive_BRB %s - SEND from %s refused: it is not the source %s", m.ID[len(m.ID)-5:], addressToPrint(m.Sender, NODE_PRINTLAST), addressToPrint(m.Source, NODE_PRINTLAST))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+		return
+	}
+
+	if step.deliver {
+		deliveredMessages.Add(m)
+		event := fmt.Sprintf("deliver_BRB %s - Message from %s delivered after %f seconds, with n=%d and f=%d: %s", m.ID[len(m.ID)-5:], addressToPrint(m.Source, NODE_PRINTLAST), clock.Now().Sub(step.start).Seconds(), n, f, m.Content)
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	}
+	if step.echo {
+		m.Type = TYPE_BRB_ECHO
+		broadcast_BRB(ctx, thisNode, m, deliveredMessages)
+	}
+	if step.ready {
+		m.Type = TYPE_BRB_READY
+		broadcast_BRB(ctx, thisNode, m, deliveredMessages)
+	}
+}
+
+// Send a message of the Bracha reliable broadcast to every node, this node included
+func broadcast_BRB(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	m.Sender = thisNode.address
+	m.Target = ""
+	m.Path = []string{}
+	m.Neighbourhood = []string{}
+
+	sent := 0
+	for _, p := range thisNode.peers() {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
+			continue // Do not send the message to the master node
+		}
+		send(ctx, thisNode, p, m, PROTOCOL_BRB)
+		sent++
+	}
+
+	event := fmt.Sprintf("send_BRB %s - %s sent to %d nodes", m.ID[len(m.ID)-5:], m.Type, sent)
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+
+	receive_BRB(ctx, thisNode, m, deliveredMessages)
+}
+
+// Start a Bracha reliable broadcast of the content of m, with this node as the source
+func sendBracha(ctx context.Context, thisNode *Node, m Message, deliveredMessages *MessageContainer) {
+	n := brachaNodes(thisNode)
+	f := thisNode.max_byzantines
+	if n <= 3*f {
+		event := fmt.Sprintf("send_BRB %s - Only %d nodes connected for %d byzantines: delivery is not granted with n <= 3f", m.ID[len(m.ID)-5:], n, f)
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	}
+
+	m.Type = TYPE_BRB_SEND
+	m.Source = thisNode.address
+	broadcast_BRB(ctx, thisNode, m, deliveredMessages)
+}
@@ -1,46 +1,321 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-// Handle a broadcast stream
-// This is actually a Byzantine Reliable Broadcast, granted by DolevU protocol
-// See @ Thesis Farina, 2021, CPT 6.1, Algorithm 1, PDF pg 42/142
-// + PDF pg 43/142, CPT 6.1.2 - DolevU Message Complexity - for performance analysis
-func handleBroadcast(s network.Stream, ctx context.Context, thisNode host.Host, messageContainer *MessageContainer) error {
-	buf := bufio.NewReader(s)
-	message, err := buf.ReadString('\n')
-	if err != nil {
-		return err
+/*
+	DOLEVU DELIVERY
+	Every node delivers a broadcast of /nab/ by itself, as soon as it can:
+		- when it receives a copy from the source;
+		- when the paths of the copies it received hold enough node-disjoint paths from the source
+		  (see MessageContainer.hasDisjointPaths): 2f+1 if the topology is known, f+1 otherwise.
+		  The topology is known by the nodes started with runNode_knownTopology (-m auto) and the nodes of a simulation.
+	Links are authenticated (see setHandler), so the last node of a path is the node that sent the copy.
+	The source delivers its own message at once. Delivery is logged with the "deliver_NAB" event,
+	together with the time since the node heard of the message first. The copy that makes the node deliver
+	is relayed, the copies received afterwards are neither kept nor relayed.
+
+	DOLEVU MODIFICATIONS
+	Modifications of DolevU that cut the copies of a message relayed in the network, see
+	@ Multi-hop Byzantine reliable broadcast with honest dealer made practical - 2019 - Bonomi, Farina, Tixeuil, CPT 4.
+	Each one is switched on and off with -nabopt (NAB_* in constants.go). They are all off by default:
+		stop	a node that delivered a message does not relay its copies anymore. It always holds,
+				the modification only counts the copies not relayed
+		empty	a node that delivered a message relays it once with an empty path, instead of the copy that made it deliver.
+				A copy with an empty path from a neighbour that is not the source tells that the neighbour delivered the message
+		ignore	copies whose path contains a neighbour that delivered the message are dropped
+		skip	copies are not sent to the neighbours that delivered the message
+	ignore and skip need empty on the neighbours.
+	For each message the node counts the copies it sent, and how many times each modification applied:
+	copies not sent for stop, empty and skip, copies dropped for ignore.
+	They are logged with the "stats_NAB" event when the message is delivered and by -broadcast STATS.
+*/
+type DolevU struct {
+	mu			sync.Mutex
+	enabled		map[string]bool					// Modifications switched on, set before the node starts
+	known		bool							// The topology is known, set when the node starts
+	paths		*MessageContainer				// Paths received for each message not delivered yet, without the source and this node
+	messages	map[string]*dolevUMessage		// Message ID -> state of the message at this node
+}
+
+// Modifications of DolevU, in the order they are printed
+var NAB_OPTIMISATIONS = []string{NAB_STOP, NAB_EMPTY, NAB_IGNORE, NAB_SKIP}
+
+// State of a broadcast message at this node
+type dolevUMessage struct {
+	start		time.Time			// When this node heard of the message first
+	needed		int					// Node-disjoint paths needed to deliver the message, 0 until the first copy
+	delivered	bool
+	sent		int					// Copies sent
+	optimised	map[string]int		// Times each modification applied
+	empty_sent	bool				// The message has been relayed with an empty path
+	done		map[string]bool		// Peer IDs of the neighbours that delivered the message
+}
+
+// Return a new DolevU, with every modification switched off
+func NewDolevU() *DolevU {
+	return &DolevU{
+		enabled:	make(map[string]bool),
+		paths:		NewMessageContainer(),
+		messages:	make(map[string]*dolevUMessage),
+	}
+}
+
+// Switch on the given modifications, and off the others
+func (d *DolevU) setOptimisations(enabled map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enabled = enabled
+}
+
+// Tell whether the topology is known by the node
+func (d *DolevU) setKnownTopology(known bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.known = known
+}
+
+// Check whether a modification is switched on
+func (d *DolevU) on(opt string) bool {
+	return d.enabled[opt]
+}
+
+// Forget every message, keeping the modifications
+func (d *DolevU) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paths.Reset()
+	d.messages = make(map[string]*dolevUMessage)
+}
+
+// State of a message. Must be called with d.mu locked
+func (d *DolevU) message(msg_id string) *dolevUMessage {
+	dm, ok := d.messages[msg_id]
+	if !ok {
+		dm = &dolevUMessage{
+			start:		clock.Now(),
+			optimised:	make(map[string]int),
+			done:		make(map[string]bool),
+		}
+		d.messages[msg_id] = dm
+	}
+	return dm
+}
+
+// Number of node-disjoint paths from the source needed to deliver a message:
+// 2f+1 if the topology is known, f+1 otherwise. Must be called with d.mu locked
+func (d *DolevU) neededPaths(f int) int {
+	if d.known {
+		return 2*f + 1
+	}
+	return f + 1
+}
+
+// Check whether this node delivered the message
+func (d *DolevU) isDelivered(msg_id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dm, ok := d.messages[msg_id]
+	return ok && dm.delivered
+}
+
+// Mark a message sent by this node as delivered
+func (d *DolevU) originate(msg_id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.message(msg_id).delivered = true
+}
+
+// Add the path of a copy of m, and tell whether the copy makes this node deliver the message
+func (d *DolevU) collect(thisNode *Node, m Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dm := d.message(m.ID)
+	if dm.delivered {
+		return false
+	}
+	if dm.needed == 0 {
+		dm.needed = d.neededPaths(thisNode.max_byzantines)
+	}
+	// Nodes between the source and this node
+	var between []string
+	for _, node := range m.Path {
+		if getNodeID(node) != getNodeID(m.Source) && getNodeID(node) != thisNode.ID().String() {
+			between = append(between, node)
+		}
+	}
+	if !d.paths.hasPath(m.ID, between) {
+		d.paths.Add(Message{ID: m.ID, Path: between})
+	}
+	if m.Sender == m.Source || d.paths.hasDisjointPaths(m.ID, dm.needed) {
+		dm.delivered = true
+		d.paths.deleteElement(m.ID)
 	}
+	return dm.delivered
+}
+
+// Deliver a broadcast: move its copies to the delivered messages, and log the delivery and the counters
+func deliverBroadcast(thisNode *Node, m Message, messageContainer *MessageContainer, deliveredMessages *MessageContainer) {
+	for _, c := range messageContainer.Get(m.ID) {
+		deliveredMessages.Add(c)
+	}
+	messageContainer.deleteElement(m.ID)
+
+	d := thisNode.dolevu
+	d.mu.Lock()
+	dm := d.message(m.ID)
+	latency := clock.Now().Sub(dm.start).Seconds()
+	needed := dm.needed
+	d.mu.Unlock()
+
+	event := fmt.Sprintf("deliver_NAB %s - Message from %s delivered after %f seconds, with %d node-disjoint paths needed and f=%d: %s", m.ID[len(m.ID)-5:], addressToPrint(m.Source, NODE_PRINTLAST), latency, needed, thisNode.max_byzantines, m.Content)
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	logEvent(thisNode.ID().String(), PRINTOPTION, d.statsEvent(m.ID))
+}
+
+// Remember the neighbours that delivered the message, and tell whether the copy must be dropped by ignore.
+// empty is true for a copy that came with an empty path from a neighbour that is not the source
+func (d *DolevU) ignored(m Message, empty bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dm := d.message(m.ID)
+	if empty {
+		dm.done[getNodeID(m.Sender)] = true
+		return false
+	}
+	if !d.on(NAB_IGNORE) {
+		return false
+	}
+	for _, node := range m.Path {
+		if dm.done[getNodeID(node)] {
+			dm.optimised[NAB_IGNORE]++
+			return true
+		}
+	}
+	return false
+}
 
-	// Transform the message into a json object with all the information
-	var m Message
-	err = json.Unmarshal([]byte(message), &m)
+// Peers to send a copy of m to: the ones that are not in its path, but the source and the master.
+// With skip, the neighbours that delivered the message are skipped too.
+// Also returns the peers left out because they are in the path, and the number of peers skipped.
+// Nothing is counted here. Must be called with d.mu locked
+func (d *DolevU) targets(thisNode *Node, m Message) (targets []peer.ID, in_path []peer.ID, skipped int) {
+	dm := d.message(m.ID)
+	for _, p := range thisNode.peers() {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
+			continue // Do not send the message to the master node
+		}
+		// If the peer p is already in the path of the message, then do not forward the message
+		if contains(m.Path, p.String()) {
+			in_path = append(in_path, p)
+			continue
+		}
+		if p.String() == getNodeID(m.Source) {
+			continue // The source already has the message
+		}
+		if d.on(NAB_SKIP) && dm.done[p.String()] {
+			skipped++
+			continue
+		}
+		targets = append(targets, p)
+	}
+	return targets, in_path, skipped
+}
+
+// Count the copies of a message already delivered that are not relayed, for stop or empty
+func (d *DolevU) dropDelivered(thisNode *Node, m Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	opt := NAB_STOP
+	if d.on(NAB_EMPTY) {
+		opt = NAB_EMPTY
+	}
+	if d.on(opt) {
+		targets, _, _ := d.targets(thisNode, m)
+		d.message(m.ID).optimised[opt] += len(targets)
+	}
+}
+
+// With empty, relay the message just delivered once with an empty path, instead of the copy.
+// Returns false if the copy has to be relayed
+func relayEmpty(ctx context.Context, thisNode *Node, m Message) bool {
+	d := thisNode.dolevu
+	d.mu.Lock()
+	dm := d.message(m.ID)
+	if !d.on(NAB_EMPTY) || dm.empty_sent {
+		d.mu.Unlock()
+		return false
+	}
+	dm.empty_sent = true
+	d.mu.Unlock()
+	m.Path = []string{}
+	new_message, err := json.Marshal(m)
 	if err != nil {
 		printError(err)
+		return true
+	}
+	sendBroadcast(ctx, thisNode, string(new_message))
+	return true
+}
+
+// Event with the counters of a message
+func (d *DolevU) statsEvent(msg_id string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dm := d.message(msg_id)
+	event := fmt.Sprintf("stats_NAB %s - %d messages sent - optimisations:", msg_id[len(msg_id)-5:], dm.sent)
+	for _, opt := range NAB_OPTIMISATIONS {
+		if d.on(opt) {
+			event += fmt.Sprintf(" %s=%d", opt, dm.optimised[opt])
+		} else {
+			event += fmt.Sprintf(" %s=off", opt)
+		}
+	}
+	return event
+}
+
+// Log the counters of every message
+func logDolevUStats(thisNode *Node) {
+	d := thisNode.dolevu
+	d.mu.Lock()
+	var ids []string
+	for id := range d.messages {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		fmt.Println("No broadcast so far")
 	}
+	for _, id := range ids {
+		logEvent(thisNode.ID().String(), PRINTOPTION, d.statsEvent(id))
+	}
+}
 
+// Handle a broadcast stream
+// This is actually a Byzantine Reliable Broadcast, granted by DolevU protocol
+// See @ Thesis Farina, 2021, CPT 6.1, Algorithm 1, PDF pg 42/142
+// + PDF pg 43/142, CPT 6.1.2 - DolevU Message Complexity - for performance analysis
+func handleBroadcast(m Message, ctx context.Context, thisNode *Node, messageContainer *MessageContainer, deliveredMessages *MessageContainer) error {
 	// Byzantine checking
-	if byzantine_status {
+	if thisNode.byzantine_status {
 		// If byzantine is of Type 1, then sleep for bz.Delay milliseconds
-		if bz.Type1 {
-			event := fmt.Sprintf("byzantine %s - delay of %s ms", m.ID[len(m.ID)-5:], bz.Delay)
+		if thisNode.bz.Type1 {
+			event := fmt.Sprintf("byzantine %s - delay of %s ms", m.ID[len(m.ID)-5:], thisNode.bz.Delay)
 			logEvent(thisNode.ID().String(), PRINTOPTION, event)
-			time.Sleep(bz.Delay)
+			clock.Sleep(ctx, thisNode.bz.Delay)
 		}
 		// If byzantine is of Type 2, then drop the message with bz.Droprate probability
-		if bz.Type2 {
-			if (rand.Float64() < bz.DropRate) {
+		if thisNode.bz.Type2 {
+			if (thisNode.rng.Float64() < thisNode.bz.DropRate) {
 				event := fmt.Sprintf("byzantine %s - Message from %s dropped", m.ID[len(m.ID)-5:], addressToPrint(m.Sender, NODE_PRINTLAST))
 				logEvent(thisNode.ID().String(), PRINTOPTION, event)
 				return nil
@@ -48,28 +323,52 @@ func handleBroadcast(s network.Stream, ctx context.Context, thisNode host.Host,
 		}
 	}
 
+	// A copy with an empty path from a node that is not the source comes from a neighbour that delivered the message
+	empty := len(m.Path) == 0 && m.Sender != m.Source
+
 	// Add sender node to the path.
 	// The PATH is represented as an array of strings
 	// If this is the target node, then append the target to the path
 	newPath := append(m.Path, m.Sender)
-	if (m.Target == getNodeAddress(thisNode, ADDR_DEFAULT)) {
+	if (m.Target == thisNode.address) {
 		newPath = append(newPath, m.Target)
 	}
 	m.Path = newPath
 
-	// add the message to the dedicated data struct
-	//receivedMessages.Add(string(new_message))
-	messageContainer.Add(m)
+	// Drop the copies through the neighbours that delivered the message, if ignore is on
+	if thisNode.dolevu.ignored(m, empty) {
+		return nil
+	}
 
 	new_message, err := json.Marshal(m)
 	if err != nil {
 		fmt.Println("Error marshalling data while handling a message:", err)
 	}
 
+	// Copies of a message already delivered are neither kept nor relayed
+	if thisNode.dolevu.isDelivered(m.ID) || len(deliveredMessages.Get(m.ID)) > 0 {
+		if (m.Target != thisNode.address) {
+			thisNode.dolevu.dropDelivered(thisNode, m)
+		}
+		return nil
+	}
+
+	// add the message to the dedicated data struct
+	//receivedMessages.Add(string(new_message))
+	messageContainer.Add(m)
+
 	printMessage(string(new_message))
 
+	delivered := thisNode.dolevu.collect(thisNode, m)
+	if delivered {
+		deliverBroadcast(thisNode, m, messageContainer, deliveredMessages)
+	}
+
 	// If we are on the target node do not forward the message
-	if (m.Target != getNodeAddress(thisNode, ADDR_DEFAULT)) {
+	if (m.Target != thisNode.address) {
+		if delivered && relayEmpty(ctx, thisNode, m) {
+			return nil
+		}
 		sendBroadcast(ctx, thisNode, string(new_message))
 	}
 
@@ -78,9 +377,9 @@ func handleBroadcast(s network.Stream, ctx context.Context, thisNode host.Host,
 
 // Send a Broadcast message
 // This is actually a Byzantine Reliable Broadcast, granted by DolevU protocol
-// See @ Thesis Farina, 2021, CPT 6.1, Algorithm 1, PDF pg 42/142 
+// See @ Thesis Farina, 2021, CPT 6.1, Algorithm 1, PDF pg 42/142
 // + PDF pg 43/142, CPT 6.1.2 - DolevU Message Complexity - for performance analysis
-func sendBroadcast(ctx context.Context, thisNode host.Host, msg string) {
+func sendBroadcast(ctx context.Context, thisNode *Node, msg string) {
     // Get the json object from content, where is stored all the information about the sender, the source and the destination
     var m Message
     err := json.Unmarshal([]byte(msg), &m)
@@ -89,50 +388,25 @@ func sendBroadcast(ctx context.Context, thisNode host.Host, msg string) {
         return
     }
 
-    // Cycle through the peers connected to the current node
-    for _, p := range thisNode.Network().Peers() {
+    // The peers already in the path of the message, the source and the master are left out
+    d := thisNode.dolevu
+    d.mu.Lock()
+    targets, in_path, skipped := d.targets(thisNode, m)
+    d.message(m.ID).sent += len(targets)
+    if skipped > 0 {
+        d.message(m.ID).optimised[NAB_SKIP] += skipped
+    }
+    d.mu.Unlock()
+    for _, p := range in_path {
+        fmt.Println("Do not forward on node ", p)
+        printShell()
+    }
 
-		if p.String() == extractPeerIDFromMultiaddr(master_address) {
-			continue // Do not send the message to the master node
-		}
+    // Change the sender into the content: the sender node is now this node
+    m.Sender = thisNode.address
 
-        // If the peer p is already in the path of the message, then do not forward the message
-        if contains(m.Path, p.String()) {
-            fmt.Println("Do not forward on node ", p)
-            printShell()
-            continue
-        }
-
-        // Open a stream with the peer
-        stream, err := openStream(ctx, thisNode, p, PROTOCOL_NAB)
-        if err != nil {
-            printError(err)
-            continue
-        }
-
-        // Ensure the stream is closed after use
-        defer stream.Close()
-
-        // Change the sender into the content: the sender node is now this node
-        m.Sender = getNodeAddress(thisNode, ADDR_DEFAULT)
-
-        dataBytes, err := json.Marshal(m)
-        if err != nil {
-            fmt.Println("Error marshalling data while sending a message:", err)
-            continue
-        }
-
-        // Lock the function (critical section)
-        streamMutex.Lock()
-
-        // Write the message on the stream
-        message := fmt.Sprintf("%s\n", string(dataBytes))
-        _, err = stream.Write([]byte(message))
-        if err != nil {
-            printError(err)
-        }
-
-        // Unlock before exiting
-        streamMutex.Unlock()
+    // Send the message to the peers
+    for _, p := range targets {
+        send(ctx, thisNode, p, m, PROTOCOL_NAB)
     }
-}
\ No newline at end of file
+}
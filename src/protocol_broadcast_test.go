@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run the test from a copy of the layout of the repository, so that the logs of the nodes
+// are not written in ../logs. Paths given are made absolute first
+func inTestLayout(t *testing.T, paths ...*string) {
+	for _, path := range paths {
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*path = abs
+	}
+	config, err := os.ReadFile(BYZANTINE_CONFIG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_clock := clock
+
+	dir := t.TempDir()
+	for _, sub := range []string{"src", "config"} {
+		err := os.Mkdir(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Chdir(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(old_dir)
+		clock = old_clock
+	})
+	err = os.WriteFile(BYZANTINE_CONFIG, config, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Counters of a broadcast, summed on all the nodes
+type nabCounters struct {
+	delivered	int
+	sent		int
+	optimised	map[string]int
+}
+
+// Broadcast a message from node A of a virtual simulation with the given modifications, and sum the counters of the nodes
+func runNabBroadcast(t *testing.T, topology_file string, nabopt string) nabCounters {
+	ctx := context.Background()
+	sim, err := NewSimulation(ctx, SimulationConfig{topology_file: topology_file, clock: SIM_CLOCK_VIRTUAL, seed: 1, nabopt: nabopt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	source := sim.Get("A")
+	clock.Run(ctx, func(ctx context.Context) {
+		err := executeCommand(ctx, source.node, cmd_broadcast+" all "+cmd_msg+" \"hello\"", source.receivedMessages, source.deliveredMessages, source.disjointPaths, source.topology)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	counters := nabCounters{optimised: make(map[string]int)}
+	for _, sn := range sim.sortedNodes() {
+		d := sn.node.dolevu
+		d.mu.Lock()
+		for _, dm := range d.messages {
+			if dm.delivered {
+				counters.delivered++
+			}
+			counters.sent += dm.sent
+			for opt, count := range dm.optimised {
+				counters.optimised[opt] += count
+			}
+		}
+		d.mu.Unlock()
+	}
+	return counters
+}
+
+// Every modification counts when it applies, and only when it is switched on
+func TestNabOptimisationCounters(t *testing.T) {
+	topology_file := "../topologies/10nodes_4connected.csv"
+	inTestLayout(t, &topology_file)
+
+	plain := runNabBroadcast(t, topology_file, OPT_NONE)
+	if plain.delivered != 10 {
+		t.Fatalf("%d nodes delivered with no modification, expected 10", plain.delivered)
+	}
+
+	tests := []struct {
+		nabopt		string
+		counted		[]string	// Modifications that apply on this network
+		fewer		bool		// Fewer copies are sent than with no modification
+	}{
+		{OPT_NONE, nil, false},
+		// Nodes stop relaying a message once delivered anyway: stop only counts the copies not relayed
+		{NAB_STOP, []string{NAB_STOP}, false},
+		{NAB_EMPTY, []string{NAB_EMPTY}, false},
+		{NAB_EMPTY + "," + NAB_IGNORE, []string{NAB_EMPTY, NAB_IGNORE}, false},
+		{NAB_EMPTY + "," + NAB_SKIP, []string{NAB_EMPTY, NAB_SKIP}, true},
+		{OPT_ALL, []string{NAB_EMPTY, NAB_SKIP}, true},
+	}
+	for _, test := range tests {
+		counters := runNabBroadcast(t, topology_file, test.nabopt)
+		if counters.delivered != plain.delivered {
+			t.Errorf("-nabopt %s: %d nodes delivered, expected %d", test.nabopt, counters.delivered, plain.delivered)
+		}
+		if test.fewer && counters.sent >= plain.sent {
+			t.Errorf("-nabopt %s: %d copies sent, expected less than the %d with no modification", test.nabopt, counters.sent, plain.sent)
+		}
+		enabled, err := parseOptimisations(test.nabopt, NAB_OPTIMISATIONS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counted := make(map[string]bool)
+		for _, opt := range test.counted {
+			counted[opt] = true
+		}
+		for _, opt := range NAB_OPTIMISATIONS {
+			count := counters.optimised[opt]
+			if !enabled[opt] && count != 0 {
+				t.Errorf("-nabopt %s: %s is off but counted %d times", test.nabopt, opt, count)
+			}
+			if counted[opt] && count == 0 {
+				t.Errorf("-nabopt %s: %s never counted", test.nabopt, opt)
+			}
+		}
+		t.Logf("-nabopt %s: %d copies sent, %v", test.nabopt, counters.sent, counters.optimised)
+	}
+
+	// Skip only counts the copies that it does not send
+	empty := runNabBroadcast(t, topology_file, NAB_EMPTY)
+	skip := runNabBroadcast(t, topology_file, NAB_EMPTY + "," + NAB_SKIP)
+	if skip.sent + skip.optimised[NAB_SKIP] != empty.sent {
+		t.Errorf("skip counted %d copies, but %d copies sent instead of %d", skip.optimised[NAB_SKIP], skip.sent, empty.sent)
+	}
+}
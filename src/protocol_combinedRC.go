@@ -1,40 +1,21 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
-
-	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 )
 
 // Handle stream for CombinedRC protocol
-func handleCombinedRC(s network.Stream, ctx context.Context, thisNode host.Host, top *Topology, 
+func handleCombinedRC(m Message, ctx context.Context, thisNode *Node, top *Topology, 
 					messageContainer *MessageContainer, deliveredMessages *MessageContainer, sentMessages *MessageContainer,
 					disjointPaths *DisjointPaths) error {
 
-	defer s.Close()
-
-	// Read the buffer and extract the message
-	buf := bufio.NewReader(s)
-	message, err := buf.ReadString('\n')
-	if err != nil {
-		printError(err)
-	}
-
-	// Transform the message
-	var m Message
-	err = json.Unmarshal([]byte(message), &m)
-	if err != nil {
-		printError(err)
-	}
+	var err error
 
 	// Apply byzantine modifications
 	// returns true if byzantine is type 2 [drop messages], so this function must be stopped
 	// returns false otherwise and applies changes to the message
-	if applyByzantine(thisNode, &m) {return nil}
+	if applyByzantine(ctx, thisNode, &m) {return nil}
 
 	if m.Type == TYPE_CRC_EXP {
 		err = receive_EXP2(ctx, thisNode, &m, top, messageContainer, deliveredMessages)
@@ -57,7 +38,7 @@ func handleCombinedRC(s network.Stream, ctx context.Context, thisNode host.Host,
 }
 
 // Send function for CombinedRC protocol
-func sendCombinedRC(ctx context.Context, thisNode host.Host, m Message, top *Topology, disjointPaths *DisjointPaths) {
+func sendCombinedRC(ctx context.Context, thisNode *Node, m Message, top *Topology, disjointPaths *DisjointPaths) {
 
 	if m.Type == TYPE_CRC_EXP {
 		sendEXP2(ctx, thisNode, m)
@@ -1,45 +1,24 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
-	"math/rand"
-	"time"
-
-	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 )
 
 // Handler for Detector protocol
-func handleDetector(s network.Stream, ctx context.Context, h host.Host, top *Topology, messageContainer *MessageContainer) error {
-
-	// Read the buffer and extract the message
-	buf := bufio.NewReader(s)
-	message, err := buf.ReadString('\n')
-	if err != nil {
-		printError(err)
-	}
-
-	// Transform the message into a json object with all the information
-	var m Message
-	err = json.Unmarshal([]byte(message), &m)
-	if err != nil {
-		printError(err)
-	}
+func handleDetector(m Message, ctx context.Context, h *Node, top *Topology, messageContainer *MessageContainer) error {
 
 	// Byzantine checking
-	if byzantine_status {
+	if h.byzantine_status {
 		// If byzantine is of Type 1, then sleep for bz.Delay milliseconds
-		if bz.Type1 {
-			event := fmt.Sprintf("byzantine %s - delay of %s ms", m.Content, bz.Delay)
+		if h.bz.Type1 {
+			event := fmt.Sprintf("byzantine %s - delay of %s ms", m.Content, h.bz.Delay)
 				logEvent(h.ID().String(), PRINTOPTION, event)
-			time.Sleep(bz.Delay)
+			clock.Sleep(ctx, h.bz.Delay)
 		}
 		// If byzantine is of Type 2, then drop the message with bz.Droprate probability
-		if bz.Type2 {
-			if (rand.Float64() < bz.DropRate) {
+		if h.bz.Type2 {
+			if (h.rng.Float64() < h.bz.DropRate) {
 				event := fmt.Sprintf("byzantine %s - Message from %s dropped", m.Content, addressToPrint(m.Sender, NODE_PRINTLAST))
 				logEvent(h.ID().String(), PRINTOPTION, event)
 				return nil
@@ -80,7 +59,7 @@ func handleDetector(s network.Stream, ctx context.Context, h host.Host, top *Top
 	g := ConvertCTopToGraph(temp_ctop)
 	connectivity := g.nodeConnectivity()
 
-	if connectivity < MAX_BYZANTINES +1 {
+	if connectivity < h.max_byzantines +1 {
 		fmt.Printf("\nDetector - node %s wants to share its topology\n", addressToPrint(m.Source, NODE_PRINTLAST))
 		messageContainer.Add(m)
 		printByzantineAlert()
@@ -103,33 +82,15 @@ func handleDetector(s network.Stream, ctx context.Context, h host.Host, top *Top
 
 
 // Send a detector message
-func sendDetector(ctx context.Context, thisNode host.Host, det_msg Message) {
-
-	dataBytes, err := json.Marshal(det_msg)
-	if err != nil {
-		printError(err)
-	}
-	msg := string(dataBytes)
+func sendDetector(ctx context.Context, thisNode *Node, det_msg Message) {
 
 	// Cycle through the peers connected to the current node
-	for _, p := range thisNode.Network().Peers() {
+	for _, p := range thisNode.peers() {
 
-		if p.String() == extractPeerIDFromMultiaddr(master_address) {
+		if p.String() == extractPeerIDFromMultiaddr(thisNode.master_address) {
 			continue // Do not send the message to the master node
 		}
 
-		// open a new stream
-		stream, err := openStream(ctx, thisNode, p, PROTOCOL_DET)
-		if err != nil {
-			printError(err)
-		}
-
-		message := fmt.Sprintf("%s\n", msg)
-
-		// Write the message on the stream 
-		_, err = stream.Write([]byte(message))
-		if err != nil {
-			printError(err)
-		}
+		send(ctx, thisNode, p, det_msg, PROTOCOL_DET)
 	}
-}
\ No newline at end of file
+}
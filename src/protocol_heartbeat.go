@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+/*
+	FAILURE DETECTOR
+	While the detector of a node runs, the node sends a heartbeat to each neighbour every interval.
+	For each neighbour that sends heartbeats, the node remembers when the last one arrived and
+	the intervals between the last HB_WINDOW ones, and computes the suspicion level phi of the
+	accrual failure detector (see @ The phi accrual failure detector - Hayashibara et al. 2004):
+	phi grows with the time since the last heartbeat, faster if heartbeats usually come on time.
+	A neighbour is suspected when phi goes over HB_PHI_THRESHOLD, and recovered when its next heartbeat arrives.
+	Neighbours are known by their address, as in the messages of the other protocols:
+	the protocol is authenticated (see setHandler), so a node can't send heartbeats for another one.
+	A node that shuts down sends a leave message on the same protocol (see shutdown in node_operations.go):
+	its neighbours mark it departed instead of suspecting it, and remove it from their cTop.
+	Other parts of the node can report a neighbour that misbehaves (see rate_limiter.go):
+	it stays suspected whatever its heartbeats say.
+	The detector only observes: suspects are logged and shown by -info,
+	but routing and broadcasts keep using the suspected neighbours.
+*/
+type FailureDetector struct {
+	mu			sync.Mutex
+	interval	time.Duration					// Time between two heartbeats of this node, 0 if the detector is not running
+	runs		int								// Number of times the detector was started, so that an old loop knows it must end
+	neighbours	map[string]*heartbeatHistory	// Neighbour address -> heartbeats received from it
+	suspected	map[string]bool					// Addresses of the neighbours currently suspected
+	departed	map[string]bool					// Addresses of the neighbours that left the network
+	reported	map[string]string				// Addresses of the neighbours reported as suspects -> reason
+}
+
+// Heartbeats received from a neighbour
+type heartbeatHistory struct {
+	last		time.Time
+	intervals	[]time.Duration		// Last HB_WINDOW intervals between two heartbeats
+}
+
+// Return a new FailureDetector, not running
+func NewFailureDetector() *FailureDetector {
+	return &FailureDetector{
+		neighbours:	make(map[string]*heartbeatHistory),
+		suspected:	make(map[string]bool),
+		departed:	make(map[string]bool),
+		reported:	make(map[string]string),
+	}
+}
+
+// Start sending heartbeats every interval and checking the neighbours, until the detector is stopped.
+// Starting a running detector changes its interval
+func (n *Node) startFailureDetector(ctx context.Context, interval time.Duration) {
+	fd := n.detector
+	if interval <= 0 {
+		return
+	}
+	fd.mu.Lock()
+	fd.interval = interval
+	fd.runs++
+	run := fd.runs
+	fd.mu.Unlock()
+
+	clock.AfterFunc(ctx, 0, func(ctx context.Context) {
+		for ctx.Err() == nil && fd.running(run) {
+			for _, p := range n.peers() {
+				if n.isStranger(p) {
+					continue
+				}
+				target := p
+				// Heartbeats to a neighbour that is gone fail: that is what the detector is for
+				clock.AfterFunc(ctx, 0, func(ctx context.Context) {
+					m := Message{Version: protocolVersion(PROTOCOL_HB), Type: TYPE_HEARTBEAT, Sender: n.address}
+					n.transport.Send(ctx, target, PROTOCOL_HB, m)
+				})
+			}
+			n.checkNeighbours()
+			clock.Sleep(ctx, fd.getInterval())
+		}
+	})
+}
+
+// Stop the detector. Neighbours are not checked anymore, but their heartbeats are still received
+func (n *Node) stopFailureDetector() {
+	n.detector.mu.Lock()
+	defer n.detector.mu.Unlock()
+	n.detector.interval = 0
+}
+
+// Check whether the given run of the detector is still the current one
+func (fd *FailureDetector) running(run int) bool {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.interval > 0 && fd.runs == run
+}
+
+func (fd *FailureDetector) getInterval() time.Duration {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.interval
+}
+
+// Handle the messages of the failure detector
+func handleHeartbeat(m Message, thisNode *Node, topology *Topology) error {
+	switch m.Type {
+	case TYPE_HEARTBEAT:
+		// A stranger is only connected while the discovery reads its label
+		if p, err := peer.Decode(extractPeerIDFromMultiaddr(m.Sender)); err == nil && thisNode.isStranger(p) {
+			return nil
+		}
+		return receiveHeartbeat(m, thisNode)
+	case TYPE_LEAVE:
+		return receiveLeave(m, thisNode, topology)
+	}
+	return fmt.Errorf("unknown message type %s on %s", m.Type, PROTOCOL_HB)
+}
+
+// Remember when a heartbeat arrived, and recover the neighbour if it was suspected
+func receiveHeartbeat(m Message, thisNode *Node) error {
+	fd := thisNode.detector
+	now := clock.Now()
+
+	fd.mu.Lock()
+	hh, ok := fd.neighbours[m.Sender]
+	if !ok {
+		// The first interval is guessed, so that a neighbour that sends only one heartbeat is suspected too.
+		// Every node of a network runs with the same -hb
+		first := fd.interval
+		if first == 0 {
+			first = HB_INTERVAL
+		}
+		hh = &heartbeatHistory{intervals: []time.Duration{first}}
+		fd.neighbours[m.Sender] = hh
+	} else {
+		hh.intervals = append(hh.intervals, now.Sub(hh.last))
+		if len(hh.intervals) > HB_WINDOW {
+			hh.intervals = hh.intervals[1:]
+		}
+	}
+	silence := now.Sub(hh.last)
+	hh.last = now
+	recovered := fd.suspected[m.Sender]
+	delete(fd.suspected, m.Sender)
+	delete(fd.departed, m.Sender) // Back after leaving
+	fd.mu.Unlock()
+
+	if recovered {
+		event := fmt.Sprintf("recover - Neighbour %s recovered after %s of silence", addressToPrint(m.Sender, NODE_PRINTLAST), silence.Round(time.Millisecond))
+		logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	}
+	return nil
+}
+
+// Forget a neighbour whose link was taken down on purpose: it is neither suspected nor departed
+func (fd *FailureDetector) forget(address string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	delete(fd.neighbours, address)
+	delete(fd.suspected, address)
+}
+
+// Forget a neighbour that left the network: it is not suspected anymore and it is removed from cTop
+func receiveLeave(m Message, thisNode *Node, topology *Topology) error {
+	fd := thisNode.detector
+	fd.mu.Lock()
+	delete(fd.neighbours, m.Sender)
+	delete(fd.suspected, m.Sender)
+	fd.departed[m.Sender] = true
+	fd.mu.Unlock()
+
+	explorer2Mutex.Lock()
+	topology.ctop.TotalRemoveElement(m.Sender)
+	explorer2Mutex.Unlock()
+
+	event := fmt.Sprintf("leave - Neighbour %s left the network", addressToPrint(m.Sender, NODE_PRINTLAST))
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	return nil
+}
+
+// Tell all the peers of the node, the master included, that the node is leaving
+func sendLeave(ctx context.Context, thisNode *Node) {
+	m := Message{Type: TYPE_LEAVE, Sender: thisNode.address}
+	for _, p := range thisNode.peers() {
+		send(ctx, thisNode, p, m, PROTOCOL_HB)
+	}
+}
+
+// Suspect the neighbours whose phi went over HB_PHI_THRESHOLD
+func (n *Node) checkNeighbours() {
+	fd := n.detector
+	now := clock.Now()
+
+	var events []string
+	fd.mu.Lock()
+	for address, hh := range fd.neighbours {
+		phi := hh.phi(now)
+		if phi > HB_PHI_THRESHOLD && !fd.suspected[address] {
+			fd.suspected[address] = true
+			events = append(events, fmt.Sprintf("suspect - Neighbour %s suspected, phi %.2f after %s of silence", addressToPrint(address, NODE_PRINTLAST), phi, now.Sub(hh.last).Round(time.Millisecond)))
+		}
+	}
+	fd.mu.Unlock()
+
+	sort.Strings(events) // Neighbours are in map order
+	for _, event := range events {
+		logEvent(n.ID().String(), PRINTOPTION, event)
+	}
+}
+
+// Suspicion level of the neighbour at time now, assuming that
+// the intervals between heartbeats follow a normal distribution
+func (hh *heartbeatHistory) phi(now time.Time) float64 {
+	var mean, variance float64
+	for _, i := range hh.intervals {
+		mean += i.Seconds()
+	}
+	mean /= float64(len(hh.intervals))
+	for _, i := range hh.intervals {
+		variance += (i.Seconds() - mean) * (i.Seconds() - mean)
+	}
+	variance /= float64(len(hh.intervals))
+
+	mean += HB_ACCEPTABLE_PAUSE.Seconds()
+	stddev := math.Max(math.Sqrt(variance), HB_MIN_STDDEV.Seconds())
+	elapsed := now.Sub(hh.last).Seconds()
+
+	// Logistic approximation of the cumulative distribution function of the normal distribution
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Report a neighbour as suspect, whatever its heartbeats say
+func (n *Node) reportSuspect(address string, reason string) {
+	n.detector.mu.Lock()
+	_, reported := n.detector.reported[address]
+	n.detector.reported[address] = reason
+	n.detector.mu.Unlock()
+
+	if !reported {
+		event := fmt.Sprintf("suspect - Neighbour %s reported: %s", addressToPrint(address, NODE_PRINTLAST), reason)
+		logEvent(n.ID().String(), PRINTOPTION, event)
+	}
+}
+
+// Addresses of the neighbours currently suspected or reported, sorted
+func (n *Node) suspects() []string {
+	n.detector.mu.Lock()
+	defer n.detector.mu.Unlock()
+	var suspects []string
+	for address := range n.detector.suspected {
+		if _, reported := n.detector.reported[address]; !reported {
+			suspects = append(suspects, address)
+		}
+	}
+	for address := range n.detector.reported {
+		suspects = append(suspects, address)
+	}
+	sort.Strings(suspects)
+	return suspects
+}
+
+// Addresses of the neighbours that left the network, sorted
+func (n *Node) departed() []string {
+	n.detector.mu.Lock()
+	defer n.detector.mu.Unlock()
+	var departed []string
+	for address := range n.detector.departed {
+		departed = append(departed, address)
+	}
+	sort.Strings(departed)
+	return departed
+}
+
+// Print the state of the failure detector of the node
+func printSuspects(h *Node) {
+	interval := h.detector.getInterval()
+	suspects := h.suspects()
+	if interval == 0 {
+		fmt.Printf("	Failure detector not running, %d suspected\n", len(suspects))
+	} else {
+		h.detector.mu.Lock()
+		monitored := len(h.detector.neighbours)
+		h.detector.mu.Unlock()
+		fmt.Printf("	Heartbeat every %s, %d neighbours monitored, %d suspected\n", interval, monitored, len(suspects))
+	}
+	for _, s := range suspects {
+		h.detector.mu.Lock()
+		reason, reported := h.detector.reported[s]
+		h.detector.mu.Unlock()
+		if reported {
+			fmt.Printf("	%s%s%s (%s)\n", RED, s, RESET, reason)
+		} else {
+			fmt.Printf("	%s%s%s\n", RED, s, RESET)
+		}
+	}
+	for _, d := range h.departed() {
+		fmt.Printf("	%s%s%s (left)\n", GREY, d, RESET)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+/*
+	PRIVATE NETWORKS
+	The nodes of an experiment can share a pre-shared key: a node started with a key only talks to
+	the nodes with the same key, and connections from any other node fail during the handshake,
+	so that experiments running on the same LAN can't mix.
+	Keys are files in the format of the libp2p swarm keys. The master can give a fresh key to the nodes:
+	each node saves it in its key file, and uses it from its next start, since the key of a node
+	can't change while it runs.
+	Private networks only work on TCP: nodes with a key don't listen on QUIC.
+*/
+
+// Options of createNode making the node use the key of the file. No options if there is no file.
+// Also returns the fingerprint of the key, "" if there is none
+func pskOptions(path string) ([]libp2p.Option, string, error) {
+	if path == "" {
+		return nil, "", nil
+	}
+	psk, err := loadPSK(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return []libp2p.Option{libp2p.PrivateNetwork(psk)}, pskFingerprint(psk), nil
+}
+
+// Load the key of a swarm key file
+func loadPSK(path string) (pnet.PSK, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+	}
+	return psk, nil
+}
+
+// Generate a fresh key
+func newPSK() (pnet.PSK, error) {
+	psk := make([]byte, PSK_SIZE)
+	_, err := rand.Read(psk)
+	if err != nil {
+		return nil, err
+	}
+	return psk, nil
+}
+
+// Save the key in a swarm key file, that only its owner can read
+func savePSK(path string, psk pnet.PSK) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%s\n/base16/\n%s\n", PSK_HEADER, hex.EncodeToString(psk))
+	return os.WriteFile(path, []byte(data), 0600)
+}
+
+// Short name of a key, that can be shown without giving the key away
+func pskFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:])[:PSK_FINGERPRINT]
+}
+
+// File where the node saves the keys given by the master
+func (n *Node) pskFile() string {
+	if n.psk_path != "" {
+		return n.psk_path
+	}
+	return PSK_FILE
+}
+
+// Give a fresh key to the nodes. The master saves it too
+func sendPSK(ctx context.Context, thisNode *Node, m Message) {
+	psk, err := newPSK()
+	if err != nil {
+		printError(err)
+		return
+	}
+	err = savePSK(thisNode.pskFile(), psk)
+	if err != nil {
+		printError(err)
+		return
+	}
+	event := fmt.Sprintf("psk - New private network key %s saved in %s, sent to %d peers", pskFingerprint(psk), thisNode.pskFile(), len(thisNode.peers()))
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+
+	m.Type = mst_psk
+	m.Content = hex.EncodeToString(psk)
+	sendMaster(ctx, thisNode, m)
+}
+
+// Save the key given by the master, to be used from the next start of the node
+func receivePSK(m Message, thisNode *Node) error {
+	psk, err := hex.DecodeString(m.Content)
+	if err != nil || len(psk) != PSK_SIZE {
+		return fmt.Errorf("invalid private network key from %s", addressToPrint(m.Sender, NODE_PRINTLAST))
+	}
+	err = savePSK(thisNode.pskFile(), psk)
+	if err != nil {
+		return err
+	}
+	event := fmt.Sprintf("psk - New private network key %s saved in %s, used from the next start", pskFingerprint(psk), thisNode.pskFile())
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	return nil
+}
+
+// Print the private network of the node
+func printPSK(h *Node) {
+	if h.psk_id == "" {
+		fmt.Printf("	None: the node talks to any node\n")
+		return
+	}
+	fmt.Printf("	Key %s, from %s\n", h.psk_id, h.psk_path)
+}
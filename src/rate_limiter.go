@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	RATE LIMITS
+	Each protocol may have a limit on the messages that a single peer can send to this node:
+	every peer has a token bucket for the protocol, that holds up to burst tokens and
+	gets rate tokens per second. A message takes a token, and is dropped if there are none left,
+	before it is queued (see worker_pool.go) and before any protocol sees it.
+	Peers are known by the connection the message came from, not by its Sender field, that can be forged.
+	Messages over the limit are counted and logged with the "limit" event, and, if asked,
+	the peer is reported as suspect to the failure detector (see protocol_heartbeat.go).
+	Limits are given by protocol name, so they hold for every version of the protocol.
+*/
+type RateLimit struct {
+	rate	float64		// Tokens added per second
+	burst	float64		// Tokens that the bucket can hold
+}
+
+type RateLimiter struct {
+	mu		sync.Mutex
+	limits	map[string]RateLimit		// Protocol name -> limit. Protocols without a limit are not limited
+	buckets	map[bucketKey]*tokenBucket
+	report	bool						// Report the peers over the limit as suspects
+}
+
+// Each peer has a bucket for each protocol
+type bucketKey struct {
+	peer		peer.ID
+	protocol	string
+}
+
+type tokenBucket struct {
+	tokens	float64
+	last	time.Time		// When the tokens were last updated
+	limited	int				// Messages dropped because the bucket was empty
+}
+
+// Return a new RateLimiter, that doesn't limit anything
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:		make(map[string]RateLimit),
+		buckets:	make(map[bucketKey]*tokenBucket),
+	}
+}
+
+// Parse limits written as "NAME=RATE:BURST,...", e.g. "crc=100:200,nab=50".
+// NAME is the name of an ARGO protocol without the version, RATE is in messages per second.
+// If BURST is omitted, it is RATE
+func parseRateLimits(spec string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, item := range strings.Split(spec, ",") {
+		if item == "" {
+			continue
+		}
+		name, values, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q: use NAME=RATE:BURST", item)
+		}
+		rate_str, burst_str, has_burst := strings.Cut(values, ":")
+		rate, err := strconv.ParseFloat(rate_str, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", item)
+		}
+		burst := rate
+		if has_burst {
+			burst, err = strconv.ParseFloat(burst_str, 64)
+			if err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in %q", item)
+			}
+		}
+		limits[PROTOCOL_PREFIX+strings.Trim(name, "/")] = RateLimit{rate: rate, burst: burst}
+	}
+	return limits, nil
+}
+
+// Set the limits, by protocol name ("/argo/crc"), and whether peers over the limit are reported as suspects
+func (rl *RateLimiter) setLimits(limits map[string]RateLimit, report bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limits = limits
+	rl.report = report
+	rl.buckets = make(map[bucketKey]*tokenBucket)
+}
+
+// Take a token from the bucket of the peer for the protocol.
+// Returns false if there was none, with the number of messages of the peer limited so far
+func (rl *RateLimiter) allow(from peer.ID, p protocol.ID) (bool, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	name := protocolName(p)
+	limit, ok := rl.limits[name]
+	if !ok {
+		return true, 0
+	}
+
+	now := clock.Now()
+	key := bucketKey{peer: from, protocol: name}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.rate
+	if b.tokens > limit.burst {
+		b.tokens = limit.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		b.limited++
+		return false, b.limited
+	}
+	b.tokens--
+	return true, b.limited
+}
+
+// Drop a message over the limit: count it, log it, and report the peer if asked
+func (n *Node) overLimit(from peer.ID, p protocol.ID, m Message, limited int) {
+	if limited == 1 || limited%POOL_LOG_EVERY == 0 {
+		event := fmt.Sprintf("limit %s - Peer %s over the rate limit of %s, message dropped, %d times so far", addressToPrint(m.ID, NODE_PRINTLAST), addressToPrint(from.String(), NODE_PRINTLAST), protocolName(p), limited)
+		logEvent(n.ID().String(), PRINTOPTION, event)
+	}
+
+	n.limiter.mu.Lock()
+	report := n.limiter.report
+	n.limiter.mu.Unlock()
+	if report && limited == 1 {
+		// The address of the peer is only known from the message: it is used if it belongs to the peer
+		address := "/p2p/" + from.String()
+		if strings.HasSuffix(m.Sender, address) {
+			address = m.Sender
+		}
+		n.reportSuspect(address, fmt.Sprintf("over the rate limit of %s", protocolName(p)))
+	}
+}
+
+// Print the limits of the node and the peers that went over them
+func printRateLimits(h *Node) {
+	rl := h.limiter
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.limits) == 0 {
+		fmt.Printf("	No rate limits\n")
+		return
+	}
+	var names []string
+	for name := range rl.limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limit := rl.limits[name]
+		fmt.Printf("	%s	%g messages/s, burst %g, for each peer\n", name, limit.rate, limit.burst)
+		for key, b := range rl.buckets {
+			if key.protocol == name && b.limited > 0 {
+				fmt.Printf("		%s%s%s	%d messages dropped\n", RED, key.peer, RESET, b.limited)
+			}
+		}
+	}
+}
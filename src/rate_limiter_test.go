@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Take n tokens and return how many were given
+func allowMany(rl *RateLimiter, from peer.ID, p protocol.ID, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := rl.allow(from, p); ok {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+// Buckets start full, get rate tokens per second and never hold more than burst
+func TestRateLimiterRefill(t *testing.T) {
+	old_clock := clock
+	vc := NewVirtualClock(clock_start)
+	clock = vc
+	defer func() { clock = old_clock }()
+
+	limits, err := parseRateLimits("nab=2:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimiter()
+	rl.setLimits(limits, false)
+	a, b := peer.ID("a"), peer.ID("b")
+
+	steps := []struct {
+		after		time.Duration	// Time since the last step
+		from		peer.ID
+		asked		int
+		allowed		int
+	}{
+		{0, a, 5, 3},							// Full bucket: burst
+		{500 * time.Millisecond, a, 2, 1},		// 2 tokens per second
+		{250 * time.Millisecond, a, 1, 0},		// Half a token is not enough
+		{250 * time.Millisecond, a, 1, 1},		// The two halves make a token
+		{time.Minute, a, 5, 3},					// No more than burst however long the wait
+		{0, b, 5, 3},							// Each peer has its own bucket
+	}
+	for i, step := range steps {
+		vc.Sleep(context.Background(), step.after)
+		if got := allowMany(rl, step.from, PROTOCOL_NAB, step.asked); got != step.allowed {
+			t.Errorf("step %d: %d messages of %d allowed, expected %d", i, got, step.asked, step.allowed)
+		}
+	}
+
+	// Messages over the limit are counted by peer, and other protocols are not limited
+	if ok, limited := rl.allow(a, PROTOCOL_NAB); ok || limited != 7 {
+		t.Errorf("over the limit: allowed %v, %d messages limited, expected false, 7", ok, limited)
+	}
+	if got := allowMany(rl, a, PROTOCOL_CRC, 100); got != 100 {
+		t.Errorf("%d messages of %d allowed on a protocol without a limit", got, 100)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+	REWIRING
+	The master can change a single link between two nodes while the experiment runs:
+		-master LINK CUT A B				the link goes down, as in a partition
+		-master LINK RESTORE A B			the link comes back
+		-master LINK ADD A B [TRUTH]		a new link is made
+		-master LINK REMOVE A B [TRUTH]		the link is taken away
+	A and B are labels known by the master, or node addresses. The master sends the change to both ends,
+	that apply it the same way: a link that goes down is closed, removed from cTop, forgotten by the failure detector
+	and refused by the gate (see gater.go); a link that comes up is let through the gate, dialled and added to cTop.
+	Only the end with the lower address dials, retrying while the other end has not opened its gate yet.
+	With TRUTH, ADD and REMOVE change the topology of the file too, on both ends and on the master.
+	The file is never rewritten: the change is kept in memory and applied by loadTopologyGraph,
+	so it holds for the next TOPLOAD and RESET. The other changes are healed by RESET.
+*/
+
+// Check whether a link change takes the link down
+func linkGoesDown(op string) bool {
+	return op == mst_link_cut || op == mst_link_remove
+}
+
+// Address of a node given by label or by address. "" if the label is not known
+func (n *Node) resolveNode(node string) string {
+	if strings.Contains(node, "/p2p/") {
+		return node
+	}
+	address, _ := n.getLabel(node)
+	return address
+}
+
+// Change the link between two nodes: LINK OP A B [TRUTH]
+func sendLinkChange(ctx context.Context, thisNode *Node, m Message, args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return fmt.Errorf("use -master %s %s|%s|%s|%s A B [%s]", mst_link, mst_link_cut, mst_link_restore, mst_link_add, mst_link_remove, mst_link_truth)
+	}
+	op := args[0]
+	switch op {
+	case mst_link_cut, mst_link_restore, mst_link_add, mst_link_remove:
+	default:
+		return fmt.Errorf("unknown link change %s: use %s, %s, %s or %s", op, mst_link_cut, mst_link_restore, mst_link_add, mst_link_remove)
+	}
+	truth := len(args) == 4
+	if truth && (args[3] != mst_link_truth || op == mst_link_cut || op == mst_link_restore) {
+		return fmt.Errorf("only %s and %s can change the topology of the file, with %s", mst_link_add, mst_link_remove, mst_link_truth)
+	}
+	a, b := thisNode.resolveNode(args[1]), thisNode.resolveNode(args[2])
+	if a == "" || b == "" || a == b {
+		return fmt.Errorf("unknown nodes %s and %s", args[1], args[2])
+	}
+
+	if truth {
+		thisNode.rewire(a, b, !linkGoesDown(op))
+	}
+	m.Type = mst_link
+	m.Content = strings.Join(append([]string{op}, args[3:]...), " ")
+	// The end that dials is told last, so that the other end is likely to have opened its gate
+	if a < b {
+		a, b = b, a
+	}
+	for _, end := range [][2]string{{a, b}, {b, a}} {
+		p, err := peer.Decode(extractPeerIDFromMultiaddr(end[0]))
+		if err != nil {
+			return err
+		}
+		m.Target = end[1]
+		send(ctx, thisNode, p, m, PROTOCOL_MST)
+	}
+	event := fmt.Sprintf("link - %s of the link %s-%s sent to both ends", m.Content, args[1], args[2])
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	return nil
+}
+
+// Apply a change of the link with the node m.Target, sent by the master
+func receiveLinkChange(ctx context.Context, m Message, thisNode *Node, topology *Topology) error {
+	fields := strings.Fields(m.Content)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty link change from the master")
+	}
+	op := fields[0]
+	other := m.Target
+	p, err := peer.Decode(extractPeerIDFromMultiaddr(other))
+	if err != nil {
+		return fmt.Errorf("invalid end of the link %s: %v", other, err)
+	}
+	if len(fields) == 2 && fields[1] == mst_link_truth {
+		thisNode.rewire(thisNode.address, other, !linkGoesDown(op))
+	}
+
+	if linkGoesDown(op) {
+		thisNode.gatePeer(p, false)
+		explorer2Mutex.Lock()
+		topology.ctop.RemoveNeighbour(thisNode.address, other)
+		explorer2Mutex.Unlock()
+		thisNode.detector.forget(other)
+		thisNode.Network().ClosePeer(p)
+	} else {
+		thisNode.gatePeer(p, true)
+		if thisNode.address < other {
+			err = thisNode.dialLink(ctx, other)
+			if err != nil {
+				return err
+			}
+		}
+		explorer2Mutex.Lock()
+		topology.ctop.AddNeighbour(thisNode.address, other)
+		explorer2Mutex.Unlock()
+	}
+
+	event := fmt.Sprintf("link - %s of the link with %s", m.Content, addressToPrint(other, NODE_PRINTLAST))
+	logEvent(thisNode.ID().String(), PRINTOPTION, event)
+	return nil
+}
+
+// Dial the other end of a link that comes up. The other end may still refuse it:
+// the dial is retried, skipping the backoff of the failed dials
+func (n *Node) dialLink(ctx context.Context, address string) error {
+	maddr, err := multiaddr.NewMultiaddr(address)
+	if err != nil {
+		return err
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return err
+	}
+	n.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	dial_ctx := network.WithForceDirectDial(ctx, "link restored by the master")
+	for attempt := 1; ; attempt++ {
+		err = n.Connect(dial_ctx, *info)
+		if err == nil || attempt == LINK_DIAL_ATTEMPTS {
+			return err
+		}
+		clock.Sleep(dial_ctx, LINK_DIAL_RETRY)
+	}
+}
+
+// Add or remove an edge of the topology of the file, between two addresses
+func (n *Node) rewire(a string, b string, added bool) {
+	n.labels_mu.Lock()
+	defer n.labels_mu.Unlock()
+	n.rewired[newLinkKey(a, b)] = added
+}
+
+// Apply the edges added and removed by rewire to a graph loaded from the file.
+// Must be called with n.labels_mu locked
+func (n *Node) applyRewiring(g *Graph) {
+	var keys []linkKey
+	for key := range n.rewired {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].a == keys[j].a {
+			return keys[i].b < keys[j].b
+		}
+		return keys[i].a < keys[j].a
+	})
+	for _, key := range keys {
+		if n.rewired[key] {
+			g.AddEdge(key.a, key.b)
+		} else {
+			g.RemoveEdge(key.a, key.b)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+/*
+	SCENARIO
+	A scenario is a text file run by the master, with one step per line:
+
+		# comment
+		wait 2s						-> wait for the given duration
+		master -master BYZ			-> run a command on the master's console
+		A -crc ROU @F				-> make node A run a command on its console
+
+	Commands are written as they would be typed on the console.
+	Nodes are addressed by their label in the topology file, and
+	@LABEL is replaced by the address of the node with that label.
+*/
+type ScenarioStep struct {
+	line		int			// Line of the step in the file
+	label		string		// SCN_MASTER, SCN_WAIT or the label of a node
+	command		string		// Command to run, or duration to wait
+}
+
+type Scenario struct {
+	path		string
+	steps		[]ScenarioStep
+}
+
+// Load a scenario from a file
+func LoadScenario(path string) (*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening scenario file: %v", err)
+	}
+	defer file.Close()
+
+	scenario := &Scenario{path: path}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		// Ignore empty lines and comments
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid scenario line %d: %s", line, text)
+		}
+		step := ScenarioStep{line: line, label: parts[0], command: strings.TrimSpace(parts[1])}
+		if step.label == SCN_WAIT {
+			if _, err := time.ParseDuration(step.command); err != nil {
+				return nil, fmt.Errorf("invalid duration at line %d: %v", line, err)
+			}
+		}
+		scenario.steps = append(scenario.steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading scenario file: %v", err)
+	}
+
+	return scenario, nil
+}
+
+// Position of the target address in the words of a command, -1 if the command has no target
+func targetPosition(words []string) int {
+	switch {
+	case len(words) > 1 && (words[0] == cmd_connect || words[0] == cmd_send || words[0] == cmd_broadcast):
+		return 1
+	case len(words) > 2 && words[0] == cmd_crc && words[1] == mod_crc_rou:
+		return 2
+	case len(words) > 3 && words[0] == cmd_crc && words[1] == mod_crc_cnt && words[2] == cmd_msg:
+		return 3
+	}
+	return -1
+}
+
+// Replace the target of the command, if given as @LABEL, with the address of the node with that label
+func resolveTarget(thisNode *Node, command string) (string, error) {
+	words := strings.Fields(command)
+	i := targetPosition(words)
+	if i < 0 || !strings.HasPrefix(words[i], "@") {
+		return command, nil
+	}
+	address, ok := thisNode.getLabel(words[i][1:])
+	if !ok {
+		return "", fmt.Errorf("unknown node %s", words[i][1:])
+	}
+
+	// Replace the word where it is, so that the spaces of the message are kept
+	start := 0
+	for j := 0; j < i; j++ {
+		start += strings.Index(command[start:], words[j]) + len(words[j])
+	}
+	start += strings.Index(command[start:], words[i])
+	return command[:start] + address + command[start+len(words[i]):], nil
+}
+
+// Run a scenario on the master, step by step, reporting the result of each step
+func runScenario(ctx context.Context, thisNode *Node, path string,
+	messageContainer *MessageContainer, deliveredMessages *MessageContainer, disjointPaths *DisjointPaths,
+	topology *Topology) {
+
+	scenario, err := LoadScenario(path)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	failed := 0
+	for i, step := range scenario.steps {
+		err := runScenarioStep(ctx, thisNode, step, messageContainer, deliveredMessages, disjointPaths, topology)
+
+		result := "OK"
+		if err != nil {
+			result = fmt.Sprintf("FAILED: %v", err)
+			failed++
+		}
+		fmt.Printf("%sStep %d/%d%s [line %d] %s %s - %s\n", color_info, i+1, len(scenario.steps), RESET, step.line, step.label, step.command, result)
+		event := fmt.Sprintf("scenario %s - step %d: %s %s - %s", path, i+1, step.label, step.command, result)
+		logEvent(thisNode.ID().String(), false, event)
+	}
+
+	fmt.Printf("Scenario %s done: %d steps, %d failed\n", path, len(scenario.steps), failed)
+	event := fmt.Sprintf("scenario %s - done: %d steps, %d failed", path, len(scenario.steps), failed)
+	logEvent(thisNode.ID().String(), false, event)
+}
+
+// Run a single step of a scenario
+func runScenarioStep(ctx context.Context, thisNode *Node, step ScenarioStep,
+	messageContainer *MessageContainer, deliveredMessages *MessageContainer, disjointPaths *DisjointPaths,
+	topology *Topology) error {
+
+	if step.label == SCN_WAIT {
+		d, _ := time.ParseDuration(step.command)
+		clock.Sleep(ctx, d)
+		return nil
+	}
+
+	command, err := resolveTarget(thisNode, step.command)
+	if err != nil {
+		return err
+	}
+
+	if step.label == SCN_MASTER {
+		return executeCommand(ctx, thisNode, command, messageContainer, deliveredMessages, disjointPaths, topology)
+	}
+
+	address, ok := thisNode.getLabel(step.label)
+	if !ok {
+		return fmt.Errorf("unknown node %s", step.label)
+	}
+	return sendCommand(ctx, thisNode, address, command)
+}
+
+// Make the node at address run a command on its console.
+// Return when the node answers with the result of the command, or after SCN_CMD_TIMEOUT
+func sendCommand(ctx context.Context, thisNode *Node, address string, command string) error {
+	target, err := peer.Decode(extractPeerIDFromMultiaddr(address))
+	if err != nil {
+		return err
+	}
+	if !containsPeer(thisNode.peers(), target) {
+		return fmt.Errorf("node %s is not connected", addressToPrint(address, NODE_PRINTLAST))
+	}
+
+	msgid := thisNode.newMessageID()
+	var m Message =
+	Message{
+		ID: msgid,
+		Type: mst_cmd,
+		Sender: thisNode.address,
+		Source: thisNode.address,
+		Target: address,
+		Content: command,
+		Neighbourhood: []string{},
+		Path: []string{},
+	}
+	answer := thisNode.expectCommand(msgid)
+	defer thisNode.forgetCommand(msgid)
+	send(ctx, thisNode, target, m, PROTOCOL_MST)
+
+	// Wait on the clock, so that on the virtual clock the other events keep running
+	if !clock.Wait(ctx, answer.done, SCN_CMD_TIMEOUT) {
+		return fmt.Errorf("node %s did not answer within %s", addressToPrint(address, NODE_PRINTLAST), SCN_CMD_TIMEOUT)
+	}
+	return answer.err
+}
+
+// Answer of a node to a command of a scenario
+type commandAnswer struct {
+	done	chan struct{}	// Closed when the answer arrives
+	err		error			// Error of the command, nil if it succeeded
+}
+
+// Wait for the answer to the command with the given ID
+func (n *Node) expectCommand(id string) *commandAnswer {
+	n.commands_mu.Lock()
+	defer n.commands_mu.Unlock()
+	answer := &commandAnswer{done: make(chan struct{})}
+	n.commands[id] = answer
+	return answer
+}
+
+func (n *Node) forgetCommand(id string) {
+	n.commands_mu.Lock()
+	defer n.commands_mu.Unlock()
+	delete(n.commands, id)
+}
+
+// Give the answer of a node to the command waiting for it, if any.
+// result is the error of the command, "" if it succeeded
+func (n *Node) commandDone(id string, result string) {
+	n.commands_mu.Lock()
+	defer n.commands_mu.Unlock()
+	answer, ok := n.commands[id]
+	if !ok {
+		return
+	}
+	delete(n.commands, id)
+	if result != "" {
+		answer.err = errors.New(result)
+	}
+	close(answer.done)
+}
+
+// Check whether a peer is in the list
+func containsPeer(peers []peer.ID, target peer.ID) bool {
+	for _, p := range peers {
+		if p == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+// Only the target of a command is resolved, and the rest of the command is kept as it is
+func TestResolveTarget(t *testing.T) {
+	n := &Node{labels: map[string]string{"F": "/ip4/127.0.0.1/tcp/4006/p2p/F"}}
+	tests := []struct {
+		command		string
+		expected	string
+		fails		bool
+	}{
+		{"-crc ROU @F", "-crc ROU /ip4/127.0.0.1/tcp/4006/p2p/F", false},
+		{"-crc  SEND -msg   @F \"hi  @F\"", "-crc  SEND -msg   /ip4/127.0.0.1/tcp/4006/p2p/F \"hi  @F\"", false},
+		{"-broadcast all -msg \"mail @F\"", "-broadcast all -msg \"mail @F\"", false},
+		{"-send @G -msg \"hi\"", "", true},
+		{"-bdopt -msg @F", "-bdopt -msg @F", false},
+	}
+	for _, test := range tests {
+		got, err := resolveTarget(n, test.command)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: resolved to %q, expected an unknown node", test.command, got)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("%q: resolved to %q (%v), expected %q", test.command, got, err, test.expected)
+		}
+	}
+}
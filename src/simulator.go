@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+	SIMULATION
+	The whole network described by a topology file runs in this process,
+	on top of the libp2p mock network. Connections are made exactly as in the file,
+	plus a master node connected with every other node.
+	The console of the process is the console of the master node.
+
+	With the virtual clock the simulation is a discrete-event simulation:
+	nodes talk through a memory transport, so messages are not written on streams
+	but scheduled on the clock, SIM_LINK_DELAY after being sent.
+	The links of the memory transport follow the connections of the mock network.
+	Every command typed in the console
+	runs until there is nothing left to do. Node identities are generated
+	from their position in the topology file, so that the same topology
+	and the same commands always produce the same run.
+*/
+
+// A node running in the simulation, together with its own data structs
+type SimNode struct {
+	label				string
+	node				*Node
+	receivedMessages	*MessageContainer
+	deliveredMessages	*MessageContainer
+	sentMessages		*MessageContainer
+	disjointPaths		*DisjointPaths
+	topology			*Topology
+}
+
+type Simulation struct {
+	network		mocknet.Mocknet
+	master		*SimNode
+	nodes		map[string]*SimNode		// key: node label in the topology file
+	labels		[]string				// node labels, sorted
+	memory		*MemoryNetwork			// Network of the memory transports of the nodes, nil on the real clock
+}
+
+// Options of a simulation
+type SimulationConfig struct {
+	topology_file	string
+	clock			string		// SIM_CLOCK_REAL or SIM_CLOCK_VIRTUAL
+	seed			int64		// Seed of the run. If 0, it is read from BYZANTINE_CONFIG
+	encoding		string		// ENC_JSON or ENC_BINARY. If empty, ENC_JSON
+	links_file		string		// Links file emulating the links of the nodes, see links.go. "" if links are not emulated
+	nabopt			string		// Modifications of the DolevU broadcast, see parseOptimisations. If empty, OPT_NONE
+	bdopt			string		// Optimisations of the Bracha-Dolev reliable broadcast, see parseOptimisations. If empty, OPT_NONE
+}
+
+// Return a new SimNode wrapping the host h
+func newSimNode(h host.Host, label string) *SimNode {
+	return &SimNode{
+		label:				label,
+		node:				NewNode(h, getNodeAddress(h, ADDR_LOOPBACK)),
+		receivedMessages:	NewMessageContainer(),
+		deliveredMessages:	NewMessageContainer(),
+		sentMessages:		NewMessageContainer(),
+		disjointPaths:		NewDisjointPaths(),
+		topology:			NewTopology(),
+	}
+}
+
+// Create a mock host with an identity and an address that only depend on i
+func (sim *Simulation) addPeer(i int) (host.Host, error) {
+	sk, _, err := crypto.GenerateEd25519Key(rand.New(rand.NewSource(int64(i))))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", SIM_BASE_PORT+i))
+	if err != nil {
+		return nil, err
+	}
+	return sim.network.AddPeer(sk, addr)
+}
+
+// Create a simulation of the network described in the topology file.
+// Every node loads its neighbourhood from the file and is connected with its neighbours
+func NewSimulation(ctx context.Context, config SimulationConfig) (*Simulation, error) {
+	topology_file := config.topology_file
+	topology_graph := LoadGraphFromCSV(topology_file)
+
+	switch config.clock {
+	case SIM_CLOCK_REAL:
+		clock = realClock{}
+	case SIM_CLOCK_VIRTUAL:
+		clock = NewVirtualClock(time.Unix(0, 0).UTC())
+	default:
+		return nil, fmt.Errorf("unknown clock %s", config.clock)
+	}
+	if config.encoding == "" {
+		config.encoding = ENC_JSON
+	}
+	err := validEncoding(config.encoding)
+	if err != nil {
+		return nil, err
+	}
+	if config.nabopt == "" {
+		config.nabopt = OPT_NONE
+	}
+	nabopt_enabled, err := parseOptimisations(config.nabopt, NAB_OPTIMISATIONS)
+	if err != nil {
+		return nil, err
+	}
+	if config.bdopt == "" {
+		config.bdopt = OPT_NONE
+	}
+	bdopt_enabled, err := parseOptimisations(config.bdopt, BDOPT_OPTIMISATIONS)
+	if err != nil {
+		return nil, err
+	}
+	var link_table *LinkTable
+	if config.links_file != "" {
+		link_table, err = loadLinks(config.links_file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sim := &Simulation{
+		network:	mocknet.New(),
+		nodes:		make(map[string]*SimNode),
+	}
+	for label := range topology_graph.nodes {
+		sim.labels = append(sim.labels, label)
+	}
+	sort.Strings(sim.labels)
+
+	// Create the hosts
+	h, err := sim.addPeer(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create master node: %v", err)
+	}
+	sim.master = newSimNode(h, "MASTER")
+
+	labels := make(map[string]string)
+	for i, label := range sim.labels {
+		h, err := sim.addPeer(i+1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create node %s: %v", label, err)
+		}
+		sim.nodes[label] = newSimNode(h, label)
+		labels[label] = sim.nodes[label].node.address
+	}
+
+	// On the virtual clock, nodes talk through memory transports.
+	// A memory link can be used while both its ends are connected in the mock network:
+	// the end that closes a connection knows it at once, the other one a bit later
+	if config.clock == SIM_CLOCK_VIRTUAL {
+		sim.memory = NewMemoryNetwork(SIM_LINK_DELAY)
+		sim.memory.SetConnectionCheck(func(a peer.ID, b peer.ID) bool {
+			return sim.network.Net(a).Connectedness(b) == network.Connected &&
+				sim.network.Net(b).Connectedness(a) == network.Connected
+		})
+		for _, sn := range append([]*SimNode{sim.master}, sim.sortedNodes()...) {
+			sn.node.transport = sim.memory.NewTransport(sn.node.ID(), sn.node.address)
+		}
+	}
+	for _, sn := range append([]*SimNode{sim.master}, sim.sortedNodes()...) {
+		sn.node.transport.SetEncoding(config.encoding)
+	}
+
+	// Link the hosts: the master with everyone, and every pair of nodes, so that the master can add links
+	// (see rewiring.go). Nodes are only connected as in the topology file
+	for i, label := range sim.labels {
+		err := sim.link(sim.master, sim.nodes[label])
+		if err != nil {
+			return nil, fmt.Errorf("failed to link master with %s: %v", label, err)
+		}
+		for _, other := range sim.labels[i+1:] {
+			err := sim.link(sim.nodes[label], sim.nodes[other])
+			if err != nil {
+				return nil, fmt.Errorf("failed to link %s with %s: %v", label, other, err)
+			}
+		}
+	}
+
+	// All the nodes of the simulation share the seed of the run
+	seed := config.seed
+	if seed == 0 {
+		readSeed(BYZANTINE_CONFIG, &seed)
+	}
+
+	// Run the nodes. The master knows the nodes by their labels, to run scenarios
+	sim.master.node.labels = labels
+	sim.master.node.setSeed(seed)
+	sim.master.run(ctx)
+	for _, label := range sim.labels {
+		sn := sim.nodes[label]
+		sn.node.setSeed(seed)
+		sn.node.setLinks(link_table, label)
+		sn.node.dolevu.setOptimisations(nabopt_enabled)
+		sn.node.dolevu.setKnownTopology(true)
+		sn.node.bdopt.setOptimisations(bdopt_enabled)
+		sn.node.master_address = sim.master.node.address
+		sn.node.topology_path = topology_file
+		sn.node.labels = labels
+		readMaxByzantines(BYZANTINE_CONFIG, &sn.node.max_byzantines)
+		sn.run(ctx)
+
+		// Load the neighbourhood in cTop from the file
+		sn.node.loadNeighbourhood(sn.topology)
+	}
+
+	// Connect the nodes
+	for _, label := range sim.labels {
+		_, err := sim.network.ConnectPeers(sim.master.node.ID(), sim.nodes[label].node.ID())
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect master with %s: %v", label, err)
+		}
+		for _, neighbour := range topology_graph.GetNeighbors(label) {
+			if label > neighbour {
+				continue
+			}
+			_, err := sim.network.ConnectPeers(sim.nodes[label].node.ID(), sim.nodes[neighbour].node.ID())
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect %s with %s: %v", label, neighbour, err)
+			}
+		}
+	}
+
+	return sim, nil
+}
+
+// Set the stream handlers of the node
+func (sn *SimNode) run(ctx context.Context) {
+	setStreamHandlers(ctx, sn.node, sn.receivedMessages, sn.deliveredMessages, sn.sentMessages, sn.disjointPaths, sn.topology)
+}
+
+// Start the failure detectors of the master and of all the nodes
+func (sim *Simulation) startFailureDetectors(ctx context.Context, interval time.Duration) {
+	for _, sn := range append([]*SimNode{sim.master}, sim.sortedNodes()...) {
+		sn.node.startFailureDetector(ctx, interval)
+	}
+}
+
+// Stop the failure detectors of the master and of all the nodes.
+// On the virtual clock, heartbeats are events: they must stop for a run to end
+func (sim *Simulation) stopFailureDetectors() {
+	for _, sn := range append([]*SimNode{sim.master}, sim.sortedNodes()...) {
+		sn.node.stopFailureDetector()
+	}
+}
+
+// Link two nodes in the mock network and, on the virtual clock, in the memory network
+func (sim *Simulation) link(a *SimNode, b *SimNode) error {
+	_, err := sim.network.LinkPeers(a.node.ID(), b.node.ID())
+	if err != nil {
+		return err
+	}
+	if sim.memory != nil {
+		sim.memory.Link(a.node.ID(), b.node.ID())
+	}
+	return nil
+}
+
+// Get the nodes of the simulation, sorted by label
+func (sim *Simulation) sortedNodes() []*SimNode {
+	var nodes []*SimNode
+	for _, label := range sim.labels {
+		nodes = append(nodes, sim.nodes[label])
+	}
+	return nodes
+}
+
+// Get a node of the simulation from its label
+func (sim *Simulation) Get(label string) *SimNode {
+	return sim.nodes[label]
+}
+
+// Close all the nodes of the simulation
+func (sim *Simulation) Close() error {
+	return sim.network.Close()
+}
+
+// Print the nodes of the simulation with their addresses
+func (sim *Simulation) toString() string {
+	str := fmt.Sprintf("\n%s##### SIMULATED NETWORK #####%s\n", CYAN, RESET)
+	str += fmt.Sprintf("%sMASTER%s\t%s\n", color_info, RESET, sim.master.node.address)
+	for _, label := range sim.labels {
+		str += fmt.Sprintf("%s%s%s\t%s\n", color_info, label, RESET, sim.nodes[label].node.address)
+	}
+	str += fmt.Sprintf("%s#############################%s\n", CYAN, RESET)
+	return str
+}
+
+// Entry point of the "sim" subcommand.
+// Starts the simulation and gives the console of the master node to the user
+func runSimulation(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet(cmd_sim, flag.ExitOnError)
+	top := flags.String("topology", topology_path, "Topology .csv file of the simulated network")
+	clk := flags.String("clock", SIM_CLOCK_REAL, "Clock of the simulation: "+SIM_CLOCK_REAL+" or "+SIM_CLOCK_VIRTUAL)
+	scn := flags.String("scenario", "", "Scenario file to run on the master. The simulation ends with the scenario")
+	enc := flags.String("encoding", ENC_JSON, "Encoding of the messages: "+ENC_JSON+" or "+ENC_BINARY)
+	hb := flags.Duration("hb", 0, "Time between two heartbeats of the failure detectors. 0 to disable them")
+	links := flags.String("links", "", "Links file emulating latency, jitter, loss and bandwidth on the links of the nodes")
+	nabopt := flags.String("nabopt", OPT_NONE, "Modifications of the DolevU broadcast (/nab/): "+OPT_ALL+", "+OPT_NONE+" or NAME,...")
+	bdopt := flags.String("bdopt", OPT_NONE, "Optimisations of the Bracha-Dolev reliable broadcast: "+OPT_ALL+", "+OPT_NONE+" or NAME,...")
+	flags.Parse(args)
+
+	if *hb > 0 && *clk == SIM_CLOCK_VIRTUAL && *scn == "" {
+		log.Fatalf("Failed to start the simulation: on the virtual clock the failure detectors need a scenario, the console would wait for their heartbeats forever")
+	}
+
+	sim, err := NewSimulation(ctx, SimulationConfig{topology_file: *top, clock: *clk, encoding: *enc, links_file: *links, nabopt: *nabopt, bdopt: *bdopt})
+	if err != nil {
+		log.Fatalf("Failed to start the simulation: %v", err)
+	}
+	defer sim.Close()
+
+	master := sim.master
+	console_address = master.node.address
+	fmt.Print(sim.toString())
+	sim.startFailureDetectors(ctx, *hb)
+
+	if *scn != "" {
+		clock.Run(ctx, func(ctx context.Context) {
+			runScenario(ctx, master.node, *scn, master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+			sim.stopFailureDetectors()
+		})
+		return
+	}
+
+	printStartMessage(master.node, mod_help_mst)
+
+	manageConsoleInput(ctx, master.node, master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	SWEEP
+	Runs CombinedRC on many configurations of the simulated network, one after the other,
+	and writes one row of results for each run in a .csv file.
+	A configuration is a topology file, a number of byzantines, a placement of the
+	byzantines, a fault type and a seed. Every run is a discrete-event simulation
+	on the virtual clock, so every row can be replayed with the same configuration.
+
+	A run is made of two phases:
+	-	EXP: the master makes every node send its CRC EXP message (-master EXP)
+	-	CNT: every correct node routes (-crc ROU) and sends (-crc SEND) a message
+		to the next correct node, in label order
+*/
+type SweepRun struct {
+	topology_file	string
+	max_byzantines	int
+	placement		string		// SWP_PLACE_*
+	fault			string		// SWP_FAULT_* (byzantine Type1, Type2 or Type3)
+	alterations		string		// Alterations of Type3 byzantines
+	seed			int64
+}
+
+type SweepResult struct {
+	nodes			int
+	byzantines		[]string	// Labels of the byzantine nodes
+	exp_expected	int			// EXP messages of correct nodes that correct nodes should deliver
+	exp_delivered	int			// EXP messages of correct nodes delivered by correct nodes
+	cnt_expected	int			// CNT messages sent by correct nodes
+	cnt_received	int			// CNT messages received unaltered by their target
+	cnt_copies		int			// Copies of the CNT messages received by their targets
+	messages		int			// Messages exchanged by the nodes, master excluded
+	crc_messages	int			// CombinedRC messages exchanged by the nodes
+	exp_time		time.Duration	// Virtual time of the EXP phase
+	cnt_time		time.Duration	// Virtual time of the CNT phase
+	wall_time		time.Duration	// Wall time of the whole run
+}
+
+var sweep_header = []string{
+	"topology", "nodes", "max_byzantines", "placement", "fault", "alterations", "seed", "byzantines",
+	"exp_expected", "exp_delivered", "cnt_expected", "cnt_received", "cnt_copies",
+	"messages", "crc_messages", "exp_time_s", "cnt_time_s", "wall_time_s",
+}
+
+// Row of the .csv file of a run
+func (r SweepRun) toRecord(res SweepResult) []string {
+	return []string{
+		r.topology_file,
+		strconv.Itoa(res.nodes),
+		strconv.Itoa(r.max_byzantines),
+		r.placement,
+		r.fault,
+		r.alterations,
+		strconv.FormatInt(r.seed, 10),
+		strings.Join(res.byzantines, " "),
+		strconv.Itoa(res.exp_expected),
+		strconv.Itoa(res.exp_delivered),
+		strconv.Itoa(res.cnt_expected),
+		strconv.Itoa(res.cnt_received),
+		strconv.Itoa(res.cnt_copies),
+		strconv.Itoa(res.messages),
+		strconv.Itoa(res.crc_messages),
+		fmt.Sprintf("%f", res.exp_time.Seconds()),
+		fmt.Sprintf("%f", res.cnt_time.Seconds()),
+		fmt.Sprintf("%f", res.wall_time.Seconds()),
+	}
+}
+
+// Choose the labels of the byzantine nodes of a run
+func placeByzantines(sim *Simulation, run SweepRun) []string {
+	labels := append([]string{}, sim.labels...)
+	degree := func(label string) int {
+		sn := sim.nodes[label]
+		return len(sn.topology.ctop.GetNeighbourhood(sn.node.address))
+	}
+
+	switch run.placement {
+	case SWP_PLACE_RANDOM:
+		rng := rand.New(rand.NewSource(run.seed))
+		rng.Shuffle(len(labels), func(i, j int) { labels[i], labels[j] = labels[j], labels[i] })
+	case SWP_PLACE_MAXDEGREE:
+		sort.SliceStable(labels, func(i, j int) bool { return degree(labels[i]) > degree(labels[j]) })
+	case SWP_PLACE_MINDEGREE:
+		sort.SliceStable(labels, func(i, j int) bool { return degree(labels[i]) < degree(labels[j]) })
+	}
+
+	if run.max_byzantines < len(labels) {
+		labels = labels[:run.max_byzantines]
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Run a single configuration
+func runSweepConfiguration(ctx context.Context, run SweepRun, base Byzantine) (SweepResult, error) {
+	var res SweepResult
+	wall_start := time.Now()
+
+	sim, err := NewSimulation(ctx, SimulationConfig{topology_file: run.topology_file, clock: SIM_CLOCK_VIRTUAL, seed: run.seed})
+	if err != nil {
+		return res, err
+	}
+	defer sim.Close()
+	console_address = sim.master.node.address
+	res.nodes = len(sim.labels)
+
+	// Set up the byzantines
+	bz := base
+	bz.Type1 = run.fault == SWP_FAULT_DELAY
+	bz.Type2 = run.fault == SWP_FAULT_DROP
+	bz.Type3 = run.fault == SWP_FAULT_ALTER
+	bz.Alterations = run.alterations
+	sim.master.node.max_byzantines = run.max_byzantines
+	for _, sn := range sim.nodes {
+		sn.node.max_byzantines = run.max_byzantines
+	}
+	res.byzantines = placeByzantines(sim, run)
+	for _, label := range res.byzantines {
+		sim.nodes[label].node.bz = bz
+		sim.nodes[label].node.byzantine_status = true
+	}
+	var correct []*SimNode
+	for _, label := range sim.labels {
+		if !sim.nodes[label].node.byzantine_status {
+			correct = append(correct, sim.nodes[label])
+		}
+	}
+
+	// EXP phase
+	master := sim.master
+	exp_start := clock.Now()
+	clock.Run(ctx, func(ctx context.Context) {
+		executeCommand(ctx, master.node, fmt.Sprintf("%s %s", cmd_master, mst_crc_exp), master.receivedMessages, master.deliveredMessages, master.disjointPaths, master.topology)
+	})
+	res.exp_time = clock.Now().Sub(exp_start)
+
+	for _, sn := range correct {
+		for _, source := range correct {
+			if source == sn {
+				continue
+			}
+			res.exp_expected++
+			if deliveredFrom(sn.deliveredMessages, TYPE_CRC_EXP, source.node.address) {
+				res.exp_delivered++
+			}
+		}
+	}
+
+	// CNT phase. Messages are sent SWP_CNT_INTERVAL one from the other, so that each route is found before its message is sent
+	cnt_start := clock.Now()
+	if len(correct) > 1 {
+		clock.Run(ctx, func(ctx context.Context) {
+			for i, sn := range correct {
+				target := correct[(i+1)%len(correct)]
+				rou := fmt.Sprintf("%s %s %s", cmd_crc, mod_crc_rou, target.node.address)
+				cnt := fmt.Sprintf("%s %s %s %s \"sweep %d\"", cmd_crc, mod_crc_cnt, cmd_msg, target.node.address, i)
+				executeCommand(ctx, sn.node, rou, sn.receivedMessages, sn.deliveredMessages, sn.disjointPaths, sn.topology)
+				clock.Sleep(ctx, SWP_CNT_INTERVAL)
+				executeCommand(ctx, sn.node, cnt, sn.receivedMessages, sn.deliveredMessages, sn.disjointPaths, sn.topology)
+				clock.Sleep(ctx, SWP_CNT_INTERVAL)
+			}
+		})
+		for i, sn := range correct {
+			target := correct[(i+1)%len(correct)]
+			copies := receivedFrom(target.receivedMessages, sn.node.address, target.node.address, fmt.Sprintf("sweep %d", i))
+			res.cnt_expected++
+			res.cnt_copies += copies
+			if copies > 0 {
+				res.cnt_received++
+			}
+		}
+	}
+	res.cnt_time = clock.Now().Sub(cnt_start)
+
+	for protocol, n := range sim.memory.Delivered() {
+		if protocol != PROTOCOL_MST {
+			res.messages += n
+		}
+		if protocol == PROTOCOL_CRC {
+			res.crc_messages += n
+		}
+	}
+	res.wall_time = time.Since(wall_start)
+	return res, nil
+}
+
+// Check whether a message of type msg_type from source has been delivered
+func deliveredFrom(mc *MessageContainer, msg_type string, source string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, messages := range mc.messages {
+		for _, m := range messages {
+			if m.Type == msg_type && m.Source == source {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Count the copies of the CNT message from source to target with the given content
+func receivedFrom(mc *MessageContainer, source string, target string, content string) int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	copies := 0
+	for _, messages := range mc.messages {
+		for _, m := range messages {
+			if m.Type == TYPE_CRC_CNT && m.Source == source && m.Target == target && m.Content == content {
+				copies++
+			}
+		}
+	}
+	return copies
+}
+
+// Build the list of runs: every combination of the given values, repeated for each seed
+func sweepRuns(topologies []string, max_byzantines []int, placements []string, faults []string, alterations []string, seeds []int64) []SweepRun {
+	var runs []SweepRun
+	for _, top := range topologies {
+		for _, f := range max_byzantines {
+			for _, placement := range placements {
+				if f == 0 {
+					// Without byzantines faults make no difference
+					for _, seed := range seeds {
+						runs = append(runs, SweepRun{top, f, placement, "none", "none", seed})
+					}
+					continue
+				}
+				for _, fault := range faults {
+					fault_alterations := []string{"none"}
+					if fault == SWP_FAULT_ALTER {
+						fault_alterations = alterations
+					}
+					for _, alt := range fault_alterations {
+						for _, seed := range seeds {
+							runs = append(runs, SweepRun{top, f, placement, fault, alt, seed})
+						}
+					}
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// Split a comma separated list
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Entry point of the "sweep" subcommand
+func runSweep(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet(cmd_sweep, flag.ExitOnError)
+	tops := flags.String("topologies", topology_path, "Comma separated topology .csv files")
+	fs := flags.String("f", "0,1", "Comma separated values of MAX_BYZANTINES")
+	places := flags.String("placements", SWP_PLACE_RANDOM, "Comma separated byzantine placements: "+SWP_PLACE_RANDOM+", "+SWP_PLACE_MAXDEGREE+", "+SWP_PLACE_MINDEGREE)
+	faults := flags.String("faults", SWP_FAULT_DROP, "Comma separated byzantine types: "+SWP_FAULT_DELAY+", "+SWP_FAULT_DROP+", "+SWP_FAULT_ALTER)
+	alts := flags.String("alterations", BYZ_SWAP_PATH, "Comma separated alterations of Type3 byzantines")
+	seed := flags.Int64("seed", 1, "Seed of the first run")
+	repeat := flags.Int("runs", 1, "Number of runs of each configuration, with seeds seed, seed+1, ...")
+	out := flags.String("out", SWP_OUTPUT, "Output .csv file")
+	flags.Parse(args)
+
+	var max_byzantines []int
+	for _, v := range splitList(*fs) {
+		f, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid value of f: %v", err)
+		}
+		max_byzantines = append(max_byzantines, f)
+	}
+	var seeds []int64
+	for i := 0; i < *repeat; i++ {
+		seeds = append(seeds, *seed+int64(i))
+	}
+
+	// Delay and DropRate of the byzantines come from the config file
+	base, err := LoadByzantineConfig(BYZANTINE_CONFIG)
+	if err != nil {
+		log.Fatalf("Failed to load byzantine config: %v", err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create results file: %v", err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write(sweep_header)
+	writer.Flush()
+
+	runs := sweepRuns(splitList(*tops), max_byzantines, splitList(*places), splitList(*faults), splitList(*alts), seeds)
+	for i, run := range runs {
+		res, err := runSweepConfiguration(ctx, run, base)
+		if err != nil {
+			fmt.Printf("Run %d/%d failed: %v\n", i+1, len(runs), err)
+			continue
+		}
+		// Rows are written as soon as they are ready, so that an interrupted sweep keeps its results
+		writer.Write(run.toRecord(res))
+		writer.Flush()
+		fmt.Printf("%sRun %d/%d%s %s f=%d %s %s %s seed=%d - EXP %d/%d, CNT %d/%d\n", color_info, i+1, len(runs), RESET,
+			run.topology_file, run.max_byzantines, run.placement, run.fault, run.alterations, run.seed,
+			res.exp_delivered, res.exp_expected, res.cnt_received, res.cnt_expected)
+	}
+	fmt.Printf("Results written in %s\n", *out)
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"math/rand"
-	"time"
+	"sort"
 )
 
 /*
@@ -74,6 +74,18 @@ func (ctop CTop) AddNeighbour(node string, neighbour string) {
 	ctop.tuples[node] = append(ctop.tuples[node], neighbour)
 }
 
+// Remove a node neighbour from the neighbourhood of node node.
+// The neighbourhood is copied, since messages may hold the old one
+func (ctop CTop) RemoveNeighbour(node string, neighbour string) {
+	neighbours := make([]string, 0, len(ctop.tuples[node]))
+	for _, n := range ctop.tuples[node] {
+		if n != neighbour {
+			neighbours = append(neighbours, n)
+		}
+	}
+	ctop.tuples[node] = neighbours
+}
+
 // Add a neighbourhood to the neighbourhood of node node
 func (top CTop) AddNeighbourhood(node string, neighbours []string) {
 	// substitute the neighbourhood of the node with the new one
@@ -124,7 +136,8 @@ func ConvertCTopToGraph(ctop *CTop) *Graph {
 
 // CTop to Graph conversion with Byzantine fault tolerance
 // Ref @ `Tractable Reliable Communication in Compromised Networks, Giovanni Farina` - cpt. 9.4 - Explorer2 - pg 78 
-func exp2_ConvertCTopToGraph(top *Topology, autoRec bool) *Graph {
+// max_byzantines is the number f of byzantines tolerated by the node building the graph
+func exp2_ConvertCTopToGraph(top *Topology, autoRec bool, max_byzantines int) *Graph {
     graph := NewGraph()
     vertices := make(map[string]bool)
 
@@ -152,7 +165,7 @@ func exp2_ConvertCTopToGraph(top *Topology, autoRec bool) *Graph {
                     count++
                 }
             }
-            if count > MAX_BYZANTINES {
+            if count > max_byzantines {
                 vertices[neighbour] = true
             }
         }
@@ -160,8 +173,14 @@ func exp2_ConvertCTopToGraph(top *Topology, autoRec bool) *Graph {
 
 	// Rule 3: ∀<v, Γ(v)> ∈ cTopi, u ∈ Γ(v), u ∈ Vi ⇒ ∃(v, u) ∈ Ei
 	// Rule 3: An edge (v, u) is added in Ei if both nodes are in Vi and v declares u in its neighbourhood
-    for node, neighbours := range top.ctop.tuples {
-        for _, neighbour := range neighbours {
+	// Nodes are taken in order, so that the same cTop always gives the same graph
+	var nodes []string
+	for node := range top.ctop.tuples {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+    for _, node := range nodes {
+        for _, neighbour := range top.ctop.tuples[node] {
             if vertices[node] && vertices[neighbour] {
                 graph.AddEdge(node, neighbour)
             }
@@ -172,8 +191,8 @@ func exp2_ConvertCTopToGraph(top *Topology, autoRec bool) *Graph {
 }
 
 // Convert CTop to Graph
-func generateGraph(top *Topology, autoRecognizeNeighbours bool) *Graph {
-	return exp2_ConvertCTopToGraph(top, autoRecognizeNeighbours)
+func generateGraph(top *Topology, autoRecognizeNeighbours bool, max_byzantines int) *Graph {
+	return exp2_ConvertCTopToGraph(top, autoRecognizeNeighbours, max_byzantines)
 	
 }
 
@@ -381,12 +400,11 @@ func Intersect(a []string, b []string) []string {
 
 // GetRandomNeighbour returns a random neighbour of this node from the topology.
 // Returns an empty string if the node has no neighbours.
-func (top *Topology) GetRandomNeighbour() string {
+func (top *Topology) GetRandomNeighbour(rng *rand.Rand) string {
     neighbours := top.ctop.GetNeighbourhood(top.nodeID)
     if len(neighbours) == 0 {
         return ""
     }
-    rand.Seed(time.Now().UnixNano())
-    idx := rand.Intn(len(neighbours))
+    idx := rng.Intn(len(neighbours))
     return neighbours[idx]
 }
\ No newline at end of file
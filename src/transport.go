@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	TRANSPORT
+	What the protocols need from the network: who this node is, who its neighbours are,
+	how to send a message to one of them and how to be given the messages of a protocol.
+	Protocols only talk to the network through the transport of their node,
+	so they can run on libp2p streams or in memory (see memory_transport.go)
+*/
+type Transport interface {
+	ID() peer.ID												// Identity of this node
+	Address() string											// Full multiaddress of this node, "<ADDRESS>/p2p/<PEER_ID>"
+	Neighbours() []peer.ID										// Peers connected to this node, sorted by ID
+	Send(ctx context.Context, target peer.ID, protocol protocol.ID, m Message) error
+	SetHandler(protocol protocol.ID, handler peerMessageHandler)	// Give the messages of the protocol to the handler
+	SetEncoding(encoding string)								// Encoding of the messages sent, ENC_JSON or ENC_BINARY
+	Encoding() string
+}
+
+// Function handling an incoming message of a protocol.
+// On the virtual clock, ctx is the context of the event handling the message (see clock.go)
+type messageHandler func(ctx context.Context, m Message) error
+
+// Function handling an incoming message of a protocol, told by the transport which peer sent it.
+// Unlike m.Sender, the peer cannot be forged
+type peerMessageHandler func(ctx context.Context, from peer.ID, m Message) error
+
+/*
+	LIBP2P TRANSPORT
+	Each node keeps one long-lived stream for each peer and protocol, opened on the first message
+	and reopened only when a write fails. Many goroutines may send on the same stream,
+	so writes are serialized by the lock of the stream.
+	Messages are written as frames: the length of the encoded message on 4 bytes (big endian),
+	then the message itself, encoded as json or in binary (see encoding.go).
+	Streams are accepted for any version of a protocol compatible with the one of this node,
+	and opened on a version that the peer advertises, if it is compatible (see versions.go).
+*/
+type libp2pTransport struct {
+	host		host.Host
+	address		string
+	mu			sync.Mutex
+	streams		map[streamKey]*outStream		// Outgoing streams of this node
+	mismatches	map[streamKey]bool				// Peers and protocols whose version mismatch has been logged
+	encoding	string							// Encoding of the messages sent by this node
+}
+
+// An outgoing stream is identified by the peer and the protocol
+type streamKey struct {
+	peer		peer.ID
+	protocol	protocol.ID
+}
+
+type outStream struct {
+	mu			sync.Mutex			// Held while opening the stream or writing a frame on it
+	stream		network.Stream		// nil until opened, and after a failure
+}
+
+// Return a new transport on the libp2p host h, reachable at address
+func newLibp2pTransport(h host.Host, address string) *libp2pTransport {
+	t := &libp2pTransport{
+		host:		h,
+		address:	address,
+		streams:	make(map[streamKey]*outStream),
+		mismatches:	make(map[streamKey]bool),
+		encoding:	ENC_JSON,
+	}
+
+	// Forget the streams of a peer once it is disconnected
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				t.closeStreams(c.RemotePeer())
+			}
+		},
+	})
+	return t
+}
+
+func (t *libp2pTransport) ID() peer.ID {
+	return t.host.ID()
+}
+
+func (t *libp2pTransport) Address() string {
+	return t.address
+}
+
+func (t *libp2pTransport) Neighbours() []peer.ID {
+	peers := t.host.Network().Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// A failed write may be due to a stream that the peer has closed,
+// so the stream is reopened and the message written once more
+func (t *libp2pTransport) Send(ctx context.Context, target peer.ID, protocol protocol.ID, m Message) error {
+	t.mu.Lock()
+	encoding := t.encoding
+	t.mu.Unlock()
+	dataBytes, err := encodeMessage(m, encoding)
+	if err != nil {
+		return err
+	}
+
+	out := t.getStream(target, protocol)
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if out.stream == nil {
+			out.stream, err = t.openStream(ctx, target, protocol)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeFrame(out.stream, dataBytes)
+		if err == nil {
+			return nil
+		}
+		out.stream.Reset()
+		out.stream = nil
+	}
+	return fmt.Errorf("failed to write message on stream: %w", err)
+}
+
+// Messages arriving on a stream are read one frame at a time, until the stream is closed,
+// and given to the handler in the order they were sent.
+// The handler should return quickly (see worker_pool.go): the stream is not read while it runs
+func (t *libp2pTransport) SetHandler(proto protocol.ID, handler peerMessageHandler) {
+	match := func(p protocol.ID) bool { return compatibleProtocols(p, proto) }
+	t.host.SetStreamHandlerMatch(proto, match, func(s network.Stream) {
+		for {
+			data, err := readFrame(s)
+			if err == io.EOF {
+				s.Close()
+				return
+			}
+			if err != nil {
+				s.Reset()
+				return
+			}
+			m, err := decodeMessage(data)
+			if err != nil {
+				printError(err) // Frames are still in place, go on with the next message
+				continue
+			}
+			err = handler(context.Background(), s.Conn().RemotePeer(), m)
+			if err != nil {
+				printError(err)
+			}
+		}
+	})
+}
+
+func (t *libp2pTransport) SetEncoding(encoding string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encoding = encoding
+}
+
+func (t *libp2pTransport) Encoding() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.encoding
+}
+
+// Open a stream to the peer on the protocol, or on a compatible version of it that the peer advertises.
+// Peers that only advertise incompatible versions are refused
+func (t *libp2pTransport) openStream(ctx context.Context, target peer.ID, proto protocol.ID) (network.Stream, error) {
+	peer_protocols, err := t.host.Peerstore().GetProtocols(target)
+	if err != nil {
+		return nil, err
+	}
+	compatible, incompatible := matchProtocols(proto, peer_protocols)
+	if len(compatible) == 0 && len(incompatible) > 0 {
+		err := fmt.Errorf("peer %s speaks %v, not compatible with %s", addressToPrint(target.String(), NODE_PRINTLAST), incompatible, proto)
+		t.logMismatch(target, proto, err)
+		return nil, err
+	}
+	return openStream(ctx, t.host, target, append([]protocol.ID{proto}, compatible...)...)
+}
+
+// Log a version mismatch with a peer, only the first time it is found
+func (t *libp2pTransport) logMismatch(target peer.ID, protocol protocol.ID, err error) {
+	t.mu.Lock()
+	key := streamKey{peer: target, protocol: protocol}
+	logged := t.mismatches[key]
+	t.mismatches[key] = true
+	t.mu.Unlock()
+
+	if !logged {
+		event := fmt.Sprintf("version - %v", err)
+		logEvent(t.host.ID().String(), PRINTOPTION, event)
+	}
+}
+
+// Get the outgoing stream to the peer for the protocol, creating it if needed
+func (t *libp2pTransport) getStream(target peer.ID, protocol protocol.ID) *outStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := streamKey{peer: target, protocol: protocol}
+	out, ok := t.streams[key]
+	if !ok {
+		out = &outStream{}
+		t.streams[key] = out
+	}
+	return out
+}
+
+// Close all the outgoing streams to the peer
+func (t *libp2pTransport) closeStreams(target peer.ID) {
+	t.mu.Lock()
+	var closing []*outStream
+	for key, out := range t.streams {
+		if key.peer == target {
+			closing = append(closing, out)
+			delete(t.streams, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, out := range closing {
+		out.mu.Lock()
+		if out.stream != nil {
+			out.stream.Close()
+			out.stream = nil
+		}
+		out.mu.Unlock()
+	}
+}
+
+// Write a frame on a stream
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read a frame from a stream
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > FRAME_MAX_SIZE {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
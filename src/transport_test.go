@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// Header of a frame of size bytes
+func frameHeader(size uint32) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, size)
+	return header
+}
+
+// Reader of endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// Frames written one after the other are read back the same, even one byte at a time
+func TestFrameRoundtrip(t *testing.T) {
+	frames := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xab}, 70000), {ENC_BINARY_MAGIC, 0}}
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		if err := writeFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range []io.Reader{bytes.NewReader(buf.Bytes()), iotest.OneByteReader(bytes.NewReader(buf.Bytes())), iotest.HalfReader(bytes.NewReader(buf.Bytes()))} {
+		for i, frame := range frames {
+			data, err := readFrame(r)
+			if err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+			if !bytes.Equal(data, frame) {
+				t.Fatalf("frame %d: read %d bytes, expected %d", i, len(data), len(frame))
+			}
+		}
+		if _, err := readFrame(r); err != io.EOF {
+			t.Fatalf("read after the last frame: %v, expected EOF", err)
+		}
+	}
+}
+
+// Frames cut in the middle are errors, and not the end of the stream
+func TestFrameTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+	for n := 1; n < len(full); n++ {
+		_, err := readFrame(iotest.OneByteReader(bytes.NewReader(full[:n])))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("frame cut after %d bytes of %d: %v, expected %v", n, len(full), err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// Frames larger than FRAME_MAX_SIZE are refused before being read
+func TestFrameMaxSize(t *testing.T) {
+	r := io.MultiReader(bytes.NewReader(frameHeader(FRAME_MAX_SIZE)), io.LimitReader(zeroReader{}, FRAME_MAX_SIZE))
+	data, err := readFrame(r)
+	if err != nil || len(data) != FRAME_MAX_SIZE {
+		t.Fatalf("frame of FRAME_MAX_SIZE bytes: %d bytes read, %v", len(data), err)
+	}
+
+	for _, size := range []uint32{FRAME_MAX_SIZE + 1, 1<<32 - 1} {
+		r := iotest.ErrReader(errors.New("frame body read"))
+		_, err := readFrame(io.MultiReader(bytes.NewReader(frameHeader(size)), r))
+		if err == nil || errors.Is(err, io.ErrUnexpectedEOF) || err.Error() == "frame body read" {
+			t.Errorf("frame of %d bytes: %v, expected to be refused", size, err)
+		}
+	}
+}
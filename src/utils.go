@@ -2,14 +2,15 @@ package main
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 
-	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
@@ -90,7 +91,7 @@ func logEvent(nodeID string, printoption bool, event string) {
 	defer f.Close()
 
 	// Format the log entry
-	timestamp := time.Now().Format("15:04:05.00000")
+	timestamp := clock.Now().Format("15:04:05.00000")
 	logMessage := fmt.Sprintf("[%s] [%s] %s\n", timestamp, nodeID, event)
 
 	// Write log entry to file
@@ -135,10 +136,7 @@ func saveReceivedLog(m Message) error {
 }
 
 // Save the content of a Message as topology file
-func saveReceivedTop(m Message) error {
-    // Prepare the filename using the source (sanitize if needed)
-	filename := topology_path
-
+func saveReceivedTop(m Message, filename string) error {
     // Write the content to the file
     f, err := os.Create(filename)
     if err != nil {
@@ -154,26 +152,106 @@ func saveReceivedTop(m Message) error {
     return nil
 }
 
+// Save the state of the node listed in states (comma separated PERSIST_* values) when the node shuts down.
+// Files are written in the logs directory, named after the node
+func persistState(h *Node, states string, topology *Topology, deliveredMessages *MessageContainer) error {
+	nodeID := addressToPrint(h.ID().String(), NODE_PRINTLAST)
+	for _, state := range strings.Split(states, ",") {
+		switch state {
+		case "":
+		case PERSIST_CTOP:
+			filename := filepath.Join(LOGDIR, fmt.Sprintf("ctop_%s.csv", nodeID))
+			h.onShutdown(filename, func() error {
+				explorer2Mutex.Lock()
+				defer explorer2Mutex.Unlock()
+				return saveCTop(&topology.ctop, filename)
+			})
+		case PERSIST_DELIVERED:
+			filename := filepath.Join(LOGDIR, fmt.Sprintf("delivered_%s.json", nodeID))
+			h.onShutdown(filename, func() error {
+				return saveMessages(deliveredMessages, filename)
+			})
+		default:
+			return fmt.Errorf("unknown state %s: use %s or %s", state, PERSIST_CTOP, PERSIST_DELIVERED)
+		}
+	}
+	return nil
+}
+
+// Save a cTop as a topology file, that can be loaded back with -t
+func saveCTop(ctop *CTop, filename string) error {
+	var nodes []string
+	width := 2
+	for node, neighbours := range ctop.tuples {
+		nodes = append(nodes, node)
+		if len(neighbours)+1 > width {
+			width = len(neighbours) + 1
+		}
+	}
+	sort.Strings(nodes)
+
+	// Every row has the same number of cells, as in the topology files
+	row := func(cells ...string) []string {
+		return append(cells, make([]string, width-len(cells))...)
+	}
+	rows := [][]string{row("NODE", "NEIGHBOURS")}
+	for _, node := range nodes {
+		rows = append(rows, row(append([]string{node}, ctop.tuples[node]...)...))
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return csv.NewWriter(f).WriteAll(rows)
+}
+
+// Save all the messages of a container as a json array, sorted by ID
+func saveMessages(mc *MessageContainer, filename string) error {
+	mc.mu.Lock()
+	var ids []string
+	for id := range mc.messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	messages := []Message{}
+	for _, id := range ids {
+		messages = append(messages, mc.messages[id]...)
+	}
+	data, err := json.MarshalIndent(messages, "", "\t")
+	mc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
 // Reset all the data structures and byzantines
-func totalReset(h host.Host, messageContainer *MessageContainer, deliveredMessages *MessageContainer, disjointPaths *DisjointPaths, topology *Topology) {
+func totalReset(h *Node, messageContainer *MessageContainer, deliveredMessages *MessageContainer, disjointPaths *DisjointPaths, topology *Topology) {
 
 	// Reset data structs
 	messageContainer.Reset()
 	deliveredMessages.Reset()
 	disjointPaths.Reset()
 	topology.Reset()
+	h.bracha.Reset()
+	h.bdopt.Reset()
+	h.dolevu.Reset()
 
 	// Reset byzantine status
-	if byzantine_status {
+	if h.byzantine_status {
 		event := fmt.Sprintf("byzantine - Node %s is no more a byzantine", addressToPrint(h.ID().String(), NODE_PRINTLAST))
 		logEvent(h.ID().String(), PRINTOPTION, event)
-		color_info = GREEN
+		if h.address == console_address {
+			color_info = GREEN
+		}
 	}
-	byzantine_status = false
+	h.byzantine_status = false
 
 
 	// Parse master_address as multiaddr and get peer info
-    maddr, err := multiaddr.NewMultiaddr(master_address)
+    maddr, err := multiaddr.NewMultiaddr(h.master_address)
     if err != nil {
         printError(err)
     }
@@ -196,4 +274,43 @@ func totalReset(h host.Host, messageContainer *MessageContainer, deliveredMessag
     }
 
 	fmt.Println("Node reset: DONE")
-}
\ No newline at end of file
+}
+
+// Parse the optimisations of a protocol written as "NAME,NAME,...", "all" or "none".
+// known are the optimisations of the protocol
+func parseOptimisations(spec string, known []string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	for _, opt := range known {
+		enabled[opt] = spec == OPT_ALL
+	}
+	if spec == OPT_ALL || spec == OPT_NONE || spec == "" {
+		return enabled, nil
+	}
+	for _, opt := range strings.Split(spec, ",") {
+		if _, ok := enabled[opt]; !ok {
+			return nil, fmt.Errorf("unknown optimisation %q: use %s, %s or %s", opt, strings.Join(known, ","), OPT_ALL, OPT_NONE)
+		}
+		enabled[opt] = true
+	}
+	return enabled, nil
+}
+
+// Print the optimisations of a protocol switched on, and the ones switched off
+func printOptimisations(enabled map[string]bool, known []string) {
+	var on, off []string
+	for _, opt := range known {
+		if enabled[opt] {
+			on = append(on, opt)
+		} else {
+			off = append(off, opt)
+		}
+	}
+	if len(on) == 0 {
+		fmt.Printf("	None\n")
+		return
+	}
+	fmt.Printf("	On:	%s\n", strings.Join(on, ", "))
+	if len(off) > 0 {
+		fmt.Printf("	Off:	%s\n", strings.Join(off, ", "))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseOptimisations(t *testing.T) {
+	tests := []struct {
+		spec	string
+		want	[]string	// Optimisations switched on
+		err		bool
+	}{
+		{"", nil, false},
+		{OPT_NONE, nil, false},
+		{OPT_ALL, NAB_OPTIMISATIONS, false},
+		{NAB_STOP, []string{NAB_STOP}, false},
+		{NAB_EMPTY + "," + NAB_SKIP, []string{NAB_EMPTY, NAB_SKIP}, false},
+		{NAB_SKIP + "," + NAB_SKIP, []string{NAB_SKIP}, false},
+		{"fast", nil, true},
+		{NAB_STOP + ",", nil, true},
+		{NAB_EMPTY + "," + OPT_ALL, nil, true},
+		{BDOPT_DIRECT, nil, true},	// An optimisation of another protocol
+	}
+	for _, test := range tests {
+		enabled, err := parseOptimisations(test.spec, NAB_OPTIMISATIONS)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseOptimisations(%q): no error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseOptimisations(%q): %v", test.spec, err)
+			continue
+		}
+		if len(enabled) != len(NAB_OPTIMISATIONS) {
+			t.Errorf("parseOptimisations(%q) = %v, expected every optimisation of the protocol", test.spec, enabled)
+		}
+		on := make(map[string]bool)
+		for _, opt := range test.want {
+			on[opt] = true
+		}
+		for _, opt := range NAB_OPTIMISATIONS {
+			if enabled[opt] != on[opt] {
+				t.Errorf("parseOptimisations(%q): %s is %v, expected %v", test.spec, opt, enabled[opt], on[opt])
+			}
+		}
+	}
+}
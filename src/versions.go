@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	PROTOCOL VERSIONS
+	Protocol IDs are "/argo/<NAME>/<MAJOR.MINOR.PATCH>" and every message carries
+	the version of the protocol it was sent on.
+	Two versions of the same protocol are compatible when they have the same major version:
+	a node accepts streams and messages of any compatible version, and refuses the others.
+	Supported protocols are advertised to the peers by libp2p (identify) and shown by -info.
+*/
+
+// Name of a protocol, without the version: "/argo/crc/1.0.0" -> "/argo/crc"
+func protocolName(p protocol.ID) string {
+	i := strings.LastIndex(string(p), "/")
+	if i < 0 {
+		return string(p)
+	}
+	return string(p)[:i]
+}
+
+// Version of a protocol: "/argo/crc/1.0.0" -> "1.0.0"
+func protocolVersion(p protocol.ID) string {
+	i := strings.LastIndex(string(p), "/")
+	return string(p)[i+1:]
+}
+
+// Major number of a version: "1.0.0" -> 1
+func majorVersion(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+	return strconv.Atoi(parts[0])
+}
+
+// Check whether two versions of a protocol can talk to each other
+func compatibleVersions(a string, b string) bool {
+	major_a, err := majorVersion(a)
+	if err != nil {
+		return false
+	}
+	major_b, err := majorVersion(b)
+	if err != nil {
+		return false
+	}
+	return major_a == major_b
+}
+
+// Check whether two protocol IDs are versions of the same protocol that can talk to each other
+func compatibleProtocols(a protocol.ID, b protocol.ID) bool {
+	return protocolName(a) == protocolName(b) && compatibleVersions(protocolVersion(a), protocolVersion(b))
+}
+
+// Split the protocols of a peer into the versions of p that are compatible with p and the ones that are not
+func matchProtocols(p protocol.ID, peer_protocols []protocol.ID) ([]protocol.ID, []protocol.ID) {
+	var compatible, incompatible []protocol.ID
+	for _, pp := range peer_protocols {
+		if protocolName(pp) != protocolName(p) {
+			continue
+		}
+		if compatibleVersions(protocolVersion(pp), protocolVersion(p)) {
+			compatible = append(compatible, pp)
+		} else {
+			incompatible = append(incompatible, pp)
+		}
+	}
+	return compatible, incompatible
+}
+
+// Keep only the ARGO protocols of a list, sorted
+func argoProtocols(protocols []protocol.ID) []protocol.ID {
+	var argo []protocol.ID
+	for _, p := range protocols {
+		if strings.HasPrefix(string(p), PROTOCOL_PREFIX) {
+			argo = append(argo, p)
+		}
+	}
+	sort.Slice(argo, func(i, j int) bool { return argo[i] < argo[j] })
+	return argo
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+	WORKER POOLS
+	Each protocol of a node has a bounded queue of incoming messages and a pool of workers
+	running the handler of the protocol, so that a flooding peer fills the queue of one protocol
+	instead of stalling the whole node.
+	When the queue is full, the overload policy of the pool decides what happens:
+		POOL_BLOCK: the stream of the message is not read until there is room, so the sender slows down
+		POOL_DROP_OLDEST: the oldest message of the queue is dropped to make room
+		POOL_DROP_NEW: the new message is dropped
+	Overloads are counted and logged with the "overload" event.
+	The time spent by messages in the queue is measured separately from the time spent in the handler.
+	On the virtual clock there are no pools: handlers run inside the events of the clock,
+	so that runs stay deterministic.
+*/
+type PoolConfig struct {
+	size	int			// Messages that can wait in the queue
+	workers	int			// Messages handled at the same time
+	policy	string		// POOL_BLOCK, POOL_DROP_OLDEST or POOL_DROP_NEW
+}
+
+type PoolStats struct {
+	received		int				// Messages given to the pool
+	processed		int				// Messages handled
+	dropped			int				// Messages dropped because the queue was full
+	blocked			int				// Messages that waited for room in the queue
+	wait			time.Duration	// Total time spent in the queue by the handled messages
+	max_wait		time.Duration
+	processing		time.Duration	// Total time spent in the handler
+	max_processing	time.Duration
+}
+
+type workerPool struct {
+	protocol	protocol.ID
+	node_id		string					// Overloads are logged under this node
+	config		PoolConfig
+	handler		messageHandler
+	mu			sync.Mutex
+	not_empty	*sync.Cond
+	not_full	*sync.Cond
+	queue		[]queuedMessage
+	closed		bool
+	stats		PoolStats
+}
+
+type queuedMessage struct {
+	ctx	context.Context
+	m	Message
+	at	time.Time		// When the message entered the queue
+}
+
+// Check that a pool configuration can be used
+func validPoolConfig(config PoolConfig) error {
+	if config.size < 1 || config.workers < 1 {
+		return fmt.Errorf("invalid pool of %d workers with a queue of %d messages", config.workers, config.size)
+	}
+	if config.policy != POOL_BLOCK && config.policy != POOL_DROP_OLDEST && config.policy != POOL_DROP_NEW {
+		return fmt.Errorf("unknown overload policy %s: use %s, %s or %s", config.policy, POOL_BLOCK, POOL_DROP_OLDEST, POOL_DROP_NEW)
+	}
+	return nil
+}
+
+// Return a new pool running handler on the messages of the protocol, with its workers started
+func newWorkerPool(node_id string, protocol protocol.ID, config PoolConfig, handler messageHandler) *workerPool {
+	p := &workerPool{
+		protocol:	protocol,
+		node_id:	node_id,
+		config:		config,
+		handler:	handler,
+	}
+	p.not_empty = sync.NewCond(&p.mu)
+	p.not_full = sync.NewCond(&p.mu)
+	for i := 0; i < config.workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Put a message in the queue, applying the overload policy if the queue is full
+func (p *workerPool) push(ctx context.Context, m Message) {
+	p.mu.Lock()
+	p.stats.received++
+	event := ""
+	accepted := true
+	if len(p.queue) >= p.config.size {
+		switch p.config.policy {
+		case POOL_BLOCK:
+			p.stats.blocked++
+			event = p.overloadEvent(p.stats.blocked, "message waited for room")
+			for len(p.queue) >= p.config.size && !p.closed {
+				p.not_full.Wait()
+			}
+		case POOL_DROP_OLDEST:
+			p.queue = p.queue[1:]
+			p.stats.dropped++
+			event = p.overloadEvent(p.stats.dropped, "oldest message dropped")
+		case POOL_DROP_NEW:
+			accepted = false
+			p.stats.dropped++
+			event = p.overloadEvent(p.stats.dropped, "new message dropped")
+		}
+	}
+	if accepted && !p.closed {
+		p.queue = append(p.queue, queuedMessage{ctx: ctx, m: m, at: clock.Now()})
+		p.not_empty.Signal()
+	}
+	p.mu.Unlock()
+
+	if event != "" {
+		logEvent(p.node_id, PRINTOPTION, event)
+	}
+}
+
+// Event of an overload, to be logged the first time and then once every POOL_LOG_EVERY,
+// so that a flood doesn't flood the log too. Empty if the overload must not be logged
+func (p *workerPool) overloadEvent(count int, what string) string {
+	if count != 1 && count%POOL_LOG_EVERY != 0 {
+		return ""
+	}
+	return fmt.Sprintf("overload %s - Queue of %d messages full, %s (%s), %d times so far", p.protocol, p.config.size, what, p.config.policy, count)
+}
+
+// Handle the messages of the queue, until the pool is closed and the queue is empty
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.not_empty.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		qm := p.queue[0]
+		p.queue = p.queue[1:]
+		p.not_full.Signal()
+		p.mu.Unlock()
+
+		start := clock.Now()
+		err := p.handler(qm.ctx, qm.m)
+		end := clock.Now()
+		if err != nil {
+			printError(err)
+		}
+
+		wait, processing := start.Sub(qm.at), end.Sub(start)
+		p.mu.Lock()
+		p.stats.processed++
+		p.stats.wait += wait
+		if wait > p.stats.max_wait {
+			p.stats.max_wait = wait
+		}
+		p.stats.processing += processing
+		if processing > p.stats.max_processing {
+			p.stats.max_processing = processing
+		}
+		p.mu.Unlock()
+	}
+}
+
+// No more messages are accepted, the ones in the queue are still handled
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.not_empty.Broadcast()
+	p.not_full.Broadcast()
+}
+
+// Current statistics of the pool and number of messages in the queue
+func (p *workerPool) getStats() (PoolStats, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats, len(p.queue)
+}
+
+// Print the statistics of a pool on one line
+func (p *workerPool) toString() string {
+	stats, queued := p.getStats()
+	str := fmt.Sprintf("%s	%d/%d queued, %d workers, %s	received %d, processed %d, dropped %d, blocked %d",
+		p.protocol, queued, p.config.size, p.config.workers, p.config.policy,
+		stats.received, stats.processed, stats.dropped, stats.blocked)
+	if stats.processed > 0 {
+		n := time.Duration(stats.processed)
+		str += fmt.Sprintf("	wait avg %s max %s, processing avg %s max %s",
+			(stats.wait / n).Round(time.Microsecond), stats.max_wait.Round(time.Microsecond),
+			(stats.processing / n).Round(time.Microsecond), stats.max_processing.Round(time.Microsecond))
+	}
+	return str
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Wait until cond is true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Fill a pool of one worker and a queue of two messages, then push one more message with the policy.
+// Return the IDs of the messages handled, in order, and the statistics of the pool
+func overloadPool(t *testing.T, policy string) ([]string, PoolStats) {
+	inTestLayout(t)
+	clock = realClock{}
+
+	var mu sync.Mutex
+	var handled []string
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	p := newWorkerPool("test", PROTOCOL_NAB, PoolConfig{size: 2, workers: 1, policy: policy}, func(ctx context.Context, m Message) error {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		handled = append(handled, m.ID)
+		mu.Unlock()
+		return nil
+	})
+	defer p.close()
+
+	// The worker holds m0, the queue holds m1 and m2
+	p.push(context.Background(), Message{ID: "m0"})
+	<-started
+	p.push(context.Background(), Message{ID: "m1"})
+	p.push(context.Background(), Message{ID: "m2"})
+
+	pushed := make(chan struct{})
+	go func() {
+		p.push(context.Background(), Message{ID: "m3"})
+		close(pushed)
+	}()
+	if policy == POOL_BLOCK {
+		waitFor(t, "m3 to wait for room", func() bool {
+			stats, _ := p.getStats()
+			return stats.blocked == 1
+		})
+		select {
+		case <-pushed:
+			t.Fatalf("%s: m3 pushed while the queue is full", policy)
+		case <-time.After(20 * time.Millisecond):
+		}
+	} else {
+		<-pushed
+	}
+	if _, queued := p.getStats(); queued != 2 {
+		t.Fatalf("%s: %d messages queued, expected 2", policy, queued)
+	}
+
+	close(release)
+	<-pushed
+	stats := PoolStats{}
+	waitFor(t, "the queue to be handled", func() bool {
+		var queued int
+		stats, queued = p.getStats()
+		mu.Lock()
+		defer mu.Unlock()
+		return queued == 0 && stats.processed == len(handled) && stats.processed + stats.dropped == 4
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string{}, handled...), stats
+}
+
+// Each overload policy keeps the messages it should, and counts the overload
+func TestWorkerPoolPolicies(t *testing.T) {
+	tests := []struct {
+		policy		string
+		handled		[]string
+		dropped		int
+		blocked		int
+	}{
+		{POOL_BLOCK, []string{"m0", "m1", "m2", "m3"}, 0, 1},
+		{POOL_DROP_OLDEST, []string{"m0", "m2", "m3"}, 1, 0},
+		{POOL_DROP_NEW, []string{"m0", "m1", "m2"}, 1, 0},
+	}
+	for _, test := range tests {
+		handled, stats := overloadPool(t, test.policy)
+		if fmt.Sprint(handled) != fmt.Sprint(test.handled) {
+			t.Errorf("%s: handled %v, expected %v", test.policy, handled, test.handled)
+		}
+		if stats.received != 4 || stats.dropped != test.dropped || stats.blocked != test.blocked {
+			t.Errorf("%s: received %d, dropped %d, blocked %d, expected 4, %d, %d", test.policy, stats.received, stats.dropped, stats.blocked, test.dropped, test.blocked)
+		}
+	}
+}
+
+// A closed pool accepts no more messages, but handles the ones in its queue
+func TestWorkerPoolClose(t *testing.T) {
+	inTestLayout(t)
+	clock = realClock{}
+
+	handled := make(chan string, 4)
+	release := make(chan struct{})
+	p := newWorkerPool("test", PROTOCOL_NAB, PoolConfig{size: 4, workers: 1, policy: POOL_BLOCK}, func(ctx context.Context, m Message) error {
+		<-release
+		handled <- m.ID
+		return nil
+	})
+	p.push(context.Background(), Message{ID: "m0"})
+	p.push(context.Background(), Message{ID: "m1"})
+	p.close()
+	p.push(context.Background(), Message{ID: "m2"})
+	close(release)
+
+	for _, id := range []string{"m0", "m1"} {
+		select {
+		case got := <-handled:
+			if got != id {
+				t.Fatalf("handled %s, expected %s", got, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s never handled", id)
+		}
+	}
+	waitFor(t, "the workers to count the messages", func() bool {
+		stats, _ := p.getStats()
+		return stats.processed == 2
+	})
+	select {
+	case got := <-handled:
+		t.Fatalf("%s handled after the pool was closed", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}